@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"net/http"
@@ -10,25 +11,18 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string) (string, error) {
-	bytesString := []byte(password)
-
-	hashedPassword, err := bcrypt.GenerateFromPassword(bytesString, bcrypt.DefaultCost)
-
-	if err != nil {
-		return "", err
-	}
+var defaultPasswordHasher = &PasswordHasher{params: DefaultArgon2Params}
 
-	return string(hashedPassword), nil
+// HashPassword hashes with argon2id and DefaultArgon2Params. Use a
+// PasswordHasher to choose the parameters.
+func HashPassword(password string) (string, error) {
+	return defaultPasswordHasher.Hash(password)
 }
 
 func CheckPasswordHash(password, hash string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-
-	return err
+	return defaultPasswordHasher.Check(password, hash)
 }
 
 func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
@@ -91,7 +85,7 @@ func MakeRefreshToken() (string, error) {
 	_, err := rand.Read(bytesArr)
 
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	convertedString := hex.EncodeToString(bytesArr)
@@ -112,4 +106,33 @@ func GetApiKey(headers http.Header) (string, error) {
 	}
 
 	return splitStrings[1], nil
-}
\ No newline at end of file
+}
+
+const apiKeyPrefix = "chirpy_"
+
+// MakeAPIKey returns a new personal API key and the short prefix shown to the
+// user to tell keys apart. Only HashToken(key) is stored.
+func MakeAPIKey() (key string, prefix string, err error) {
+	bytesArr := make([]byte, 32)
+	_, err = rand.Read(bytesArr)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	secret := hex.EncodeToString(bytesArr)
+	prefix = secret[:8]
+
+	return apiKeyPrefix + secret, prefix, nil
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// HashToken hashes high-entropy secrets (API keys, refresh tokens) before
+// they are stored. A fast hash is fine here since they can't be brute forced.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
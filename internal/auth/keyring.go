@@ -0,0 +1,493 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// SigningKey is a key used to verify, and when the private half is known to
+// sign, chirpy access tokens. Asymmetric keys are identified by their ID, which
+// is written to the "kid" header of every token they sign.
+type SigningKey struct {
+	ID        string
+	method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+}
+
+func (k *SigningKey) Algorithm() string {
+	return k.method.Alg()
+}
+
+func (k *SigningKey) CanSign() bool {
+	return k.signKey != nil
+}
+
+func (k *SigningKey) isSymmetric() bool {
+	_, ok := k.method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+// NewHMACKey wraps the shared JWT_SECRET. HMAC keys have no ID so that tokens
+// signed with them look exactly like the ones issued before key rotation
+// existed.
+func NewHMACKey(secret string) *SigningKey {
+	return &SigningKey{
+		method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+}
+
+// ParsePrivateKeyPEM accepts RSA (PKCS#1 or PKCS#8), ECDSA P-256 and Ed25519
+// private keys.
+func ParsePrivateKeyPEM(id string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key cannot be used for signing")
+	}
+
+	key, err := newAsymmetricKey(id, signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	key.signKey = signer
+	return key, nil
+}
+
+// ParsePublicKeyPEM loads a verification-only key, typically one that has been
+// rotated out but whose tokens have not expired yet.
+func ParsePublicKeyPEM(id string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newAsymmetricKey(id, parsed)
+}
+
+func newAsymmetricKey(id string, public any) (*SigningKey, error) {
+	if id == "" {
+		return nil, errors.New("asymmetric keys need an id")
+	}
+
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return &SigningKey{ID: id, method: jwt.SigningMethodRS256, verifyKey: pub}, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		return &SigningKey{ID: id, method: jwt.SigningMethodES256, verifyKey: pub}, nil
+	case ed25519.PublicKey:
+		return &SigningKey{ID: id, method: jwt.SigningMethodEdDSA, verifyKey: pub}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+}
+
+// KeyRing signs new tokens with a single active key and verifies tokens
+// signed by any key it holds, so keys can be rotated without logging everyone
+// out.
+type KeyRing struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+}
+
+func NewKeyRing(active *SigningKey, others ...*SigningKey) (*KeyRing, error) {
+	if active == nil || !active.CanSign() {
+		return nil, errors.New("the active key must be able to sign")
+	}
+
+	ring := &KeyRing{
+		active: active,
+		keys:   map[string]*SigningKey{},
+	}
+
+	for _, key := range append([]*SigningKey{active}, others...) {
+		if _, exists := ring.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		ring.keys[key.ID] = key
+	}
+
+	return ring, nil
+}
+
+// LoadKeyRing builds the key ring from the environment. Without a key
+// directory it falls back to HS256 with the shared secret. Otherwise every
+// *.pem file in dir is loaded with its file name as key ID, activeID selects
+// the signing key, and a non-empty legacySecret keeps HS256 tokens valid while
+// they expire.
+func LoadKeyRing(dir, activeID, legacySecret string) (*KeyRing, error) {
+	if dir == "" {
+		return NewKeyRing(NewHMACKey(legacySecret))
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*SigningKey{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+
+		key, err := ParsePrivateKeyPEM(id, data)
+		if err != nil {
+			key, err = ParsePublicKeyPEM(id, data)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+
+		keys[id] = key
+	}
+
+	active, ok := keys[activeID]
+	if !ok {
+		return nil, fmt.Errorf("active signing key %q not found in %s", activeID, dir)
+	}
+
+	var others []*SigningKey
+	for id, key := range keys {
+		if id != activeID {
+			others = append(others, key)
+		}
+	}
+
+	if legacySecret != "" {
+		others = append(others, NewHMACKey(legacySecret))
+	}
+
+	return NewKeyRing(active, others...)
+}
+
+// Claims are the claims carried by chirpy access tokens. Tokens without a
+// scope claim are full sessions issued by POST /api/login.
+type Claims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+}
+
+func (kr *KeyRing) MakeJWT(userID uuid.UUID, expiresIn time.Duration) (string, error) {
+	return kr.MakeScopedJWT(userID, nil, expiresIn)
+}
+
+// MakeScopedJWT issues a token restricted to the given scopes. A nil scope
+// list issues a full session token.
+func (kr *KeyRing) MakeScopedJWT(userID uuid.UUID, scopes []string, expiresIn time.Duration) (string, error) {
+	if scopes != nil && len(scopes) == 0 {
+		return "", errors.New("a scoped token needs at least one scope")
+	}
+
+	jwtToken := jwt.NewWithClaims(kr.active.method, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		Scope: FormatScopes(scopes),
+	})
+
+	if kr.active.ID != "" {
+		jwtToken.Header["kid"] = kr.active.ID
+	}
+
+	return jwtToken.SignedString(kr.active.signKey)
+}
+
+// ParseJWT validates an access token. Tokens issued for another audience,
+// such as two-factor challenges, are rejected.
+func (kr *KeyRing) ParseJWT(tokenString string) (*Claims, error) {
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, &claims, kr.keyFunc, jwt.WithExpirationRequired())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(claims.Audience) > 0 {
+		return nil, errors.New("not an access token")
+	}
+
+	return &claims, nil
+}
+
+const challengeAudience = "chirpy:2fa"
+
+// MakeChallengeJWT issues the token POST /api/login returns instead of a
+// session when the account has two-factor authentication enabled. It proves
+// the password was checked and is only accepted by ValidateChallengeJWT. Its
+// random jti lets callers make sure it is only redeemed once.
+func (kr *KeyRing) MakeChallengeJWT(userID uuid.UUID, expiresIn time.Duration) (string, error) {
+	jwtToken := jwt.NewWithClaims(kr.active.method, jwt.RegisteredClaims{
+		Issuer:    "chirpy",
+		Audience:  jwt.ClaimStrings{challengeAudience},
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+		Subject:   userID.String(),
+		ID:        uuid.NewString(),
+	})
+
+	if kr.active.ID != "" {
+		jwtToken.Header["kid"] = kr.active.ID
+	}
+
+	return jwtToken.SignedString(kr.active.signKey)
+}
+
+// Challenge is a validated two-factor challenge.
+type Challenge struct {
+	UserID    uuid.UUID
+	ID        string
+	ExpiresAt time.Time
+}
+
+func (kr *KeyRing) ValidateChallengeJWT(tokenString string) (Challenge, error) {
+	claims := jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, &claims, kr.keyFunc,
+		jwt.WithExpirationRequired(),
+		jwt.WithAudience(challengeAudience),
+	)
+
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	if claims.ID == "" {
+		return Challenge{}, errors.New("challenge has no jti")
+	}
+
+	userID, err := uuid.Parse(claims.Subject)
+
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	return Challenge{UserID: userID, ID: claims.ID, ExpiresAt: claims.ExpiresAt.Time}, nil
+}
+
+func (kr *KeyRing) ValidateJWT(tokenString string) (uuid.UUID, error) {
+	claims, err := kr.ParseJWT(tokenString)
+
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return uuid.Parse(claims.Subject)
+}
+
+func (kr *KeyRing) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := kr.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+
+	return key.verifyKey, nil
+}
+
+// JSONWebKey is the public half of an asymmetric signing key as described by
+// RFC 7517.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS lists the public keys of the ring. HMAC secrets are never published.
+func (kr *KeyRing) JWKS() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+
+	for _, key := range kr.keys {
+		if key.isSymmetric() {
+			continue
+		}
+
+		jwk := JSONWebKey{
+			Kid: key.ID,
+			Use: "sig",
+			Alg: key.Algorithm(),
+		}
+
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encodeSegment(pub.N.Bytes())
+			jwk.E = encodeSegment(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			ecdhKey, err := pub.ECDH()
+			if err != nil {
+				continue
+			}
+			// Uncompressed point: 0x04 || X || Y
+			point := ecdhKey.Bytes()
+			size := (len(point) - 1) / 2
+			jwk.Kty = "EC"
+			jwk.Crv = "P-256"
+			jwk.X = encodeSegment(point[1 : 1+size])
+			jwk.Y = encodeSegment(point[1+size:])
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = encodeSegment(pub)
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].Kid < set.Keys[j].Kid
+	})
+
+	return set
+}
+
+// PublicKey decodes the key so it can verify tokens signed by another
+// issuer, such as an OpenID Connect provider.
+func (k JSONWebKey) PublicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("malformed RSA modulus: %w", err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("malformed RSA exponent")
+		}
+
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+
+		return pub, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("malformed EC point")
+		}
+
+		// Uncompressed point: 0x04 || X || Y, checked to be on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, errors.New("invalid EC point")
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed Ed25519 key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func pemEncodePrivateKey(t *testing.T, key any) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func pemEncodePublicKey(t *testing.T, key any) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestKeyRingAlgorithms(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	cases := map[string]any{
+		"RS256": rsaKey,
+		"ES256": ecKey,
+		"EdDSA": edKey,
+	}
+
+	for alg, privateKey := range cases {
+		key, err := ParsePrivateKeyPEM("key-"+alg, pemEncodePrivateKey(t, privateKey))
+		if err != nil {
+			t.Errorf("%s: failed to parse key: %v", alg, err)
+			continue
+		}
+
+		if key.Algorithm() != alg {
+			t.Errorf("Expected algorithm %s, got %s", alg, key.Algorithm())
+		}
+
+		ring, err := NewKeyRing(key)
+		if err != nil {
+			t.Errorf("%s: failed to build key ring: %v", alg, err)
+			continue
+		}
+
+		userID := uuid.New()
+		token, err := ring.MakeJWT(userID, time.Hour)
+		if err != nil {
+			t.Errorf("%s: failed to sign token: %v", alg, err)
+			continue
+		}
+
+		returnedID, err := ring.ValidateJWT(token)
+		if err != nil {
+			t.Errorf("%s: failed to validate token: %v", alg, err)
+			continue
+		}
+
+		if returnedID != userID {
+			t.Errorf("%s: user %v does not correspond to user %v", alg, userID, returnedID)
+		}
+
+		jwks := ring.JWKS()
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != key.ID || jwks.Keys[0].Alg != alg {
+			t.Errorf("%s: unexpected JWKS %+v", alg, jwks)
+		}
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	oldPrivate, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, newPrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "2024-old.pem"), pemEncodePrivateKey(t, oldPrivate), 0600)
+	os.WriteFile(filepath.Join(dir, "2025-new.pem"), pemEncodePrivateKey(t, newPrivate), 0600)
+
+	oldRing, err := LoadKeyRing(dir, "2024-old", "")
+	if err != nil {
+		t.Fatalf("Failed to load key ring: %v", err)
+	}
+
+	legacyToken, err := MakeJWT(uuid.New(), "legacysecret", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create legacy token: %v", err)
+	}
+
+	oldToken, err := oldRing.MakeJWT(uuid.New(), time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	// Rotate: the new key signs, the old key only verifies
+	os.WriteFile(filepath.Join(dir, "2024-old.pem"), pemEncodePublicKey(t, &oldPrivate.PublicKey), 0600)
+
+	newRing, err := LoadKeyRing(dir, "2025-new", "legacysecret")
+	if err != nil {
+		t.Fatalf("Failed to load rotated key ring: %v", err)
+	}
+
+	if _, err := newRing.ValidateJWT(oldToken); err != nil {
+		t.Errorf("Tokens signed by the previous key are rejected: %v", err)
+	}
+
+	if _, err := newRing.ValidateJWT(legacyToken); err != nil {
+		t.Errorf("Legacy HS256 tokens are rejected: %v", err)
+	}
+
+	if _, err := oldRing.ValidateJWT(legacyToken); err == nil {
+		t.Errorf("HS256 tokens are accepted without a legacy secret")
+	}
+
+	if len(newRing.JWKS().Keys) != 2 {
+		t.Errorf("Expected both public keys to be published, got %+v", newRing.JWKS())
+	}
+
+	if _, err := LoadKeyRing(dir, "2024-old", ""); err == nil {
+		t.Errorf("A verification-only key was accepted as the active key")
+	}
+}
+
+func TestKeyRingRejectsUnknownKeys(t *testing.T) {
+	_, privateA, _ := ed25519.GenerateKey(rand.Reader)
+	_, privateB, _ := ed25519.GenerateKey(rand.Reader)
+
+	keyA, _ := ParsePrivateKeyPEM("shared-id", pemEncodePrivateKey(t, privateA))
+	keyB, _ := ParsePrivateKeyPEM("shared-id", pemEncodePrivateKey(t, privateB))
+
+	ringA, _ := NewKeyRing(keyA)
+	ringB, _ := NewKeyRing(keyB)
+
+	token, err := ringA.MakeJWT(uuid.New(), time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	if _, err := ringB.ValidateJWT(token); err == nil {
+		t.Errorf("Token signed by a different key was accepted")
+	}
+
+	expired, _ := ringA.MakeJWT(uuid.New(), -time.Minute)
+	if _, err := ringA.ValidateJWT(expired); err == nil {
+		t.Errorf("Failed to catch expired tokens")
+	}
+}
+
+func TestChallengeTokens(t *testing.T) {
+	ring, _ := NewKeyRing(NewHMACKey("testsecret"))
+	userID := uuid.New()
+
+	challenge, err := ring.MakeChallengeJWT(userID, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+
+	if _, err := ring.ValidateJWT(challenge); err == nil {
+		t.Errorf("A challenge token was accepted as an access token")
+	}
+
+	validated, err := ring.ValidateChallengeJWT(challenge)
+	if err != nil || validated.UserID != userID || validated.ID == "" {
+		t.Errorf("Failed to validate challenge token: %+v, %v", validated, err)
+	}
+
+	other, _ := ring.MakeChallengeJWT(userID, time.Minute)
+	if otherValidated, _ := ring.ValidateChallengeJWT(other); otherValidated.ID == validated.ID {
+		t.Errorf("Two challenges share the jti %s", validated.ID)
+	}
+
+	session, _ := ring.MakeJWT(userID, time.Minute)
+	if _, err := ring.ValidateChallengeJWT(session); err == nil {
+		t.Errorf("An access token was accepted as a challenge token")
+	}
+}
+
+func TestJSONWebKeyPublicKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, privateKey := range []any{rsaKey, ecKey, edKey} {
+		key, _ := ParsePrivateKeyPEM("key", pemEncodePrivateKey(t, privateKey))
+		ring, _ := NewKeyRing(key)
+
+		token, _ := ring.MakeJWT(uuid.New(), time.Hour)
+
+		jwk := ring.JWKS().Keys[0]
+		publicKey, err := jwk.PublicKey()
+		if err != nil {
+			t.Errorf("%s: failed to decode JWK: %v", jwk.Alg, err)
+			continue
+		}
+
+		_, err = jwt.Parse(token, func(*jwt.Token) (any, error) { return publicKey, nil })
+		if err != nil {
+			t.Errorf("%s: decoded key does not verify tokens: %v", jwk.Alg, err)
+		}
+	}
+
+	if _, err := (JSONWebKey{Kty: "EC", Crv: "P-256", X: "AAAA", Y: "AAAA"}).PublicKey(); err == nil {
+		t.Errorf("Malformed EC key accepted")
+	}
+
+	if _, err := (JSONWebKey{Kty: "oct"}).PublicKey(); err == nil {
+		t.Errorf("Symmetric key accepted")
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testArgon2Params = Argon2Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func TestPasswordHasher(t *testing.T) {
+	hasher, err := NewPasswordHasher(testArgon2Params)
+
+	if err != nil {
+		t.Fatalf("Failed to create hasher: %v", err)
+	}
+
+	hash, err := hasher.Hash("correct horse battery staple")
+
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Unexpected PHC string %s", hash)
+	}
+
+	if err := hasher.Check("correct horse battery staple", hash); err != nil {
+		t.Errorf("Correct password rejected: %v", err)
+	}
+
+	if err := hasher.Check("Tr0ub4dor&3", hash); err != ErrMismatchedPassword {
+		t.Errorf("Wrong password not rejected: %v", err)
+	}
+
+	if hasher.NeedsRehash(hash) {
+		t.Errorf("Hash with current parameters flagged for rehash")
+	}
+
+	stronger := testArgon2Params
+	stronger.Iterations = 2
+	strongerHasher, _ := NewPasswordHasher(stronger)
+
+	if !strongerHasher.NeedsRehash(hash) {
+		t.Errorf("Hash with outdated parameters not flagged for rehash")
+	}
+
+	// Old parameters still verify
+	if err := strongerHasher.Check("correct horse battery staple", hash); err != nil {
+		t.Errorf("Hash with old parameters rejected: %v", err)
+	}
+}
+
+func TestPasswordHasherLongPasswords(t *testing.T) {
+	hasher, _ := NewPasswordHasher(testArgon2Params)
+
+	// bcrypt only looks at the first 72 bytes
+	prefix := strings.Repeat("a", 72)
+	hash, _ := hasher.Hash(prefix + "b")
+
+	if err := hasher.Check(prefix+"c", hash); err == nil {
+		t.Errorf("Passwords longer than 72 bytes are truncated")
+	}
+}
+
+func TestPasswordHasherBcrypt(t *testing.T) {
+	hasher, _ := NewPasswordHasher(testArgon2Params)
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+
+	if err := hasher.Check("hunter2", string(legacy)); err != nil {
+		t.Errorf("bcrypt hash rejected: %v", err)
+	}
+
+	if err := hasher.Check("hunter3", string(legacy)); err != ErrMismatchedPassword {
+		t.Errorf("Wrong password not rejected: %v", err)
+	}
+
+	if !hasher.NeedsRehash(string(legacy)) {
+		t.Errorf("bcrypt hash not flagged for rehash")
+	}
+
+	if err := hasher.Check("hunter2", "unset"); err == nil {
+		t.Errorf("Malformed hash accepted")
+	}
+}
+
+func TestArgon2ParamsValidate(t *testing.T) {
+	if err := DefaultArgon2Params.Validate(); err != nil {
+		t.Errorf("Default parameters are invalid: %v", err)
+	}
+
+	invalid := DefaultArgon2Params
+	invalid.Iterations = 0
+
+	if _, err := NewPasswordHasher(invalid); err == nil {
+		t.Errorf("Zero iterations accepted")
+	}
+}
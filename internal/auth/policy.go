@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy is checked whenever a password is set. Length is counted in
+// characters, not bytes.
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	DisallowEmail bool
+	// Breached is optional. When set, known-breached passwords are rejected.
+	Breached BreachedPasswords
+}
+
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Check returns every rule password breaks, or nil if it is acceptable.
+func (p PasswordPolicy) Check(password, email string) ([]PolicyViolation, error) {
+	var violations []PolicyViolation
+
+	length := utf8.RuneCountInString(password)
+
+	if length < p.MinLength {
+		violations = append(violations, PolicyViolation{
+			Rule:    "min_length",
+			Message: fmt.Sprintf("must be at least %d characters long", p.MinLength),
+		})
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, PolicyViolation{
+			Rule:    "max_length",
+			Message: fmt.Sprintf("must be at most %d characters long", p.MaxLength),
+		})
+	}
+
+	classes := []struct {
+		required bool
+		rule     string
+		message  string
+		matches  func(rune) bool
+	}{
+		{p.RequireLower, "lowercase", "must contain a lowercase letter", unicode.IsLower},
+		{p.RequireUpper, "uppercase", "must contain an uppercase letter", unicode.IsUpper},
+		{p.RequireDigit, "digit", "must contain a digit", unicode.IsDigit},
+		{p.RequireSymbol, "symbol", "must contain a symbol", isSymbol},
+	}
+
+	for _, class := range classes {
+		if class.required && !strings.ContainsFunc(password, class.matches) {
+			violations = append(violations, PolicyViolation{Rule: class.rule, Message: class.message})
+		}
+	}
+
+	if p.DisallowEmail && email != "" {
+		localPart, _, _ := strings.Cut(email, "@")
+
+		if strings.EqualFold(password, email) || strings.EqualFold(password, localPart) {
+			violations = append(violations, PolicyViolation{
+				Rule:    "email",
+				Message: "must not be your email address",
+			})
+		}
+	}
+
+	if p.Breached != nil && password != "" {
+		breached, err := p.Breached.Contains(password)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if breached {
+			violations = append(violations, PolicyViolation{
+				Rule:    "breached",
+				Message: "appears in a list of breached passwords, choose another one",
+			})
+		}
+	}
+
+	return violations, nil
+}
+
+func isSymbol(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+}
+
+// BreachedPasswords answers whether a password is known to have leaked.
+// Lookups are done by SHA-1 prefix (the k-anonymity scheme used by Have I
+// Been Pwned) so large lists never need to be loaded or queried in full.
+type BreachedPasswords interface {
+	Contains(password string) (bool, error)
+}
+
+//go:embed breached_passwords.txt
+var bundledBreachedPasswords string
+
+// BundledBreachedPasswords is a small list of the most common passwords
+// shipped with chirpy, used when no list is configured.
+func BundledBreachedPasswords() BreachedPasswords {
+	list, _ := parseHashList(strings.NewReader(bundledBreachedPasswords))
+	return list
+}
+
+// LoadBreachedPasswords opens a breached password list. path is either a
+// file of "SHA1[:COUNT]" lines, or a directory of range files named after a
+// 5 character SHA-1 prefix (ABCDE.txt) holding "SUFFIX[:COUNT]" lines, as
+// produced by the Have I Been Pwned downloader. Range files are read on
+// demand.
+func LoadBreachedPasswords(path string) (BreachedPasswords, error) {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return rangeDirectory(path), nil
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return parseHashList(file)
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// hashList maps SHA-1 prefixes to the suffixes known under them.
+type hashList map[string]map[string]bool
+
+func parseHashList(r io.Reader) (hashList, error) {
+	list := hashList{}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+
+		if hash == "" {
+			continue
+		}
+
+		if len(hash) != 40 {
+			return nil, fmt.Errorf("malformed SHA-1 hash %q", hash)
+		}
+
+		hash = strings.ToUpper(hash)
+		prefix, suffix := hash[:5], hash[5:]
+
+		if list[prefix] == nil {
+			list[prefix] = map[string]bool{}
+		}
+
+		list[prefix][suffix] = true
+	}
+
+	return list, scanner.Err()
+}
+
+func (l hashList) Contains(password string) (bool, error) {
+	hash := sha1Hex(password)
+	return l[hash[:5]][hash[5:]], nil
+}
+
+type rangeDirectory string
+
+func (d rangeDirectory) Contains(password string) (bool, error) {
+	hash := sha1Hex(password)
+
+	file, err := os.Open(filepath.Join(string(d), hash[:5]+".txt"))
+
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		suffix, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+
+		if strings.EqualFold(suffix, hash[5:]) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
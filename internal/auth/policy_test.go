@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func violatedRules(violations []PolicyViolation) map[string]bool {
+	rules := map[string]bool{}
+	for _, v := range violations {
+		rules[v.Rule] = true
+	}
+	return rules
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:     8,
+		MaxLength:     16,
+		RequireLower:  true,
+		RequireUpper:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		DisallowEmail: true,
+	}
+
+	violations, _ := policy.Check("", "user@example.com")
+	rules := violatedRules(violations)
+
+	for _, rule := range []string{"min_length", "lowercase", "uppercase", "digit", "symbol"} {
+		if !rules[rule] {
+			t.Errorf("Empty password did not violate %s", rule)
+		}
+	}
+
+	violations, _ = policy.Check("Str0ng!Passphrase-too-long", "user@example.com")
+	if rules := violatedRules(violations); len(rules) != 1 || !rules["max_length"] {
+		t.Errorf("Expected only max_length, got %+v", violations)
+	}
+
+	violations, _ = policy.Check("Str0ng!Pass", "user@example.com")
+	if violations != nil {
+		t.Errorf("Valid password rejected: %+v", violations)
+	}
+
+	// Length counts characters, not bytes
+	violations, _ = PasswordPolicy{MinLength: 4, MaxLength: 4}.Check("ééé€", "")
+	if violations != nil {
+		t.Errorf("Multi-byte characters miscounted: %+v", violations)
+	}
+
+	emailPolicy := PasswordPolicy{DisallowEmail: true}
+	for _, password := range []string{"user@example.com", "USER@example.com", "user"} {
+		violations, _ = emailPolicy.Check(password, "user@example.com")
+		if !violatedRules(violations)["email"] {
+			t.Errorf("%q was accepted as password for user@example.com", password)
+		}
+	}
+}
+
+func TestBundledBreachedPasswords(t *testing.T) {
+	policy := PasswordPolicy{Breached: BundledBreachedPasswords()}
+
+	violations, err := policy.Check("password123", "")
+	if err != nil || !violatedRules(violations)["breached"] {
+		t.Errorf("password123 not reported as breached: %v %+v", err, violations)
+	}
+
+	violations, _ = policy.Check("a perfectly unguessable passphrase", "")
+	if violations != nil {
+		t.Errorf("Unexpected violations %+v", violations)
+	}
+}
+
+func TestLoadBreachedPasswords(t *testing.T) {
+	dir := t.TempDir()
+
+	// SHA1("hunter2") = F3BBBD66A63D4BF1747940578EC3D0103530E21D
+	listPath := filepath.Join(dir, "list.txt")
+	os.WriteFile(listPath, []byte("f3bbbd66a63d4bf1747940578ec3d0103530e21d:17\n"), 0600)
+
+	rangesPath := filepath.Join(dir, "ranges")
+	os.Mkdir(rangesPath, 0700)
+	os.WriteFile(filepath.Join(rangesPath, "F3BBB.txt"), []byte("0000000000000000000000000000000000A:1\r\nD66A63D4BF1747940578EC3D0103530E21D:17\r\n"), 0600)
+
+	for _, path := range []string{listPath, rangesPath} {
+		breached, err := LoadBreachedPasswords(path)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", path, err)
+		}
+
+		if found, err := breached.Contains("hunter2"); err != nil || !found {
+			t.Errorf("%s: hunter2 not found (%v)", path, err)
+		}
+
+		if found, _ := breached.Contains("hunter3"); found {
+			t.Errorf("%s: hunter3 reported as breached", path)
+		}
+	}
+
+	os.WriteFile(listPath, []byte("not-a-hash\n"), 0600)
+	if _, err := LoadBreachedPasswords(listPath); err == nil {
+		t.Errorf("Malformed list accepted")
+	}
+}
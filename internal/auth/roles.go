@@ -0,0 +1,23 @@
+package auth
+
+import "slices"
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Roles are ordered: each role can do everything the roles before it can.
+var Roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+func IsRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// HasRole reports whether role is required or a role above it. Unknown roles
+// have none.
+func HasRole(role, required string) bool {
+	have := slices.Index(Roles, role)
+	return have >= 0 && have >= slices.Index(Roles, required)
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	ScopeChirpsRead   = "chirps:read"
+	ScopeChirpsWrite  = "chirps:write"
+	ScopeProfileRead  = "profile:read"
+	ScopeProfileWrite = "profile:write"
+	// ScopeKeysManage, ScopeSecurityManage, ScopeClientsManage and
+	// ScopeWebhooksManage are only held by full sessions so a leaked API key
+	// or OAuth token can't be used to mint more credentials, take over the
+	// account's two-factor settings or read webhook signing secrets.
+	ScopeKeysManage     = "keys:manage"
+	ScopeSecurityManage = "security:manage"
+	ScopeClientsManage  = "clients:manage"
+	ScopeWebhooksManage = "webhooks:manage"
+)
+
+// AllScopes is what a full session (a token from POST /api/login) is granted.
+var AllScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileRead, ScopeProfileWrite, ScopeKeysManage, ScopeSecurityManage, ScopeClientsManage, ScopeWebhooksManage}
+
+// DelegableScopes are the scopes that can be granted to API keys and OAuth
+// clients.
+var DelegableScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileRead, ScopeProfileWrite}
+
+// ParseScopes splits a space separated scope list and checks every entry is
+// one of the allowed scopes. Duplicates are dropped.
+func ParseScopes(scope string, allowed []string) ([]string, error) {
+	var scopes []string
+
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(allowed, s) {
+			return nil, fmt.Errorf("unknown scope %q", s)
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+
+	return scopes, nil
+}
+
+func FormatScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func HasScope(granted []string, required string) bool {
+	return slices.Contains(granted, required)
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("chirps:read  chirps:write chirps:read", DelegableScopes)
+
+	if err != nil {
+		t.Errorf("Failed to parse scopes: %v", err)
+	}
+
+	if FormatScopes(scopes) != "chirps:read chirps:write" {
+		t.Errorf("Unexpected scopes %v", scopes)
+	}
+
+	// Session-only scopes can't be delegated
+	_, err = ParseScopes("chirps:read keys:manage", DelegableScopes)
+
+	if err == nil {
+		t.Errorf("keys:manage was accepted as a delegable scope")
+	}
+
+	_, err = ParseScopes("admin", AllScopes)
+
+	if err == nil {
+		t.Errorf("Unknown scopes are not rejected")
+	}
+}
+
+func TestScopedJWT(t *testing.T) {
+	ring, _ := NewKeyRing(NewHMACKey("testsecret"))
+
+	token, err := ring.MakeScopedJWT(uuid.New(), []string{ScopeChirpsRead}, time.Hour)
+
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	claims, err := ring.ParseJWT(token)
+
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+
+	if claims.Scope != ScopeChirpsRead {
+		t.Errorf("Expected scope %s, got %q", ScopeChirpsRead, claims.Scope)
+	}
+
+	session, _ := ring.MakeJWT(uuid.New(), time.Hour)
+	claims, _ = ring.ParseJWT(session)
+
+	if claims.Scope != "" {
+		t.Errorf("Session tokens should not carry a scope claim, got %q", claims.Scope)
+	}
+
+	_, err = ring.MakeScopedJWT(uuid.New(), []string{}, time.Hour)
+
+	if err == nil {
+		t.Errorf("A scoped token without scopes was issued")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	key, prefix, err := MakeAPIKey()
+
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+
+	if !IsAPIKey(key) {
+		t.Errorf("%s is not recognised as an API key", key)
+	}
+
+	if key[len(apiKeyPrefix):len(apiKeyPrefix)+len(prefix)] != prefix {
+		t.Errorf("Prefix %s does not match key %s", prefix, key)
+	}
+
+	if HashToken(key) == key || HashToken(key) != HashToken(key) {
+		t.Errorf("HashToken is not a stable hash")
+	}
+
+	token, _ := MakeJWT(uuid.New(), "testsecret", time.Hour)
+
+	if IsAPIKey(token) {
+		t.Errorf("A JWT was recognised as an API key")
+	}
+}
@@ -0,0 +1,558 @@
+// Package config loads chirpy's settings. Values come from, in increasing
+// order of precedence: the defaults below, an optional YAML file and the
+// environment (including a .env file, loaded without overriding variables
+// that are already set). An empty environment variable counts as unset.
+package config
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/samuelea/chirpy/internal/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// Fields are mapped to environment variables by their env tag. On a struct
+// the tag is a prefix for the variables of its fields. Lists are split on
+// commas unless a sep tag says otherwise, and fields tagged secret are
+// redacted when the configuration is printed.
+type Config struct {
+	LogLevel slog.Level `yaml:"log_level" env:"LOG_LEVEL"`
+
+	Server        Server         `yaml:"server" env:""`
+	Database      Database       `yaml:"database" env:""`
+	JWT           JWT            `yaml:"jwt" env:""`
+	Tokens        Tokens         `yaml:"tokens" env:""`
+	Passwords     Passwords      `yaml:"passwords" env:""`
+	Mail          Mail           `yaml:"mail" env:""`
+	Polka         Polka          `yaml:"polka" env:""`
+	OIDC          []OIDCProvider `yaml:"oidc_providers"`
+	Subscriptions Subscriptions  `yaml:"subscriptions" env:""`
+	Plans         Plans          `yaml:"plans" env:""`
+	Webhooks      Webhooks       `yaml:"webhooks" env:""`
+	Admin         Admin          `yaml:"admin" env:""`
+	Fixtures      Fixtures       `yaml:"fixtures" env:""`
+}
+
+type Server struct {
+	Port              int           `yaml:"port" env:"PORT"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes" env:"HTTP_MAX_HEADER_BYTES"`
+	MaxBodyBytes      int64         `yaml:"max_body_bytes" env:"HTTP_MAX_BODY_BYTES"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	// ShutdownDelay keeps serving after readiness starts failing on
+	// shutdown, before connections are drained.
+	ShutdownDelay    time.Duration `yaml:"shutdown_delay" env:"SHUTDOWN_DELAY"`
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout" env:"READINESS_TIMEOUT"`
+	// TrustProxyHeaders takes the client address from X-Forwarded-For.
+	TrustProxyHeaders bool   `yaml:"trust_proxy_headers" env:"TRUST_PROXY_HEADERS"`
+	MetricsToken      string `yaml:"metrics_token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+type Database struct {
+	URL             string        `yaml:"url" env:"DB_URL" secret:"url"`
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME"`
+	// AutoMigrate applies pending migrations on startup.
+	AutoMigrate bool `yaml:"auto_migrate" env:"DB_AUTO_MIGRATE"`
+}
+
+// JWT signs with the PEM keys in KeysDir when it is set, and with the HMAC
+// Secret otherwise.
+type JWT struct {
+	Secret      string `yaml:"secret" env:"JWT_SECRET" secret:"true"`
+	KeysDir     string `yaml:"keys_dir" env:"JWT_KEYS_DIR"`
+	ActiveKeyID string `yaml:"active_key_id" env:"JWT_ACTIVE_KEY_ID"`
+}
+
+// Tokens are the lifetimes of the tokens chirpy issues. The access and
+// refresh token lifetimes apply to logins and OAuth clients alike.
+type Tokens struct {
+	AccessTokenLifetime            time.Duration `yaml:"access_token_lifetime" env:"ACCESS_TOKEN_LIFETIME"`
+	RefreshTokenLifetime           time.Duration `yaml:"refresh_token_lifetime" env:"REFRESH_TOKEN_LIFETIME"`
+	EmailVerificationTokenLifetime time.Duration `yaml:"email_verification_token_lifetime" env:"EMAIL_VERIFICATION_TOKEN_LIFETIME"`
+	PasswordResetTokenLifetime     time.Duration `yaml:"password_reset_token_lifetime" env:"PASSWORD_RESET_TOKEN_LIFETIME"`
+}
+
+type Passwords struct {
+	Argon2MemoryKiB   uint32 `yaml:"argon2_memory_kib" env:"ARGON2_MEMORY_KIB"`
+	Argon2Iterations  uint32 `yaml:"argon2_iterations" env:"ARGON2_ITERATIONS"`
+	Argon2Parallelism uint8  `yaml:"argon2_parallelism" env:"ARGON2_PARALLELISM"`
+	MinLength         int    `yaml:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	MaxLength         int    `yaml:"max_length" env:"PASSWORD_MAX_LENGTH"`
+	RequireLower      bool   `yaml:"require_lower" env:"PASSWORD_REQUIRE_LOWER"`
+	RequireUpper      bool   `yaml:"require_upper" env:"PASSWORD_REQUIRE_UPPER"`
+	RequireDigit      bool   `yaml:"require_digit" env:"PASSWORD_REQUIRE_DIGIT"`
+	RequireSymbol     bool   `yaml:"require_symbol" env:"PASSWORD_REQUIRE_SYMBOL"`
+	AllowEmail        bool   `yaml:"allow_email" env:"PASSWORD_ALLOW_EMAIL"`
+	// BreachedPasswordsPath replaces the bundled list; "off" disables the
+	// check.
+	BreachedPasswordsPath string `yaml:"breached_passwords_path" env:"BREACHED_PASSWORDS_PATH"`
+}
+
+// Argon2Params are the hashing parameters, on top of chirpy's defaults.
+func (p Passwords) Argon2Params() auth.Argon2Params {
+	params := auth.DefaultArgon2Params
+	params.Memory = p.Argon2MemoryKiB
+	params.Iterations = p.Argon2Iterations
+	params.Parallelism = p.Argon2Parallelism
+	return params
+}
+
+type Mail struct {
+	From string `yaml:"from" env:"MAIL_FROM"`
+	// OutboxDir writes emails to files instead of logging them.
+	OutboxDir            string `yaml:"outbox_dir" env:"MAIL_OUTBOX_DIR"`
+	RequireVerifiedEmail bool   `yaml:"require_verified_email" env:"REQUIRE_VERIFIED_EMAIL"`
+}
+
+type Polka struct {
+	APIKey           string        `yaml:"api_key" env:"POLKA_API_KEY" secret:"true"`
+	WebhookSecrets   []string      `yaml:"webhook_secrets" env:"POLKA_WEBHOOK_SECRETS" secret:"true"`
+	WebhookTolerance time.Duration `yaml:"webhook_tolerance" env:"POLKA_WEBHOOK_TOLERANCE"`
+}
+
+// OIDCProvider is read from OIDC_<NAME>_* variables for every name listed in
+// OIDC_PROVIDERS, <NAME> being upper cased with dashes turned into
+// underscores.
+type OIDCProvider struct {
+	Name         string   `yaml:"name"`
+	Issuer       string   `yaml:"issuer" env:"ISSUER"`
+	ClientID     string   `yaml:"client_id" env:"CLIENT_ID"`
+	ClientSecret string   `yaml:"client_secret" env:"CLIENT_SECRET" secret:"true"`
+	RedirectURL  string   `yaml:"redirect_url" env:"REDIRECT_URL"`
+	Scopes       []string `yaml:"scopes" env:"SCOPES" sep:" "`
+}
+
+type Subscriptions struct {
+	GracePeriod    time.Duration `yaml:"grace_period" env:"SUBSCRIPTION_GRACE_PERIOD"`
+	ExpiryInterval time.Duration `yaml:"expiry_interval" env:"SUBSCRIPTION_EXPIRY_INTERVAL"`
+}
+
+type Plans struct {
+	Free Plan `yaml:"free" env:"FREE_"`
+	Red  Plan `yaml:"red" env:"RED_"`
+	// ScheduledChirpsInterval is how often due scheduled chirps are posted.
+	ScheduledChirpsInterval time.Duration `yaml:"scheduled_chirps_interval" env:"SCHEDULED_CHIRPS_INTERVAL"`
+}
+
+// Plan holds the limits of a plan. Zero disables editing and scheduling and
+// lifts the hourly limit.
+type Plan struct {
+	MaxChirpLength     int           `yaml:"max_chirp_length" env:"MAX_CHIRP_LENGTH"`
+	ChirpEditWindow    time.Duration `yaml:"chirp_edit_window" env:"CHIRP_EDIT_WINDOW"`
+	MaxScheduledChirps int           `yaml:"max_scheduled_chirps" env:"MAX_SCHEDULED_CHIRPS"`
+	ChirpsPerHour      int           `yaml:"chirps_per_hour" env:"CHIRPS_PER_HOUR"`
+}
+
+type Webhooks struct {
+	// AllowPrivate allows http URLs and private addresses, for development.
+	AllowPrivate     bool          `yaml:"allow_private" env:"WEBHOOKS_ALLOW_PRIVATE"`
+	DisableAfter     int           `yaml:"disable_after" env:"WEBHOOK_DISABLE_AFTER"`
+	DispatchInterval time.Duration `yaml:"dispatch_interval" env:"WEBHOOK_DISPATCH_INTERVAL"`
+	// MaxEndpoints caps each user's endpoints. Each event about their chirps
+	// is queued for every one of them.
+	MaxEndpoints int `yaml:"max_endpoints" env:"WEBHOOK_MAX_ENDPOINTS"`
+}
+
+// Admin endpoints also accept Token, when set, as a bearer token acting as
+// the account with TokenEmail, for automation. Admin users sign in as usual.
+type Admin struct {
+	Token      string `yaml:"token" env:"ADMIN_TOKEN" secret:"true"`
+	TokenEmail string `yaml:"token_email" env:"ADMIN_TOKEN_EMAIL"`
+}
+
+// Fixtures wipe tables, so loading one needs TestMode on and ConfirmToken
+// sent along.
+type Fixtures struct {
+	TestMode     bool   `yaml:"test_mode" env:"TEST_MODE"`
+	ConfirmToken string `yaml:"confirm_token" env:"FIXTURES_CONFIRM_TOKEN" secret:"true"`
+	Dir          string `yaml:"dir" env:"FIXTURES_DIR"`
+}
+
+// Default is the configuration used for anything that isn't set.
+func Default() Config {
+	return Config{
+		LogLevel: slog.LevelInfo,
+		Server: Server{
+			Port:              8080,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    1 << 20,
+			MaxBodyBytes:      1 << 20,
+			ShutdownTimeout:   30 * time.Second,
+			ReadinessTimeout:  2 * time.Second,
+		},
+		Database: Database{
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		Tokens: Tokens{
+			AccessTokenLifetime:            time.Hour,
+			RefreshTokenLifetime:           60 * 24 * time.Hour,
+			EmailVerificationTokenLifetime: 48 * time.Hour,
+			PasswordResetTokenLifetime:     time.Hour,
+		},
+		Passwords: Passwords{
+			Argon2MemoryKiB:   auth.DefaultArgon2Params.Memory,
+			Argon2Iterations:  auth.DefaultArgon2Params.Iterations,
+			Argon2Parallelism: auth.DefaultArgon2Params.Parallelism,
+			MinLength:         8,
+			MaxLength:         256,
+		},
+		Mail: Mail{
+			From: "chirpy@localhost",
+		},
+		Polka: Polka{
+			WebhookTolerance: 5 * time.Minute,
+		},
+		Subscriptions: Subscriptions{
+			GracePeriod:    72 * time.Hour,
+			ExpiryInterval: time.Minute,
+		},
+		Plans: Plans{
+			Free: Plan{
+				MaxChirpLength: 140,
+				ChirpsPerHour:  30,
+			},
+			Red: Plan{
+				MaxChirpLength:     1000,
+				ChirpEditWindow:    15 * time.Minute,
+				MaxScheduledChirps: 50,
+				ChirpsPerHour:      300,
+			},
+			ScheduledChirpsInterval: 15 * time.Second,
+		},
+		Webhooks: Webhooks{
+			DisableAfter:     15,
+			DispatchInterval: 5 * time.Second,
+			MaxEndpoints:     10,
+		},
+		Fixtures: Fixtures{
+			Dir: "fixtures",
+		},
+	}
+}
+
+// Load reads .env, then the YAML file at path, or CONFIG_FILE when path is
+// empty, then the environment. It only fails on values that can't be parsed;
+// call Validate to check the result makes sense.
+func Load(path string) (Config, error) {
+	godotenv.Load()
+
+	config := Default()
+
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+
+	if path != "" {
+		err := config.loadFile(path)
+
+		if err != nil {
+			return config, err
+		}
+	}
+
+	err := config.loadEnv(os.LookupEnv)
+
+	return config, err
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(c)
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	errs := []error{applyEnv(reflect.ValueOf(c).Elem(), "", lookup)}
+
+	// OIDC_PROVIDERS replaces the providers of the file
+	if names, ok := lookup("OIDC_PROVIDERS"); ok && names != "" {
+		var providers []OIDCProvider
+
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+
+			if name == "" {
+				continue
+			}
+
+			provider := OIDCProvider{Name: name}
+
+			for _, existing := range c.OIDC {
+				if existing.Name == name {
+					provider = existing
+				}
+			}
+
+			providers = append(providers, provider)
+		}
+
+		c.OIDC = providers
+	}
+
+	for i := range c.OIDC {
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(c.OIDC[i].Name, "-", "_")) + "_"
+		errs = append(errs, applyEnv(reflect.ValueOf(&c.OIDC[i]).Elem(), prefix, lookup))
+	}
+
+	return errors.Join(errs...)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	var errs []error
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, ok := field.Tag.Lookup("env")
+
+		if !ok {
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(v.Field(i), prefix+name, lookup))
+			continue
+		}
+
+		raw, ok := lookup(prefix + name)
+
+		if !ok || raw == "" {
+			continue
+		}
+
+		err := setValue(v.Field(i), raw, field.Tag.Get("sep"))
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", prefix+name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func setValue(v reflect.Value, raw, sep string) error {
+	if unmarshaler, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(raw))
+	}
+
+	switch {
+	case v.Type() == durationType:
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(parsed))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(parsed)
+	case v.CanInt():
+		parsed, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(parsed)
+	case v.CanUint():
+		parsed, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(parsed)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		if sep == "" {
+			sep = ","
+		}
+
+		var items []string
+		for _, item := range strings.Split(raw, sep) {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// Validate reports every setting that would make chirpy misbehave, so it can
+// refuse to start.
+func (c Config) Validate() error {
+	var errs []error
+
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "PORT must be between 1 and 65535")
+	check(c.Server.ReadHeaderTimeout >= 0 && c.Server.ReadTimeout >= 0 && c.Server.WriteTimeout >= 0 && c.Server.IdleTimeout >= 0, "HTTP timeouts can't be negative")
+	check(c.Server.MaxHeaderBytes > 0, "HTTP_MAX_HEADER_BYTES must be positive")
+	check(c.Server.MaxBodyBytes > 0, "HTTP_MAX_BODY_BYTES must be positive")
+	check(c.Server.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+	check(c.Server.ShutdownDelay >= 0, "SHUTDOWN_DELAY can't be negative")
+	check(c.Server.ReadinessTimeout > 0, "READINESS_TIMEOUT must be positive")
+
+	check(c.Database.URL != "", "DB_URL is required")
+	check(c.Database.MaxOpenConns >= 0 && c.Database.MaxIdleConns >= 0, "database connection limits can't be negative")
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns, "DB_MAX_IDLE_CONNS can't be more than DB_MAX_OPEN_CONNS")
+	check(c.Database.ConnMaxLifetime >= 0 && c.Database.ConnMaxIdleTime >= 0, "database connection lifetimes can't be negative")
+
+	if c.JWT.KeysDir == "" {
+		// An HMAC key shorter than the SHA-256 output weakens every token
+		check(len(c.JWT.Secret) >= 32, "JWT_SECRET must be at least 32 bytes, or JWT_KEYS_DIR set")
+	} else {
+		check(c.JWT.ActiveKeyID != "", "JWT_ACTIVE_KEY_ID is required with JWT_KEYS_DIR")
+	}
+
+	check(c.Tokens.AccessTokenLifetime > 0, "ACCESS_TOKEN_LIFETIME must be positive")
+	check(c.Tokens.RefreshTokenLifetime > 0, "REFRESH_TOKEN_LIFETIME must be positive")
+	check(c.Tokens.EmailVerificationTokenLifetime > 0, "EMAIL_VERIFICATION_TOKEN_LIFETIME must be positive")
+	check(c.Tokens.PasswordResetTokenLifetime > 0, "PASSWORD_RESET_TOKEN_LIFETIME must be positive")
+
+	if err := c.Passwords.Argon2Params().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid Argon2 parameters: %w", err))
+	}
+
+	check(c.Passwords.MinLength > 0, "PASSWORD_MIN_LENGTH must be positive")
+	check(c.Passwords.MaxLength >= c.Passwords.MinLength, "PASSWORD_MAX_LENGTH can't be less than PASSWORD_MIN_LENGTH")
+
+	check(c.Polka.WebhookTolerance > 0, "POLKA_WEBHOOK_TOLERANCE must be positive")
+
+	for _, provider := range c.OIDC {
+		check(provider.Name != "" && provider.Issuer != "" && provider.ClientID != "" && provider.RedirectURL != "",
+			"OIDC provider %q needs an issuer, client id and redirect URL", provider.Name)
+	}
+
+	check(c.Subscriptions.GracePeriod >= 0, "SUBSCRIPTION_GRACE_PERIOD can't be negative")
+	check(c.Subscriptions.ExpiryInterval > 0, "SUBSCRIPTION_EXPIRY_INTERVAL must be positive")
+
+	for prefix, plan := range map[string]Plan{"FREE_": c.Plans.Free, "RED_": c.Plans.Red} {
+		check(plan.MaxChirpLength > 0, "%sMAX_CHIRP_LENGTH must be positive", prefix)
+		check(plan.ChirpEditWindow >= 0, "%sCHIRP_EDIT_WINDOW can't be negative", prefix)
+		check(plan.MaxScheduledChirps >= 0, "%sMAX_SCHEDULED_CHIRPS can't be negative", prefix)
+		check(plan.ChirpsPerHour >= 0, "%sCHIRPS_PER_HOUR can't be negative", prefix)
+	}
+
+	check(c.Plans.ScheduledChirpsInterval > 0, "SCHEDULED_CHIRPS_INTERVAL must be positive")
+
+	check(c.Webhooks.DisableAfter > 0, "WEBHOOK_DISABLE_AFTER must be positive")
+	check(c.Webhooks.DispatchInterval > 0, "WEBHOOK_DISPATCH_INTERVAL must be positive")
+	check(c.Webhooks.MaxEndpoints > 0, "WEBHOOK_MAX_ENDPOINTS must be positive")
+
+	check(c.Admin.Token == "" || len(c.Admin.Token) >= 32, "ADMIN_TOKEN must be at least 32 bytes")
+	check(c.Admin.Token == "" || c.Admin.TokenEmail != "", "ADMIN_TOKEN_EMAIL is required with ADMIN_TOKEN")
+
+	if c.Fixtures.TestMode {
+		check(len(c.Fixtures.ConfirmToken) >= 32, "FIXTURES_CONFIRM_TOKEN must be at least 32 bytes with TEST_MODE")
+	}
+
+	return errors.Join(errs...)
+}
+
+const redacted = "REDACTED"
+
+// Redacted returns a copy with secrets replaced, for printing. Database URLs
+// keep everything but the password.
+func (c Config) Redacted() Config {
+	c.OIDC = append([]OIDCProvider(nil), c.OIDC...)
+	c.Polka.WebhookSecrets = append([]string(nil), c.Polka.WebhookSecrets...)
+
+	redact(reflect.ValueOf(&c).Elem())
+
+	return c
+}
+
+func redact(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			redact(value)
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+			for j := 0; j < value.Len(); j++ {
+				redact(value.Index(j))
+			}
+		case field.Tag.Get("secret") == "url" && value.String() != "":
+			value.SetString(redactURL(value.String()))
+		case field.Tag.Get("secret") == "true" && value.Kind() == reflect.String && value.String() != "":
+			value.SetString(redacted)
+		case field.Tag.Get("secret") == "true" && value.Kind() == reflect.Slice:
+			for j := 0; j < value.Len(); j++ {
+				value.Index(j).SetString(redacted)
+			}
+		}
+	}
+}
+
+// redactURL hides the password of a URL, whether in its user info or in a
+// password parameter. Anything else, like a key=value connection string, is
+// hidden entirely.
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return redacted
+	}
+
+	query := parsed.Query()
+
+	if query.Has("password") {
+		query.Set("password", redacted)
+		parsed.RawQuery = query.Encode()
+	}
+
+	return parsed.Redacted()
+}
+
+// YAML renders the configuration in the format Load reads.
+func (c Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Dialect is the database chirpy runs against. The queries are shared: on
+// SQLite, ForSQLite adapts them and connections provide the NOW() and
+// gen_random_uuid() functions they use. The schema comes from separate
+// migrations.
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
+)
+
+// sqliteDefaults are applied to SQLite URLs that don't set them. Immediate
+// transactions take the write lock upfront, so a transaction that reads then
+// writes waits for other writers instead of failing.
+var sqliteDefaults = map[string]string{
+	"_foreign_keys": "on",
+	"_busy_timeout": "5000",
+	"_journal_mode": "WAL",
+	"_txlock":       "immediate",
+}
+
+// Open opens the database dbURL points at, picking the dialect from its
+// scheme: postgres:// or postgresql:// (or a key=value connection string)
+// for Postgres, and sqlite:path/to/chirpy.db or sqlite:///abs/path.db for
+// SQLite. It doesn't connect yet.
+func Open(dbURL string) (*sql.DB, Dialect, error) {
+	rest, ok := strings.CutPrefix(dbURL, "sqlite:")
+	if !ok {
+		db, err := sql.Open("postgres", dbURL)
+		return db, Postgres, err
+	}
+
+	if !sqliteAvailable {
+		return nil, SQLite, errors.New("SQLite needs chirpy to be built with cgo")
+	}
+
+	rest = strings.TrimPrefix(rest, "//")
+	path, rawQuery, _ := strings.Cut(rest, "?")
+
+	if path == "" {
+		return nil, SQLite, fmt.Errorf("no database file in %q", dbURL)
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+
+	if err != nil {
+		return nil, SQLite, fmt.Errorf("invalid SQLite options: %w", err)
+	}
+
+	for name, value := range sqliteDefaults {
+		if !query.Has(name) {
+			query.Set(name, value)
+		}
+	}
+
+	db, err := sql.Open(sqliteDriver, "file:"+path+"?"+query.Encode())
+
+	if err != nil {
+		return nil, SQLite, err
+	}
+
+	return db, SQLite, nil
+}
+
+// ForSQLite adapts queries written for Postgres to a SQLite db:
+//   - $1 parameters become ?1. SQLite numbers $1 parameters in the order they
+//     first appear, not by their number.
+//   - FOR UPDATE is dropped. Transactions are immediate, so they already hold
+//     the write lock.
+//   - Times are stored in UTC. SQLite keeps them as text and compares them as
+//     strings, which only orders them correctly when they share a time zone.
+func ForSQLite(db DBTX) DBTX {
+	return sqliteDB{db: db}
+}
+
+type sqliteDB struct {
+	db DBTX
+}
+
+var (
+	postgresParam = regexp.MustCompile(`\$(\d+)`)
+	forUpdate     = regexp.MustCompile(`\s+FOR UPDATE\b`)
+	sqliteQueries sync.Map
+)
+
+func toSQLite(query string) string {
+	if converted, ok := sqliteQueries.Load(query); ok {
+		return converted.(string)
+	}
+
+	converted := postgresParam.ReplaceAllString(query, "?$1")
+	converted = forUpdate.ReplaceAllString(converted, "")
+	sqliteQueries.Store(query, converted)
+
+	return converted
+}
+
+func toUTC(args []interface{}) []interface{} {
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case time.Time:
+			args[i] = arg.UTC()
+		case sql.NullTime:
+			args[i] = sql.NullTime{Time: arg.Time.UTC(), Valid: arg.Valid}
+		}
+	}
+
+	return args
+}
+
+func (s sqliteDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, toSQLite(query), toUTC(args)...)
+}
+
+func (s sqliteDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return s.db.PrepareContext(ctx, toSQLite(query))
+}
+
+func (s sqliteDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, toSQLite(query), toUTC(args)...)
+}
+
+func (s sqliteDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(ctx, toSQLite(query), toUTC(args)...)
+}
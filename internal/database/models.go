@@ -5,11 +5,36 @@
 package database
 
 import (
+	"database/sql"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+type AdminAuditLog struct {
+	ID            uuid.UUID
+	CreatedAt     time.Time
+	ActorID       uuid.NullUUID
+	Action        string
+	TargetUserID  uuid.UUID
+	Details       string
+	ViaAdminToken bool
+}
+
+type ApiKey struct {
+	ID         uuid.UUID
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	UserID     uuid.UUID
+	Name       string
+	Prefix     string
+	HashedKey  string
+	Scopes     string
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
 type Chirp struct {
 	ID        uuid.UUID
 	CreatedAt time.Time
@@ -18,11 +43,188 @@ type Chirp struct {
 	UserID    uuid.UUID
 }
 
+type EmailVerificationToken struct {
+	TokenHash string
+	UserID    uuid.UUID
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type OauthAuthorizationCode struct {
+	CodeHash      string
+	ClientID      uuid.UUID
+	UserID        uuid.UUID
+	RedirectUri   string
+	Scopes        string
+	CodeChallenge string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+	UsedAt        sql.NullTime
+}
+
+type OauthClient struct {
+	ID           uuid.UUID
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	UserID       uuid.UUID
+	Name         string
+	HashedSecret sql.NullString
+	RedirectUris string
+	Scopes       string
+}
+
+type OidcLoginState struct {
+	StateHash    string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+	LinkUserID   uuid.NullUUID
+}
+
+type PasswordResetToken struct {
+	TokenHash string
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type RecoveryCode struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	CodeHash  string
+	CreatedAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type ScheduledChirp struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	Body      string
+	PublishAt time.Time
+	Error     sql.NullString
+}
+
+type Subscription struct {
+	ID               uuid.UUID
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	UserID           uuid.UUID
+	Plan             string
+	Status           string
+	CurrentPeriodEnd sql.NullTime
+	GracePeriodEnd   sql.NullTime
+	CancelledAt      sql.NullTime
+}
+
+type Token struct {
+	Token     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	UserID    uuid.UUID
+	ExpiresAt time.Time
+	RevokedAt sql.NullTime
+	ClientID  uuid.NullUUID
+	Scopes    sql.NullString
+}
+
+type TwoFactorChallenge struct {
+	Jti       string
+	UserID    uuid.UUID
+	UsedAt    time.Time
+	ExpiresAt time.Time
+}
+
 type User struct {
+	ID                uuid.UUID
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	Email             string
+	HashedPassword    string
+	IsChirpyRed       bool
+	EmailVerifiedAt   sql.NullTime
+	TotpSecret        sql.NullString
+	TotpEnabledAt     sql.NullTime
+	TotpLastCounter   int64
+	FailedLoginCount  int32
+	LastFailedLoginAt sql.NullTime
+	LockedUntil       sql.NullTime
+	Role              string
+	TokensValidAfter  sql.NullTime
+}
+
+type UserIdentity struct {
+	ID          uuid.UUID
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	UserID      uuid.UUID
+	Provider    string
+	Subject     string
+	Email       string
+	LastLoginAt sql.NullTime
+}
+
+type WebhookDelivery struct {
+	ID                 uuid.UUID
+	CreatedAt          time.Time
+	EndpointID         uuid.UUID
+	EventID            uuid.UUID
+	EventType          string
+	Payload            string
+	Status             string
+	Attempts           int32
+	NextAttemptAt      time.Time
+	LastAttemptAt      sql.NullTime
+	LastResponseStatus sql.NullInt32
+	LastError          sql.NullString
+	DeliveredAt        sql.NullTime
+}
+
+type WebhookDeliveryAttempt struct {
 	ID             uuid.UUID
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	Email          string
-	HashedPassword string
-	IsChirpyRed		 bool
+	DeliveryID     uuid.UUID
+	AttemptedAt    time.Time
+	ResponseStatus sql.NullInt32
+	Error          sql.NullString
+	DurationMs     int32
+}
+
+type WebhookEndpoint struct {
+	ID                  uuid.UUID
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+	UserID              uuid.UUID
+	Url                 string
+	Secret              string
+	EventTypes          string
+	Enabled             bool
+	ConsecutiveFailures int32
+	DisabledAt          sql.NullTime
+	DisabledReason      sql.NullString
+}
+
+type WebhookEvent struct {
+	ID            uuid.UUID
+	Source        string
+	EventID       string
+	EventType     string
+	Payload       string
+	Status        string
+	Error         sql.NullString
+	Attempts      int32
+	ReceivedAt    time.Time
+	LastAttemptAt sql.NullTime
+}
+
+type WebhookOutbox struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	EventType string
+	Payload   string
 }
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Observer is told about every query: its sqlc name ("unknown" for queries
+// not written through sqlc), how long it took and how it failed, if it did.
+type Observer func(query string, duration time.Duration, err error)
+
+// Observe wraps db so every query is reported to observer.
+func Observe(db DBTX, observer Observer) DBTX {
+	return observedDB{db: db, observer: observer}
+}
+
+// WithObservedTx is WithTx for Queries made over Observe or ForSQLite: queries in
+// the transaction go through the same wrappers.
+func (q *Queries) WithObservedTx(tx *sql.Tx) *Queries {
+	return &Queries{db: WrapTx(q.db, tx)}
+}
+
+// WrapTx wraps tx like db is wrapped, for queries not written through sqlc.
+func WrapTx(db DBTX, tx *sql.Tx) DBTX {
+	switch db := db.(type) {
+	case observedDB:
+		return observedDB{db: WrapTx(db.db, tx), observer: db.observer}
+	case sqliteDB:
+		return sqliteDB{db: WrapTx(db.db, tx)}
+	}
+
+	return tx
+}
+
+// QueryName extracts the name from the "-- name: GetUser :one" header sqlc
+// puts at the start of every query.
+func QueryName(query string) string {
+	rest, ok := strings.CutPrefix(query, "-- name: ")
+	if !ok {
+		return "unknown"
+	}
+
+	name, _, _ := strings.Cut(rest, " ")
+
+	return name
+}
+
+type observedDB struct {
+	db       DBTX
+	observer Observer
+}
+
+func (o observedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := o.db.ExecContext(ctx, query, args...)
+	o.observer(QueryName(query), time.Since(start), err)
+	return result, err
+}
+
+func (o observedDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return o.db.PrepareContext(ctx, query)
+}
+
+// QueryContext times the query up to its first results; reading the rows
+// isn't included.
+func (o observedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := o.db.QueryContext(ctx, query, args...)
+	o.observer(QueryName(query), time.Since(start), err)
+	return rows, err
+}
+
+func (o observedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := o.db.QueryRowContext(ctx, query, args...)
+	o.observer(QueryName(query), time.Since(start), row.Err())
+	return row
+}
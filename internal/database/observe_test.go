@@ -0,0 +1,17 @@
+package database
+
+import "testing"
+
+func TestQueryName(t *testing.T) {
+	cases := map[string]string{
+		getUser:              "GetUser",
+		claimWebhookDelivery: "ClaimWebhookDelivery",
+		"SELECT 1":           "unknown",
+	}
+
+	for query, name := range cases {
+		if got := QueryName(query); got != name {
+			t.Errorf("Expected %q, got %q", name, got)
+		}
+	}
+}
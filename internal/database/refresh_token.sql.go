@@ -49,7 +49,7 @@ func (q *Queries) CreateRefreshToken(ctx context.Context, arg CreateRefreshToken
 }
 
 const getUserFromRefreshToken = `-- name: GetUserFromRefreshToken :one
-SELECT token, user_id, expires_at, tokens.created_at, tokens.updated_at, revoked_at
+SELECT token, user_id, expires_at, tokens.created_at, tokens.updated_at, revoked_at, client_id
 FROM tokens
 INNER JOIN users ON users.id = tokens.user_id
 WHERE token=$1
@@ -62,6 +62,7 @@ type GetUserFromRefreshTokenRow struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	RevokedAt sql.NullTime
+	ClientID  uuid.NullUUID
 }
 
 func (q *Queries) GetUserFromRefreshToken(ctx context.Context, dollar_1 sql.NullString) (GetUserFromRefreshTokenRow, error) {
@@ -74,10 +75,57 @@ func (q *Queries) GetUserFromRefreshToken(ctx context.Context, dollar_1 sql.Null
 		&i.CreatedAt,
 		&i.UpdatedAt,
 		&i.RevokedAt,
+		&i.ClientID,
 	)
 	return i, err
 }
 
+const listActiveSessionsByUser = `-- name: ListActiveSessionsByUser :many
+SELECT created_at, expires_at, client_id FROM tokens
+WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+ORDER BY created_at DESC
+`
+
+type ListActiveSessionsByUserRow struct {
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	ClientID  uuid.NullUUID
+}
+
+func (q *Queries) ListActiveSessionsByUser(ctx context.Context, userID uuid.UUID) ([]ListActiveSessionsByUserRow, error) {
+	rows, err := q.db.QueryContext(ctx, listActiveSessionsByUser, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListActiveSessionsByUserRow
+	for rows.Next() {
+		var i ListActiveSessionsByUserRow
+		if err := rows.Scan(&i.CreatedAt, &i.ExpiresAt, &i.ClientID); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const revokeAllUserTokens = `-- name: RevokeAllUserTokens :exec
+UPDATE tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeAllUserTokens(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, revokeAllUserTokens, userID)
+	return err
+}
+
 const revokeToken = `-- name: RevokeToken :exec
 UPDATE tokens
 SET revoked_at = NOW(), updated_at = NOW()
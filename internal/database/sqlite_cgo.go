@@ -0,0 +1,33 @@
+//go:build cgo
+
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+)
+
+const sqliteAvailable = true
+
+const sqliteDriver = "chirpy_sqlite3"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// In the format the driver stores time.Time arguments in, so
+			// NOW() compares with them as text
+			err := conn.RegisterFunc("now", func() string {
+				return time.Now().UTC().Format(sqlite3.SQLiteTimestampFormats[0])
+			}, false)
+
+			if err != nil {
+				return err
+			}
+
+			return conn.RegisterFunc("gen_random_uuid", uuid.NewString, false)
+		},
+	})
+}
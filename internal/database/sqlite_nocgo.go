@@ -0,0 +1,8 @@
+//go:build !cgo
+
+package database
+
+// The SQLite driver is written in C.
+const sqliteAvailable = false
+
+const sqliteDriver = ""
@@ -0,0 +1,173 @@
+//go:build cgo
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuelea/chirpy/sql/schema"
+)
+
+func openSQLite(t *testing.T) (*sql.DB, *Queries) {
+	db, dialect, err := Open("sqlite:" + filepath.Join(t.TempDir(), "chirpy.db"))
+
+	if err != nil || dialect != SQLite {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	migrateSQLite(t, db)
+
+	return db, New(ForSQLite(db))
+}
+
+// migrateSQLite applies the Up part of every SQLite migration, in order.
+func migrateSQLite(t *testing.T, db *sql.DB) {
+	names, _ := fs.Glob(schema.SQLiteMigrations, "sqlite/*.sql")
+
+	for _, name := range names {
+		migration, err := schema.SQLiteMigrations.ReadFile(name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		up, _, _ := strings.Cut(string(migration), "-- +goose Down")
+
+		if _, err := db.Exec(up); err != nil {
+			t.Fatalf("Failed to apply %s: %v", name, err)
+		}
+	}
+}
+
+// Every query must at least compile against the SQLite schema
+func TestSQLiteQueries(t *testing.T) {
+	db, _ := openSQLite(t)
+
+	files, _ := filepath.Glob("../../sql/queries/*.sql")
+
+	if len(files) == 0 {
+		t.Fatal("No queries found")
+	}
+
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, query := range strings.Split(string(contents), "-- name: ")[1:] {
+			stmt, err := ForSQLite(db).PrepareContext(context.Background(), "-- name: "+query)
+
+			if err != nil {
+				t.Errorf("%s: %v", QueryName("-- name: "+query), err)
+				continue
+			}
+
+			stmt.Close()
+		}
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	db, queries := openSQLite(t)
+	ctx := context.Background()
+
+	user, err := queries.CreateUser(ctx, CreateUserParams{Email: "walt@breakingbad.com", HashedPassword: "hash"})
+
+	if err != nil {
+		t.Fatalf("Failed to create a user: %v", err)
+	}
+
+	if time.Since(user.CreatedAt).Abs() > time.Minute || user.IsChirpyRed {
+		t.Errorf("Unexpected user %+v", user)
+	}
+
+	// Times come back in UTC whatever zone they were written in
+	tx, err := db.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	periodEnd := time.Now().In(time.FixedZone("UTC-10", -10*60*60)).Add(time.Hour)
+
+	_, err = queries.WithObservedTx(tx).UpsertSubscription(ctx, UpsertSubscriptionParams{
+		UserID:           user.ID,
+		Plan:             "chirpy_red",
+		Status:           "active",
+		CurrentPeriodEnd: sql.NullTime{Time: periodEnd, Valid: true},
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err = queries.SyncChirpyRedStatus(ctx, user.ID)
+
+	if err != nil || !user.IsChirpyRed {
+		t.Errorf("Subscription running for another hour not active: %+v, %v", user, err)
+	}
+
+	if _, err := queries.CreateChirp(ctx, CreateChirpParams{UserID: user.ID, Body: "I am the one who knocks"}); err != nil {
+		t.Fatalf("Failed to chirp: %v", err)
+	}
+
+	if err := queries.ClearUsers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	chirps, err := queries.GetChirpsByUserID(ctx, user.ID)
+
+	if err != nil || len(chirps) != 0 {
+		t.Errorf("Chirps not deleted with their user: %v, %v", chirps, err)
+	}
+}
+
+func TestSQLiteListUsers(t *testing.T) {
+	_, queries := openSQLite(t)
+	ctx := context.Background()
+
+	for _, email := range []string{"Walt@breakingbad.com", "walt_jr@breakingbad.com", "saul@bettercall.com"} {
+		if _, err := queries.CreateUser(ctx, CreateUserParams{Email: email, HashedPassword: "hash"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		search string
+		want   int64
+	}{
+		{"", 3},
+		{"WALT", 2},
+		{`\_`, 1},
+		{`\%`, 0},
+	}
+
+	for _, tt := range tests {
+		count, err := queries.CountUsers(ctx, tt.search)
+
+		if err != nil || count != tt.want {
+			t.Errorf("CountUsers(%q) = %d, %v, want %d", tt.search, count, err, tt.want)
+		}
+	}
+
+	users, err := queries.ListUsers(ctx, ListUsersParams{Search: "walt", MaxUsers: 1, Skip: 1})
+
+	if err != nil || len(users) != 1 || users[0].Email != "walt_jr@breakingbad.com" {
+		t.Errorf("Unexpected second page %+v, %v", users, err)
+	}
+}
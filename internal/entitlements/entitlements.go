@@ -0,0 +1,58 @@
+// Package entitlements describes what each plan allows. Handlers ask for the
+// caller's Entitlements and check them instead of testing for Chirpy Red
+// directly, so tiers can be changed through configuration.
+package entitlements
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Entitlements are the limits of one plan. Zero values disable a feature:
+// no edit window means chirps can't be edited, no scheduled chirps means
+// chirps can't be scheduled and no hourly limit means chirping is unlimited.
+type Entitlements struct {
+	MaxChirpLength     int           `json:"max_chirp_length"`
+	EditWindow         time.Duration `json:"-"`
+	MaxScheduledChirps int           `json:"max_scheduled_chirps"`
+	ChirpsPerHour      int           `json:"chirps_per_hour"`
+}
+
+// Tiers maps Chirpy Red status to a plan.
+type Tiers struct {
+	Free Entitlements
+	Red  Entitlements
+}
+
+func (t Tiers) For(isChirpyRed bool) Entitlements {
+	if isChirpyRed {
+		return t.Red
+	}
+
+	return t.Free
+}
+
+// CheckChirpLength counts characters, not bytes.
+func (e Entitlements) CheckChirpLength(body string) error {
+	if utf8.RuneCountInString(body) > e.MaxChirpLength {
+		return fmt.Errorf("Chirp is too long, the limit is %d characters", e.MaxChirpLength)
+	}
+
+	return nil
+}
+
+// CanEdit reports whether a chirp posted at createdAt can still be edited.
+func (e Entitlements) CanEdit(createdAt, now time.Time) bool {
+	return now.Before(createdAt.Add(e.EditWindow))
+}
+
+func (e Entitlements) CanSchedule() bool {
+	return e.MaxScheduledChirps > 0
+}
+
+// AllowChirp reports whether another chirp may be posted by a user who
+// posted recent chirps in the last hour.
+func (e Entitlements) AllowChirp(recent int64) bool {
+	return e.ChirpsPerHour == 0 || recent < int64(e.ChirpsPerHour)
+}
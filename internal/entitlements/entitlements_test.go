@@ -0,0 +1,63 @@
+package entitlements
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var tiers = Tiers{
+	Free: Entitlements{MaxChirpLength: 140, ChirpsPerHour: 2},
+	Red:  Entitlements{MaxChirpLength: 280, EditWindow: 15 * time.Minute, MaxScheduledChirps: 5},
+}
+
+func TestChirpLength(t *testing.T) {
+	long := strings.Repeat("a", 200)
+
+	if tiers.For(false).CheckChirpLength(long) == nil {
+		t.Errorf("Free plan accepted a %d character chirp", len(long))
+	}
+
+	if err := tiers.For(true).CheckChirpLength(long); err != nil {
+		t.Errorf("Red plan rejected a %d character chirp: %v", len(long), err)
+	}
+
+	// Multi-byte characters count once
+	if err := tiers.For(false).CheckChirpLength(strings.Repeat("é", 140)); err != nil {
+		t.Errorf("Length counted in bytes: %v", err)
+	}
+}
+
+func TestCanEdit(t *testing.T) {
+	createdAt := time.Now()
+
+	if tiers.For(false).CanEdit(createdAt, createdAt) {
+		t.Errorf("Free plan can edit chirps")
+	}
+
+	red := tiers.For(true)
+
+	if !red.CanEdit(createdAt, createdAt.Add(14*time.Minute)) {
+		t.Errorf("Red plan can't edit within the window")
+	}
+
+	if red.CanEdit(createdAt, createdAt.Add(15*time.Minute)) {
+		t.Errorf("Red plan can edit after the window")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	if tiers.For(false).CanSchedule() || !tiers.For(true).CanSchedule() {
+		t.Errorf("Scheduling not keyed on the plan")
+	}
+
+	free := tiers.For(false)
+
+	if !free.AllowChirp(1) || free.AllowChirp(2) {
+		t.Errorf("Hourly limit not enforced")
+	}
+
+	if !tiers.For(true).AllowChirp(1000) {
+		t.Errorf("Unlimited plan was limited")
+	}
+}
@@ -0,0 +1,259 @@
+// Package fixtures reseeds tables from declarative seed files, for tests and
+// demos.
+//
+// A fixture is a YAML file mapping table names to rows:
+//
+//	users:
+//	  - id: 5a7f3b9e-8f0e-4f64-9d55-2b1f0f4b1c11
+//	    email: walt@example.com
+//	    password: Heisenberg-99
+//	chirps:
+//	  - user_id: 5a7f3b9e-8f0e-4f64-9d55-2b1f0f4b1c11
+//	    body: I am the one who knocks
+//
+// Ids and creation times left out are generated, a user's password is hashed
+// into hashed_password, lists are stored space separated like scopes, and
+// unquoted timestamps are times.
+package fixtures
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samuelea/chirpy/internal/database"
+	"gopkg.in/yaml.v3"
+)
+
+type table struct {
+	name string
+	// defaults are generated when a row leaves them out: a random id or
+	// the current time
+	defaults []string
+}
+
+// tables can be seeded, parents before the tables referencing them.
+var tables = []table{
+	{"users", []string{"id", "created_at", "updated_at"}},
+	{"chirps", []string{"id", "created_at", "updated_at"}},
+	{"oauth_clients", []string{"id", "created_at", "updated_at"}},
+	{"tokens", []string{"created_at", "updated_at"}},
+	{"api_keys", []string{"id", "created_at", "updated_at"}},
+	{"password_reset_tokens", []string{"created_at"}},
+	{"email_verification_tokens", []string{"created_at"}},
+	{"recovery_codes", []string{"id", "created_at"}},
+	{"oauth_authorization_codes", []string{"created_at"}},
+	{"user_identities", []string{"id", "created_at", "updated_at"}},
+	{"oidc_login_states", []string{"created_at"}},
+	{"webhook_events", []string{"id", "received_at"}},
+	{"subscriptions", []string{"id", "created_at", "updated_at"}},
+	{"scheduled_chirps", []string{"id", "created_at"}},
+	{"webhook_endpoints", []string{"id", "created_at", "updated_at"}},
+	{"webhook_outbox", []string{"id", "created_at"}},
+	{"webhook_deliveries", []string{"id", "created_at"}},
+	{"webhook_delivery_attempts", []string{"id", "attempted_at"}},
+}
+
+var (
+	fixtureName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	columnName  = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+)
+
+type Row map[string]any
+
+// Fixture holds rows by table.
+type Fixture map[string][]Row
+
+// Load reads and checks the fixture name.yaml from fsys.
+func Load(fsys fs.FS, name string) (Fixture, error) {
+	if !fixtureName.MatchString(name) {
+		return nil, fmt.Errorf("invalid fixture name %q", name)
+	}
+
+	data, err := fs.ReadFile(fsys, name+".yaml")
+
+	if err != nil {
+		return nil, err
+	}
+
+	fixture, err := Parse(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("fixture %s: %w", name, err)
+	}
+
+	return fixture, nil
+}
+
+// Parse reads a fixture, rejecting unknown tables and column names that
+// aren't identifiers.
+func Parse(data []byte) (Fixture, error) {
+	var fixture Fixture
+
+	if err := yaml.Unmarshal(data, &fixture); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+
+	for name, rows := range fixture {
+		if !known(name) {
+			errs = append(errs, fmt.Errorf("unknown table %q", name))
+			continue
+		}
+
+		for i, row := range rows {
+			for column := range row {
+				if !columnName.MatchString(column) {
+					errs = append(errs, fmt.Errorf("%s row %d: invalid column %q", name, i+1, column))
+				}
+			}
+		}
+	}
+
+	return fixture, errors.Join(errs...)
+}
+
+func known(name string) bool {
+	return slices.ContainsFunc(tables, func(t table) bool { return t.name == name })
+}
+
+// Options are what Apply needs from the application.
+type Options struct {
+	// HashPassword hashes the password of users rows.
+	HashPassword func(password string) (string, error)
+}
+
+// TableResult is what Apply did to a table. Rows deleted by cascading
+// foreign keys aren't counted.
+type TableResult struct {
+	Table    string `json:"table"`
+	Deleted  int64  `json:"deleted"`
+	Inserted int    `json:"inserted"`
+}
+
+// Apply empties the tables, then inserts the fixture's rows into them; with
+// no tables, it reseeds the tables the fixture has rows for. Emptying a table
+// also deletes the rows referencing it, as deleting them in chirpy does. db
+// should be a transaction, so a failure leaves every table as it was.
+func (f Fixture) Apply(ctx context.Context, db database.DBTX, only []string, opts Options) ([]TableResult, error) {
+	for _, name := range only {
+		if !known(name) {
+			return nil, fmt.Errorf("unknown table %q", name)
+		}
+	}
+
+	var selected []table
+
+	for _, t := range tables {
+		_, seeded := f[t.name]
+
+		if (len(only) == 0 && seeded) || slices.Contains(only, t.name) {
+			selected = append(selected, t)
+		}
+	}
+
+	results := make([]TableResult, len(selected))
+
+	// Children first, so the counts aren't lost to cascades
+	for i := len(selected) - 1; i >= 0; i-- {
+		results[i].Table = selected[i].name
+
+		result, err := db.ExecContext(ctx, "DELETE FROM "+selected[i].name)
+
+		if err != nil {
+			return nil, fmt.Errorf("emptying %s: %w", selected[i].name, err)
+		}
+
+		results[i].Deleted, _ = result.RowsAffected()
+	}
+
+	now := time.Now()
+
+	for i, t := range selected {
+		for n, row := range f[t.name] {
+			// A microsecond apart, so rows sorted by time keep the file's order
+			query, args, err := insert(t, row, now.Add(time.Duration(n)*time.Microsecond), opts)
+
+			if err == nil {
+				_, err = db.ExecContext(ctx, query, args...)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("%s row %d: %w", t.name, n+1, err)
+			}
+
+			results[i].Inserted++
+		}
+	}
+
+	return results, nil
+}
+
+func insert(t table, row Row, now time.Time, opts Options) (string, []any, error) {
+	values := map[string]any{}
+
+	for _, column := range t.defaults {
+		if column == "id" {
+			values[column] = uuid.NewString()
+		} else {
+			values[column] = now
+		}
+	}
+
+	for column, value := range row {
+		if list, ok := value.([]any); ok {
+			words := make([]string, len(list))
+
+			for i, word := range list {
+				words[i] = fmt.Sprint(word)
+			}
+
+			value = strings.Join(words, " ")
+		}
+
+		values[column] = value
+	}
+
+	if password, ok := values["password"]; ok && t.name == "users" {
+		if opts.HashPassword == nil {
+			return "", nil, errors.New("passwords can't be hashed")
+		}
+
+		hash, err := opts.HashPassword(fmt.Sprint(password))
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		delete(values, "password")
+		values["hashed_password"] = hash
+	}
+
+	columns := make([]string, 0, len(values))
+
+	for column := range values {
+		columns = append(columns, column)
+	}
+
+	sort.Strings(columns)
+
+	params := make([]string, len(columns))
+	args := make([]any, len(columns))
+
+	for i, column := range columns {
+		params[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = values[column]
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.name, strings.Join(columns, ", "), strings.Join(params, ", "))
+
+	return query, args, nil
+}
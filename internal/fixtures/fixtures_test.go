@@ -0,0 +1,37 @@
+package fixtures
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParse(t *testing.T) {
+	_, err := Parse([]byte(`
+users:
+  - email: walt@example.com
+    "email; DROP TABLE users": x
+pg_shadow:
+  - usename: postgres
+`))
+
+	for _, want := range []string{`unknown table "pg_shadow"`, `invalid column "email; DROP TABLE users"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %s, got %v", want, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{"basic.yaml": {Data: []byte("users:\n  - email: walt@example.com\n")}}
+
+	fixture, err := Load(fsys, "basic")
+
+	if err != nil || len(fixture["users"]) != 1 {
+		t.Errorf("Unexpected fixture %v, %v", fixture, err)
+	}
+
+	if _, err := Load(fsys, "../basic"); err == nil {
+		t.Errorf("Path accepted as a fixture name")
+	}
+}
@@ -0,0 +1,89 @@
+//go:build cgo
+
+package fixtures
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samuelea/chirpy/internal/database"
+	"github.com/samuelea/chirpy/sql/schema"
+)
+
+func TestApply(t *testing.T) {
+	db, _, err := database.Open("sqlite:" + filepath.Join(t.TempDir(), "chirpy.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	names, _ := fs.Glob(schema.SQLiteMigrations, "sqlite/*.sql")
+
+	for _, name := range names {
+		migration, _ := schema.SQLiteMigrations.ReadFile(name)
+		up, _, _ := strings.Cut(string(migration), "-- +goose Down")
+
+		if _, err := db.Exec(up); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fixture, err := Parse([]byte(`
+users:
+  - id: 5a7f3b9e-8f0e-4f64-9d55-2b1f0f4b1c11
+    email: walt@example.com
+    password: Heisenberg-99
+chirps:
+  - user_id: 5a7f3b9e-8f0e-4f64-9d55-2b1f0f4b1c11
+    body: I am the one who knocks
+api_keys:
+  - user_id: 5a7f3b9e-8f0e-4f64-9d55-2b1f0f4b1c11
+    name: ci
+    prefix: ci
+    hashed_key: abc
+    scopes: [chirps:write, profile:read]
+    expires_at: 2030-01-01T00:00:00Z
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	queries := database.New(database.ForSQLite(db))
+	opts := Options{HashPassword: func(password string) (string, error) { return "hashed " + password, nil }}
+
+	for range 2 {
+		if _, err := fixture.Apply(ctx, database.ForSQLite(db), nil, opts); err != nil {
+			t.Fatalf("Failed to apply: %v", err)
+		}
+	}
+
+	user, err := queries.GetUser(ctx, "walt@example.com")
+
+	if err != nil || user.HashedPassword != "hashed Heisenberg-99" {
+		t.Fatalf("Unexpected user %+v, %v", user, err)
+	}
+
+	keys, err := queries.ListApiKeysByUser(ctx, user.ID)
+
+	if err != nil || len(keys) != 1 || keys[0].Scopes != "chirps:write profile:read" || keys[0].ExpiresAt.Time.Year() != 2030 {
+		t.Errorf("Unexpected keys %+v, %v", keys, err)
+	}
+
+	// Reseeding only chirps leaves the users alone
+	results, err := fixture.Apply(ctx, database.ForSQLite(db), []string{"chirps"}, opts)
+
+	if err != nil || len(results) != 1 || results[0] != (TableResult{Table: "chirps", Deleted: 1, Inserted: 1}) {
+		t.Errorf("Unexpected results %+v, %v", results, err)
+	}
+
+	if _, err := fixture.Apply(ctx, database.ForSQLite(db), []string{"pg_shadow"}, opts); err == nil {
+		t.Errorf("Unknown table accepted")
+	}
+}
@@ -0,0 +1,230 @@
+// Package health answers liveness and readiness probes.
+//
+// Liveness only says the process is serving requests, so an orchestrator
+// restarts it when it hangs. Readiness runs every registered check, each with
+// a timeout, and fails while any of them does or once shutdown has started,
+// so traffic is only routed to instances that can handle it.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// Check returns an error when a dependency isn't usable. It must give up
+// when ctx is done.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker holds the readiness checks.
+type Checker struct {
+	timeout      time.Duration
+	checks       []namedCheck
+	shuttingDown atomic.Bool
+}
+
+// NewChecker returns a Checker giving each check timeout to answer.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a check. Checks run concurrently and are reported in the
+// order they were added.
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// ShutDown makes readiness fail from now on.
+func (c *Checker) ShutDown() {
+	c.shuttingDown.Store(true)
+}
+
+type Result struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+	// ShuttingDown is set once shutdown has started.
+	ShuttingDown bool `json:"shutting_down,omitempty"`
+}
+
+// Run runs every check and reports whether all of them passed.
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: StatusOK, Checks: make([]Result, len(c.checks))}
+
+	var wg sync.WaitGroup
+
+	for i, named := range c.checks {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			report.Checks[i] = c.run(ctx, named)
+		}()
+	}
+
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status != StatusOK {
+			report.Status = StatusFailing
+		}
+	}
+
+	if c.shuttingDown.Load() {
+		report.Status = StatusFailing
+		report.ShuttingDown = true
+	}
+
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, named namedCheck) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+
+	// A check that ignores ctx still can't hold up the probe
+	go func() {
+		done <- named.check(ctx)
+	}()
+
+	var err error
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", c.timeout)
+	}
+
+	result := Result{
+		Name:      named.name,
+		Status:    StatusOK,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+
+	if err != nil {
+		result.Status = StatusFailing
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// ReadinessHandler answers 200 with the report when every check passes and
+// 503 otherwise.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Run(r.Context())
+
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, report)
+	})
+}
+
+// LivenessHandler always answers 200: answering at all is the check.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Report{Status: StatusOK, Checks: []Result{}})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, report Report) {
+	body, _ := json.Marshal(report)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// jobFailureLimit is how many runs in a row have to fail before a job check
+// does. The next run retries the work, so a single error doesn't take the
+// instance out of rotation.
+const jobFailureLimit = 3
+
+// Job tracks a background job that runs every interval, so readiness fails
+// when runs keep failing or have stopped being started. A slow run doesn't
+// count against it: the job is still making its way through the work.
+type Job struct {
+	interval time.Duration
+
+	mu       sync.Mutex
+	running  bool
+	started  time.Time
+	failures int
+	lastErr  error
+}
+
+func NewJob(interval time.Duration) *Job {
+	return &Job{interval: interval, started: time.Now()}
+}
+
+// Started records that a run began.
+func (j *Job) Started() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.running = true
+	j.started = time.Now()
+}
+
+// Finished records the outcome of a run.
+func (j *Job) Finished(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.running = false
+
+	if err != nil {
+		j.failures++
+		j.lastErr = err
+		return
+	}
+
+	j.failures = 0
+	j.lastErr = nil
+}
+
+// Check fails when the last few runs all failed, or when no run is going and
+// none started for three intervals, which means the job is no longer
+// scheduled.
+func (j *Job) Check(ctx context.Context) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.failures >= jobFailureLimit {
+		return fmt.Errorf("last %d runs failed: %w", j.failures, j.lastErr)
+	}
+
+	if !j.running && time.Since(j.started) > 3*j.interval {
+		return fmt.Errorf("no run started since %s", j.started.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	checker := NewChecker(50 * time.Millisecond)
+	checker.Add("database", func(ctx context.Context) error { return nil })
+
+	res := httptest.NewRecorder()
+	checker.ReadinessHandler().ServeHTTP(res, httptest.NewRequest("GET", "/readyz", nil))
+
+	if res.Code != 200 {
+		t.Errorf("Expected 200, got %d: %s", res.Code, res.Body)
+	}
+
+	checker.Add("migrations", func(ctx context.Context) error { return errors.New("2 pending") })
+	checker.Add("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	res = httptest.NewRecorder()
+	checker.ReadinessHandler().ServeHTTP(res, httptest.NewRequest("GET", "/readyz", nil))
+
+	var report Report
+	json.Unmarshal(res.Body.Bytes(), &report)
+
+	if res.Code != 503 || report.Status != StatusFailing || len(report.Checks) != 3 {
+		t.Fatalf("Expected a failing report with 3 checks, got %d: %s", res.Code, res.Body)
+	}
+
+	if report.Checks[0].Status != StatusOK || report.Checks[1].Error != "2 pending" || report.Checks[2].Status != StatusFailing {
+		t.Errorf("Unexpected checks %+v", report.Checks)
+	}
+
+	if report.Checks[2].LatencyMs > 500 {
+		t.Errorf("Slow check was waited for: %vms", report.Checks[2].LatencyMs)
+	}
+}
+
+func TestShutDown(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.ShutDown()
+
+	report := checker.Run(context.Background())
+
+	if report.Status != StatusFailing || !report.ShuttingDown {
+		t.Errorf("Readiness passing during shutdown: %+v", report)
+	}
+
+	res := httptest.NewRecorder()
+	LivenessHandler().ServeHTTP(res, httptest.NewRequest("GET", "/livez", nil))
+
+	if res.Code != 200 {
+		t.Errorf("Liveness failing during shutdown: %d", res.Code)
+	}
+}
+
+func TestJob(t *testing.T) {
+	job := NewJob(time.Hour)
+
+	if err := job.Check(context.Background()); err != nil {
+		t.Errorf("New job failing: %v", err)
+	}
+
+	for i := 1; i <= jobFailureLimit; i++ {
+		job.Started()
+		job.Finished(errors.New("connection refused"))
+
+		err := job.Check(context.Background())
+
+		if i < jobFailureLimit && err != nil {
+			t.Errorf("Failing after %d failed runs: %v", i, err)
+		}
+
+		if i == jobFailureLimit && err == nil {
+			t.Errorf("Failed runs not reported")
+		}
+	}
+
+	job.Started()
+	job.Finished(nil)
+
+	if err := job.Check(context.Background()); err != nil {
+		t.Errorf("Recovered job failing: %v", err)
+	}
+
+	job = NewJob(time.Millisecond)
+	job.Started()
+	time.Sleep(5 * time.Millisecond)
+
+	if err := job.Check(context.Background()); err != nil {
+		t.Errorf("Slow run failing: %v", err)
+	}
+
+	job.Finished(nil)
+
+	if err := job.Check(context.Background()); err == nil {
+		t.Errorf("Stuck job not reported")
+	}
+}
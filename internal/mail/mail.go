@@ -0,0 +1,82 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers transactional emails (password resets, verifications).
+// Implementations must be safe for concurrent use.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// OutboxSender writes every message as an .eml file in Dir instead of sending
+// it, which is enough for development and for deployments that ship the
+// outbox to a relay.
+type OutboxSender struct {
+	Dir string
+}
+
+func (s OutboxSender) Send(ctx context.Context, msg Message) error {
+	err := os.MkdirAll(s.Dir, 0700)
+
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+
+	return os.WriteFile(filepath.Join(s.Dir, name), []byte(msg.format(now)), 0600)
+}
+
+// LogSender prints messages to the server log. It is the default when no
+// outbox is configured so nothing requires SMTP to work.
+type LogSender struct {
+	Logger *log.Logger
+}
+
+func (s LogSender) Send(ctx context.Context, msg Message) error {
+	logger := s.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	logger.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+func (m Message) format(date time.Time) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "From: %s\r\n", m.From)
+	fmt.Fprintf(&sb, "To: %s\r\n", m.To)
+	fmt.Fprintf(&sb, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&sb, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	sb.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+
+	return sb.String()
+}
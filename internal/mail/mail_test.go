@@ -0,0 +1,54 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutboxSender(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	sender := OutboxSender{Dir: dir}
+
+	for i := 0; i < 2; i++ {
+		err := sender.Send(context.Background(), Message{
+			From:    "chirpy@localhost",
+			To:      "user@example.com",
+			Subject: "Reset your password",
+			Body:    "line one\nline two",
+		})
+
+		if err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 messages in the outbox, found %d", len(files))
+	}
+
+	content, _ := os.ReadFile(files[0])
+
+	for _, expected := range []string{"To: user@example.com\r\n", "Subject: Reset your password\r\n", "\r\n\r\nline one\r\nline two"} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Message does not contain %q:\n%s", expected, content)
+		}
+	}
+}
+
+func TestLogSender(t *testing.T) {
+	var buf bytes.Buffer
+	sender := LogSender{Logger: log.New(&buf, "", 0)}
+
+	sender.Send(context.Background(), Message{To: "user@example.com", Subject: "Hello", Body: "token"})
+
+	if !strings.Contains(buf.String(), "user@example.com") || !strings.Contains(buf.String(), "token") {
+		t.Errorf("Unexpected log output %q", buf.String())
+	}
+}
@@ -0,0 +1,376 @@
+// Package metrics keeps counters, gauges and histograms in memory and
+// exposes them in the Prometheus text format (version 0.0.4), so they can be
+// scraped without running anything next to chirpy.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit request and query latencies in seconds.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds every metric and writes them out in registration order.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriter(counter)
+
+	for _, c := range collectors {
+		c.write(buffered)
+	}
+
+	err := buffered.Flush()
+
+	return counter.n, err
+}
+
+// Handler serves the metrics for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// family is what every metric type shares: a name, help text, label names
+// and one series per combination of label values.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms only
+	bucketCounts []uint64
+	count        uint64
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+
+	// Metrics without labels are reported as 0 until they change
+	if len(labels) == 0 && kind != "histogram" {
+		f.get(nil)
+	}
+
+	return f
+}
+
+// get returns the series for labelValues. The caller holds f.mu.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// sorted returns the series ordered by label values so output is stable.
+// The caller holds f.mu.
+func (f *family) sorted() []*series {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, f.series[key])
+	}
+
+	return sorted
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.writeHeader(w)
+
+	for _, s := range f.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatValue(s.value))
+	}
+}
+
+// Counter only goes up.
+type Counter struct {
+	family *family
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: newFamily(name, help, "counter", labels)}
+	r.register(name, c.family)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic("metrics: counters can't decrease")
+	}
+
+	c.family.mu.Lock()
+	defer c.family.mu.Unlock()
+
+	c.family.get(labelValues).value += value
+}
+
+// Value returns the current value, for tests and the admin page.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.family.mu.Lock()
+	defer c.family.mu.Unlock()
+
+	return c.family.get(labelValues).value
+}
+
+// Sum adds up every series.
+func (c *Counter) Sum() float64 {
+	c.family.mu.Lock()
+	defer c.family.mu.Unlock()
+
+	sum := 0.0
+	for _, s := range c.family.series {
+		sum += s.value
+	}
+
+	return sum
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	family *family
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{family: newFamily(name, help, "gauge", labels)}
+	r.register(name, g.family)
+	return g
+}
+
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.family.mu.Lock()
+	defer g.family.mu.Unlock()
+
+	g.family.get(labelValues).value += value
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.family.mu.Lock()
+	defer g.family.mu.Unlock()
+
+	g.family.get(labelValues).value = value
+}
+
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.family.mu.Lock()
+	defer g.family.mu.Unlock()
+
+	return g.family.get(labelValues).value
+}
+
+// gaugeFunc reads its value when scraped.
+type gaugeFunc struct {
+	family *family
+	fn     func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	g := &gaugeFunc{family: newFamily(name, help, "gauge", nil), fn: fn}
+	r.register(name, g)
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.family.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.family.name, formatValue(g.fn()))
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	family  *family
+	buckets []float64
+}
+
+// NewHistogram registers a histogram. buckets are upper bounds in increasing
+// order; the +Inf bucket is added automatically.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be sorted")
+	}
+
+	h := &Histogram{family: newFamily(name, help, "histogram", labels), buckets: buckets}
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.family.mu.Lock()
+	defer h.family.mu.Unlock()
+
+	s := h.family.get(labelValues)
+	if s.bucketCounts == nil {
+		s.bucketCounts = make([]uint64, len(h.buckets))
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.bucketCounts[i]++
+		}
+	}
+
+	s.count++
+	s.value += value
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.family.mu.Lock()
+	defer h.family.mu.Unlock()
+
+	h.family.writeHeader(w)
+
+	labels := append(append([]string(nil), h.family.labels...), "le")
+
+	for _, s := range h.family.sorted() {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.family.name, formatLabels(labels, s.labelValues, "le", formatValue(bound)), s.bucketCounts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.family.name, formatLabels(labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.family.name, formatLabels(h.family.labels, s.labelValues, "", ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.family.name, formatLabels(h.family.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// formatLabels renders {a="1",b="2"}. extra is appended as the value of the
+// last label name when set.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(values) == 0 && extraName == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+
+	for i, value := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, names[i], escapeLabel(value))
+	}
+
+	if extraName != "" {
+		if len(values) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extraName, extraValue)
+	}
+
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounter("test_requests_total", "Requests handled.", "route", "code")
+	inFlight := registry.NewGauge("test_in_flight", "Requests in flight.")
+	latency := registry.NewHistogram("test_duration_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	registry.NewGaugeFunc("test_answer", "The answer.", func() float64 { return 42 })
+	registry.NewCounter("test_untouched_total", "Never incremented.")
+
+	requests.Inc("GET /b", "200")
+	requests.Inc("GET /a", "200")
+	requests.Add(2, "GET /a", "200")
+	requests.Inc("GET /a", `5"0\0`)
+	inFlight.Inc()
+	inFlight.Inc()
+	inFlight.Dec()
+	latency.Observe(0.05, "GET /a")
+	latency.Observe(0.5, "GET /a")
+	latency.Observe(5, "GET /a")
+
+	expected := `# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{route="GET /a",code="200"} 3
+test_requests_total{route="GET /a",code="5\"0\\0"} 1
+test_requests_total{route="GET /b",code="200"} 1
+# HELP test_in_flight Requests in flight.
+# TYPE test_in_flight gauge
+test_in_flight 1
+# HELP test_duration_seconds Request latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="GET /a",le="0.1"} 1
+test_duration_seconds_bucket{route="GET /a",le="1"} 2
+test_duration_seconds_bucket{route="GET /a",le="+Inf"} 3
+test_duration_seconds_sum{route="GET /a"} 5.55
+test_duration_seconds_count{route="GET /a"} 3
+# HELP test_answer The answer.
+# TYPE test_answer gauge
+test_answer 42
+# HELP test_untouched_total Never incremented.
+# TYPE test_untouched_total counter
+test_untouched_total 0
+`
+
+	var out strings.Builder
+	registry.WriteTo(&out)
+
+	if out.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+
+	if requests.Sum() != 5 {
+		t.Errorf("Expected a sum of 5, got %v", requests.Sum())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "Things.").Inc()
+
+	res := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.HasPrefix(res.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", res.Header().Get("Content-Type"))
+	}
+
+	if !strings.Contains(res.Body.String(), "test_total 1\n") {
+		t.Errorf("Counter missing from %q", res.Body.String())
+	}
+}
+
+func TestPanics(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_total", "Things.", "kind")
+
+	cases := map[string]func(){
+		"duplicate name":     func() { registry.NewGauge("test_total", "Again.") },
+		"wrong label count":  func() { counter.Inc() },
+		"negative increment": func() { counter.Add(-1, "a") },
+		"unsorted buckets":   func() { registry.NewHistogram("test_seconds", "Latency.", []float64{1, 0.1}) },
+	}
+
+	for name, fn := range cases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,124 @@
+// Package migrations applies the embedded schema migrations with goose.
+//
+// On Postgres, migrations that change the schema take an advisory lock, so
+// instances starting together don't race to apply them.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+	"github.com/samuelea/chirpy/internal/database"
+	"github.com/samuelea/chirpy/sql/schema"
+)
+
+// ErrSchemaAhead means the database has migrations this binary doesn't know
+// about, so it was built from older code than the schema.
+var ErrSchemaAhead = errors.New("database schema is ahead of chirpy")
+
+type Migrator struct {
+	provider *goose.Provider
+}
+
+func New(db *sql.DB, dialect database.Dialect) (*Migrator, error) {
+	var provider *goose.Provider
+	var err error
+
+	switch dialect {
+	case database.Postgres:
+		var locker lock.SessionLocker
+
+		locker, err = lock.NewPostgresSessionLocker()
+
+		if err != nil {
+			return nil, err
+		}
+
+		provider, err = goose.NewProvider(goose.DialectPostgres, db, schema.Migrations, goose.WithSessionLocker(locker))
+	case database.SQLite:
+		// SQLite serves a single instance, so there is no one to race with
+		var migrations fs.FS
+
+		migrations, err = fs.Sub(schema.SQLiteMigrations, "sqlite")
+
+		if err != nil {
+			return nil, err
+		}
+
+		provider, err = goose.NewProvider(goose.DialectSQLite3, db, migrations)
+	default:
+		err = fmt.Errorf("no migrations for %s", dialect)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{provider: provider}, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) ([]*goose.MigrationResult, error) {
+	return m.provider.Up(ctx)
+}
+
+// Down rolls back the newest migration.
+func (m *Migrator) Down(ctx context.Context) ([]*goose.MigrationResult, error) {
+	result, err := m.provider.Down(ctx)
+
+	if result == nil {
+		return nil, err
+	}
+
+	return []*goose.MigrationResult{result}, err
+}
+
+// Redo rolls back the newest migration and applies it again.
+func (m *Migrator) Redo(ctx context.Context) ([]*goose.MigrationResult, error) {
+	results, err := m.Down(ctx)
+
+	if err != nil {
+		return results, err
+	}
+
+	result, err := m.provider.UpByOne(ctx)
+
+	if result != nil {
+		results = append(results, result)
+	}
+
+	return results, err
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]*goose.MigrationStatus, error) {
+	return m.provider.Status(ctx)
+}
+
+// Check fails when migrations are pending, or with ErrSchemaAhead when the
+// database is newer than the embedded migrations.
+func (m *Migrator) Check(ctx context.Context) error {
+	current, target, err := m.provider.GetVersions(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	return compare(current, target)
+}
+
+func compare(current, target int64) error {
+	if current > target {
+		return fmt.Errorf("%w: the database is at migration %d, chirpy only knows up to %d", ErrSchemaAhead, current, target)
+	}
+
+	if current < target {
+		return fmt.Errorf("the database is at migration %d, chirpy needs %d", current, target)
+	}
+
+	return nil
+}
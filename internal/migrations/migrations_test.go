@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/samuelea/chirpy/sql/schema"
+)
+
+func TestCompare(t *testing.T) {
+	if err := compare(17, 17); err != nil {
+		t.Errorf("Up to date schema failing: %v", err)
+	}
+
+	if err := compare(16, 17); err == nil || errors.Is(err, ErrSchemaAhead) {
+		t.Errorf("Expected a pending error, got %v", err)
+	}
+
+	if err := compare(18, 17); !errors.Is(err, ErrSchemaAhead) {
+		t.Errorf("Expected ErrSchemaAhead, got %v", err)
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	embedded, err := fs.Glob(schema.Migrations, "*.sql")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onDisk, err := fs.Glob(os.DirFS("../../sql/schema"), "*.sql")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(embedded) == 0 || len(embedded) != len(onDisk) {
+		t.Errorf("Embedded %d migrations, %d on disk", len(embedded), len(onDisk))
+	}
+}
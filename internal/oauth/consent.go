@@ -0,0 +1,66 @@
+package oauth
+
+import (
+	"html/template"
+	"io"
+
+	"github.com/samuelea/chirpy/internal/auth"
+)
+
+var scopeDescriptions = map[string]string{
+	auth.ScopeChirpsRead:   "Read chirps",
+	auth.ScopeChirpsWrite:  "Post and delete chirps as you",
+	auth.ScopeProfileRead:  "See your account and subscription",
+	auth.ScopeProfileWrite: "Change your email address and password",
+}
+
+// ConsentPage is shown by GET /oauth/authorize. The user signs in and
+// approves or denies the request in the same form.
+type ConsentPage struct {
+	ClientName string
+	Scopes     []string
+	// Params are the authorization request parameters, posted back as
+	// hidden fields.
+	Params map[string]string
+	Email  string
+	Error  string
+}
+
+func (p ConsentPage) ScopeDescription(scope string) string {
+	if description, ok := scopeDescriptions[scope]; ok {
+		return description
+	}
+
+	return scope
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Authorize {{.ClientName}} - Chirpy</title>
+  </head>
+  <body>
+    <h1>{{.ClientName}} wants to access your Chirpy account</h1>
+    {{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+    <p>It will be able to:</p>
+    <ul>
+      {{range .Scopes}}<li>{{$.ScopeDescription .}}</li>
+      {{end}}
+    </ul>
+    <form method="post" action="/oauth/authorize">
+      {{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+      {{end}}
+      <label>Email <input type="email" name="email" value="{{.Email}}" autocomplete="username" required></label>
+      <label>Password <input type="password" name="password" autocomplete="current-password"></label>
+      <label>Two-factor code (if enabled) <input type="text" name="code" inputmode="numeric" autocomplete="one-time-code"></label>
+      <button type="submit" name="decision" value="allow">Allow</button>
+      <button type="submit" name="decision" value="deny" formnovalidate>Deny</button>
+    </form>
+  </body>
+</html>
+`))
+
+func RenderConsentPage(w io.Writer, page ConsentPage) error {
+	return consentTemplate.Execute(w, page)
+}
@@ -0,0 +1,175 @@
+// Package oauth holds the protocol rules of chirpy's OAuth 2.0 authorization
+// server: RFC 6749 error codes, PKCE (RFC 7636) and redirect URI checks. The
+// HTTP handlers and storage live with the rest of the API.
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Error codes from RFC 6749 sections 4.1.2.1 and 5.2.
+const (
+	ErrInvalidRequest          = "invalid_request"
+	ErrInvalidClient           = "invalid_client"
+	ErrInvalidGrant            = "invalid_grant"
+	ErrInvalidScope            = "invalid_scope"
+	ErrUnauthorizedClient      = "unauthorized_client"
+	ErrUnsupportedGrantType    = "unsupported_grant_type"
+	ErrUnsupportedResponseType = "unsupported_response_type"
+	ErrAccessDenied            = "access_denied"
+	ErrServerError             = "server_error"
+)
+
+// Error is the body of a failed token, revocation or authorization request.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+
+	return e.Code + ": " + e.Description
+}
+
+// CodeChallengeMethod is the only PKCE method accepted. "plain" offers no
+// protection when the authorization request leaks, so it is refused.
+const CodeChallengeMethod = "S256"
+
+// ValidCodeVerifier reports whether verifier follows RFC 7636 section 4.1:
+// 43 to 128 unreserved characters.
+func ValidCodeVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	return isUnreserved(verifier)
+}
+
+// ValidCodeChallenge reports whether challenge looks like an S256 challenge,
+// the unpadded base64url encoding of a SHA-256 digest.
+func ValidCodeChallenge(challenge string) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// VerifyCodeChallenge checks verifier against the S256 challenge sent with
+// the authorization request.
+func VerifyCodeChallenge(verifier, challenge string) bool {
+	if !ValidCodeVerifier(verifier) {
+		return false
+	}
+
+	expected := S256Challenge(verifier)
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// S256Challenge derives the code challenge sent with an authorization request
+// from its verifier.
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func isUnreserved(s string) bool {
+	for _, r := range s {
+		isAlnum := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if !isAlnum && !strings.ContainsRune("-._~", r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ValidateRedirectURI checks a redirect URI at client registration. It must
+// be absolute and without a fragment. Plain http is only allowed for loopback
+// addresses, used by desktop apps, while private schemes such as
+// com.example.app:/callback are allowed for mobile apps.
+func ValidateRedirectURI(raw string) error {
+	uri, err := url.Parse(raw)
+
+	if err != nil {
+		return errors.New("malformed redirect URI")
+	}
+
+	if !uri.IsAbs() {
+		return errors.New("redirect URIs must be absolute")
+	}
+
+	if uri.Fragment != "" || strings.Contains(raw, "#") {
+		return errors.New("redirect URIs must not contain a fragment")
+	}
+
+	switch uri.Scheme {
+	case "https":
+		if uri.Host == "" {
+			return errors.New("redirect URIs must have a host")
+		}
+	case "http":
+		if !isLoopback(uri.Hostname()) {
+			return errors.New("http redirect URIs are only allowed for localhost")
+		}
+	default:
+		// Private-use schemes must be reverse domain names (RFC 8252 7.1)
+		if !strings.Contains(uri.Scheme, ".") {
+			return errors.New("custom redirect URI schemes must be reverse domain names")
+		}
+	}
+
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// MatchRedirectURI reports whether uri is one of the registered URIs. Matching
+// is exact, as required by the OAuth security best current practice.
+func MatchRedirectURI(registered []string, uri string) bool {
+	for _, candidate := range registered {
+		if candidate == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RedirectURL adds params to the query of redirectURI, keeping any query the
+// client registered.
+func RedirectURL(redirectURI string, params url.Values) string {
+	uri, err := url.Parse(redirectURI)
+
+	if err != nil {
+		return redirectURI
+	}
+
+	query := uri.Query()
+
+	for key, values := range params {
+		for _, value := range values {
+			if value != "" {
+				query.Add(key, value)
+			}
+		}
+	}
+
+	uri.RawQuery = query.Encode()
+
+	return uri.String()
+}
@@ -0,0 +1,121 @@
+package oauth
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if !ValidCodeChallenge(challenge) {
+		t.Errorf("Valid challenge rejected")
+	}
+
+	if !VerifyCodeChallenge(verifier, challenge) {
+		t.Errorf("Verifier does not match its challenge")
+	}
+
+	if VerifyCodeChallenge(strings.Replace(verifier, "d", "e", 1), challenge) {
+		t.Errorf("Wrong verifier accepted")
+	}
+
+	if VerifyCodeChallenge("short", challenge) {
+		t.Errorf("Verifier shorter than 43 characters accepted")
+	}
+
+	if ValidCodeChallenge(verifier + "==") {
+		t.Errorf("Malformed challenge accepted")
+	}
+
+	if ValidCodeVerifier(strings.Repeat("a", 42) + "!") {
+		t.Errorf("Verifier with reserved characters accepted")
+	}
+}
+
+func TestValidateRedirectURI(t *testing.T) {
+	valid := []string{
+		"https://app.example.com/callback",
+		"https://app.example.com/callback?tenant=1",
+		"http://localhost:8080/callback",
+		"http://127.0.0.1/callback",
+		"http://[::1]:3000/cb",
+		"com.example.app:/oauth",
+	}
+
+	for _, uri := range valid {
+		if err := ValidateRedirectURI(uri); err != nil {
+			t.Errorf("%s rejected: %v", uri, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"/callback",
+		"http://app.example.com/callback",
+		"https://app.example.com/callback#fragment",
+		"myapp:/callback",
+		"https:///callback",
+	}
+
+	for _, uri := range invalid {
+		if err := ValidateRedirectURI(uri); err == nil {
+			t.Errorf("%q accepted", uri)
+		}
+	}
+}
+
+func TestMatchRedirectURI(t *testing.T) {
+	registered := []string{"https://app.example.com/callback"}
+
+	if !MatchRedirectURI(registered, "https://app.example.com/callback") {
+		t.Errorf("Registered URI rejected")
+	}
+
+	for _, uri := range []string{"https://app.example.com/callback/", "https://app.example.com/callback?x=1", "https://APP.example.com/callback"} {
+		if MatchRedirectURI(registered, uri) {
+			t.Errorf("%s matched %v", uri, registered)
+		}
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	redirect := RedirectURL("https://app.example.com/cb?tenant=1", url.Values{
+		"code":  {"abc"},
+		"state": {""},
+	})
+
+	uri, _ := url.Parse(redirect)
+	query := uri.Query()
+
+	if query.Get("tenant") != "1" || query.Get("code") != "abc" || query.Has("state") {
+		t.Errorf("Unexpected redirect %s", redirect)
+	}
+}
+
+func TestRenderConsentPage(t *testing.T) {
+	var page strings.Builder
+
+	err := RenderConsentPage(&page, ConsentPage{
+		ClientName: "<script>alert(1)</script>",
+		Scopes:     []string{"chirps:read"},
+		Params:     map[string]string{"state": `"><b>`},
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+
+	html := page.String()
+
+	if strings.Contains(html, "<script>") || strings.Contains(html, `"><b>`) {
+		t.Errorf("Client supplied values are not escaped:\n%s", html)
+	}
+
+	if !strings.Contains(html, "Read chirps") {
+		t.Errorf("Scope description missing:\n%s", html)
+	}
+}
@@ -0,0 +1,174 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/samuelea/chirpy/internal/oidc/oidctest"
+)
+
+const redirectURL = "http://localhost:8080/api/oidc/stub/callback"
+
+func newTestProvider(t *testing.T) (*oidctest.Provider, *Provider) {
+	stub := oidctest.NewProvider("chirpy", "s3cret/+")
+	t.Cleanup(stub.Close)
+
+	provider, err := NewProvider(Config{
+		Name:         "stub",
+		Issuer:       stub.Issuer(),
+		ClientID:     stub.ClientID,
+		ClientSecret: stub.ClientSecret,
+		RedirectURL:  redirectURL,
+	}, stub.Server.Client())
+
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+
+	return stub, provider
+}
+
+// authorize follows the authorization URL and returns the code the stub
+// redirects back with.
+func authorize(t *testing.T, stub *oidctest.Provider, authURL, state string) string {
+	client := stub.Server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("Authorization request failed: %v", err)
+	}
+	res.Body.Close()
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), redirectURL) {
+		t.Fatalf("Unexpected redirect %q", res.Header.Get("Location"))
+	}
+
+	if location.Query().Get("state") != state {
+		t.Fatalf("State was not returned")
+	}
+
+	return location.Query().Get("code")
+}
+
+func TestLogin(t *testing.T) {
+	stub, provider := newTestProvider(t)
+	ctx := context.Background()
+
+	verifier := strings.Repeat("v", 43)
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatalf("Failed to build authorization URL: %v", err)
+	}
+
+	code := authorize(t, stub, authURL, "state-1")
+
+	idToken, err := provider.Exchange(ctx, code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+
+	if idToken.Subject != stub.Subject || idToken.Email != stub.Email || !idToken.EmailVerified {
+		t.Errorf("Unexpected ID token %+v", idToken)
+	}
+
+	// Codes are single use
+	if _, err := provider.Exchange(ctx, code, verifier, "nonce-1"); err == nil {
+		t.Errorf("A code was redeemed twice")
+	}
+}
+
+func TestExchangeChecksPKCEAndNonce(t *testing.T) {
+	stub, provider := newTestProvider(t)
+	ctx := context.Background()
+
+	verifier := strings.Repeat("v", 43)
+
+	authURL, _ := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+	code := authorize(t, stub, authURL, "state")
+
+	if _, err := provider.Exchange(ctx, code, strings.Repeat("w", 43), "nonce"); err == nil {
+		t.Errorf("Wrong code verifier accepted")
+	}
+
+	authURL, _ = provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+	code = authorize(t, stub, authURL, "state")
+
+	if _, err := provider.Exchange(ctx, code, verifier, "other-nonce"); err == nil {
+		t.Errorf("ID token with another nonce accepted")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	stub, provider := newTestProvider(t)
+	ctx := context.Background()
+
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":   stub.Issuer(),
+			"sub":   "user-1",
+			"aud":   stub.ClientID,
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": "nonce",
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	if _, err := provider.VerifyIDToken(ctx, stub.SignIDToken(claims(nil)), "nonce"); err != nil {
+		t.Fatalf("Valid token rejected: %v", err)
+	}
+
+	invalid := map[string]jwt.MapClaims{
+		"other issuer":   {"iss": "https://evil.example.com"},
+		"other audience": {"aud": "someone-else"},
+		"expired":        {"exp": time.Now().Add(-time.Hour).Unix()},
+		"no subject":     {"sub": ""},
+		"other azp":      {"aud": []string{stub.ClientID, "other"}, "azp": "other"},
+	}
+
+	for name, overrides := range invalid {
+		if _, err := provider.VerifyIDToken(ctx, stub.SignIDToken(claims(overrides)), "nonce"); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	idToken, err := provider.VerifyIDToken(ctx, stub.SignIDToken(claims(jwt.MapClaims{"email_verified": "true"})), "nonce")
+	if err != nil || !idToken.EmailVerified {
+		t.Errorf("String email_verified not understood: %v", err)
+	}
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil))
+	forgedToken, _ := forged.SignedString([]byte("secret"))
+
+	if _, err := provider.VerifyIDToken(ctx, forgedToken, "nonce"); err == nil {
+		t.Errorf("HS256 token accepted")
+	}
+}
+
+func TestDiscoveryChecksIssuer(t *testing.T) {
+	stub := oidctest.NewProvider("chirpy", "")
+	defer stub.Close()
+
+	provider, _ := NewProvider(Config{
+		Name:        "stub",
+		Issuer:      stub.Issuer() + "/",
+		ClientID:    "chirpy",
+		RedirectURL: redirectURL,
+	}, stub.Server.Client())
+
+	if _, err := provider.Metadata(context.Background()); err == nil {
+		t.Errorf("Discovery document for another issuer accepted")
+	}
+}
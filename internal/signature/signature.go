@@ -0,0 +1,152 @@
+// Package signature signs and verifies webhook deliveries with HMAC-SHA256.
+//
+// The signed payload is the delivery timestamp (Unix seconds), a dot and the
+// raw request body. The signature header holds one or more comma separated
+// "v1=<hex digest>" entries so the sender can sign with both the old and the
+// new secret while secrets are rotated.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const version = "v1"
+
+var (
+	ErrMissingSignature    = errors.New("missing signature")
+	ErrInvalidTimestamp    = errors.New("invalid timestamp")
+	ErrTimestampOutOfRange = errors.New("timestamp outside the tolerance window")
+	ErrInvalidSignature    = errors.New("invalid signature")
+	ErrReplayed            = errors.New("delivery already received")
+)
+
+// Sign returns the hex HMAC-SHA256 of the delivery.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Header builds the signature header value for a delivery signed with every
+// secret.
+func Header(secrets []string, timestamp time.Time, body []byte) string {
+	signatures := make([]string, 0, len(secrets))
+
+	for _, secret := range secrets {
+		signatures = append(signatures, version+"="+Sign(secret, timestamp, body))
+	}
+
+	return strings.Join(signatures, ",")
+}
+
+// Verifier checks signed deliveries. A delivery is accepted when its
+// timestamp is within Tolerance of now and any of its signatures matches any
+// of the secrets. Each accepted signature is remembered until it leaves the
+// tolerance window so a captured delivery can't be replayed.
+//
+// The replay memory is per process; run a single receiver or dedupe events
+// downstream when several instances share the secrets.
+type Verifier struct {
+	secrets   []string
+	tolerance time.Duration
+	now       func() time.Time
+	mu        sync.Mutex
+	seen      map[string]time.Time
+}
+
+func NewVerifier(secrets []string, tolerance time.Duration) (*Verifier, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("at least one secret is required")
+	}
+
+	for _, secret := range secrets {
+		if secret == "" {
+			return nil, errors.New("empty secrets are not allowed")
+		}
+	}
+
+	if tolerance <= 0 {
+		return nil, errors.New("the tolerance must be positive")
+	}
+
+	return &Verifier{
+		secrets:   secrets,
+		tolerance: tolerance,
+		now:       time.Now,
+		seen:      map[string]time.Time{},
+	}, nil
+}
+
+func (v *Verifier) Verify(signatureHeader, timestampHeader string, body []byte) error {
+	if signatureHeader == "" || timestampHeader == "" {
+		return ErrMissingSignature
+	}
+
+	unix, err := strconv.ParseInt(timestampHeader, 10, 64)
+
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	timestamp := time.Unix(unix, 0)
+	now := v.now()
+
+	if timestamp.Before(now.Add(-v.tolerance)) || timestamp.After(now.Add(v.tolerance)) {
+		return ErrTimestampOutOfRange
+	}
+
+	matched := ""
+
+	for _, entry := range strings.Split(signatureHeader, ",") {
+		entryVersion, signature, ok := strings.Cut(strings.TrimSpace(entry), "=")
+
+		if !ok || entryVersion != version {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(signature)
+
+		if err != nil {
+			continue
+		}
+
+		for _, secret := range v.secrets {
+			expected, _ := hex.DecodeString(Sign(secret, timestamp, body))
+
+			if hmac.Equal(decoded, expected) {
+				matched = hex.EncodeToString(expected)
+			}
+		}
+	}
+
+	if matched == "" {
+		return ErrInvalidSignature
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for signature, expiresAt := range v.seen {
+		if now.After(expiresAt) {
+			delete(v.seen, signature)
+		}
+	}
+
+	if _, replayed := v.seen[matched]; replayed {
+		return ErrReplayed
+	}
+
+	v.seen[matched] = timestamp.Add(v.tolerance)
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package signature
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"event":"user.upgraded"}`)
+
+	verifier, err := NewVerifier([]string{"old-secret", "new-secret"}, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+	verifier.now = func() time.Time { return now }
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	cases := []struct {
+		name      string
+		header    string
+		timestamp string
+		body      []byte
+		err       error
+	}{
+		{"old secret", Header([]string{"old-secret"}, now, body), timestamp, body, nil},
+		{"new secret", Header([]string{"new-secret"}, now, body), timestamp, body, nil},
+		{"replay", Header([]string{"new-secret"}, now, body), timestamp, body, ErrReplayed},
+		{"unknown secret first", Header([]string{"other", "new-secret"}, now.Add(-time.Second), body), strconv.FormatInt(now.Unix()-1, 10), body, nil},
+		{"unknown secret", Header([]string{"other"}, now, body), timestamp, body, ErrInvalidSignature},
+		{"tampered body", Header([]string{"new-secret"}, now, body), timestamp, []byte(`{"event":"user.downgraded"}`), ErrInvalidSignature},
+		{"tampered timestamp", Header([]string{"new-secret"}, now, body), strconv.FormatInt(now.Unix()+1, 10), body, ErrInvalidSignature},
+		{"too old", Header([]string{"new-secret"}, now.Add(-6*time.Minute), body), strconv.FormatInt(now.Add(-6*time.Minute).Unix(), 10), body, ErrTimestampOutOfRange},
+		{"in the future", Header([]string{"new-secret"}, now.Add(6*time.Minute), body), strconv.FormatInt(now.Add(6*time.Minute).Unix(), 10), body, ErrTimestampOutOfRange},
+		{"malformed timestamp", Header([]string{"new-secret"}, now, body), "yesterday", body, ErrInvalidTimestamp},
+		{"missing", "", timestamp, body, ErrMissingSignature},
+		{"other version", "v0=" + Sign("new-secret", now, body), timestamp, body, ErrInvalidSignature},
+	}
+
+	for _, c := range cases {
+		err := verifier.Verify(c.header, c.timestamp, c.body)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestVerifyForgetsExpiredSignatures(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte("{}")
+
+	verifier, _ := NewVerifier([]string{"secret"}, time.Minute)
+	verifier.now = func() time.Time { return now }
+
+	header := Header([]string{"secret"}, now, body)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	verifier.Verify(header, timestamp, body)
+
+	now = now.Add(2 * time.Minute)
+	verifier.Verify(Header([]string{"secret"}, now, body), strconv.FormatInt(now.Unix(), 10), body)
+
+	if len(verifier.seen) != 1 {
+		t.Errorf("Expected expired signatures to be forgotten, %d remembered", len(verifier.seen))
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	if _, err := NewVerifier(nil, time.Minute); err == nil {
+		t.Errorf("Verifier without secrets created")
+	}
+
+	if _, err := NewVerifier([]string{""}, time.Minute); err == nil {
+		t.Errorf("Verifier with an empty secret created")
+	}
+}
@@ -0,0 +1,162 @@
+// Package subscription holds the Chirpy Red subscription lifecycle: the
+// events the payment provider sends and how each one moves a subscription
+// between states.
+package subscription
+
+import (
+	"errors"
+	"time"
+)
+
+const PlanChirpyRed = "chirpy_red"
+
+// Statuses. Active, cancelled and past due subscriptions grant access until
+// their period (or grace period) ends; expired and refunded ones never do.
+const (
+	StatusActive    = "active"
+	StatusCancelled = "cancelled"
+	StatusPastDue   = "past_due"
+	StatusExpired   = "expired"
+	StatusRefunded  = "refunded"
+)
+
+// Events sent by Polka.
+const (
+	EventUpgraded      = "user.upgraded"
+	EventDowngraded    = "user.downgraded"
+	EventRenewed       = "subscription.renewed"
+	EventRenewalFailed = "subscription.renewal_failed"
+	EventExpired       = "subscription.expired"
+	EventRefunded      = "subscription.refunded"
+)
+
+var (
+	ErrUnknownEvent     = errors.New("unknown subscription event")
+	ErrNoSubscription   = errors.New("the user has no subscription")
+	ErrMissingPeriodEnd = errors.New("the event has no period end")
+)
+
+// State is a subscription at a point in time. Zero times mean "not set": a
+// subscription without a period end runs until it is cancelled.
+type State struct {
+	Status      string
+	PeriodEnd   time.Time
+	GraceEnd    time.Time
+	CancelledAt time.Time
+}
+
+// Event is a lifecycle event for one user. PeriodEnd is the end of the paid
+// period for upgrades and renewals.
+type Event struct {
+	Type      string
+	PeriodEnd time.Time
+}
+
+func KnownEvent(eventType string) bool {
+	switch eventType {
+	case EventUpgraded, EventDowngraded, EventRenewed, EventRenewalFailed, EventExpired, EventRefunded:
+		return true
+	}
+
+	return false
+}
+
+// ActiveAt reports whether the subscription grants Chirpy Red at now.
+func (s State) ActiveAt(now time.Time) bool {
+	switch s.Status {
+	case StatusActive, StatusCancelled, StatusPastDue:
+	default:
+		return false
+	}
+
+	if s.PeriodEnd.IsZero() || now.Before(s.PeriodEnd) {
+		return true
+	}
+
+	return now.Before(s.GraceEnd)
+}
+
+// ValidUntil is when access ends, zero for open ended subscriptions.
+func (s State) ValidUntil() time.Time {
+	if s.PeriodEnd.IsZero() {
+		return time.Time{}
+	}
+
+	if s.GraceEnd.After(s.PeriodEnd) {
+		return s.GraceEnd
+	}
+
+	return s.PeriodEnd
+}
+
+// Apply returns the state after event. current is nil when the user has never
+// subscribed. A failed renewal keeps access for grace past the period end.
+func Apply(current *State, event Event, now time.Time, grace time.Duration) (State, error) {
+	if !KnownEvent(event.Type) {
+		return State{}, ErrUnknownEvent
+	}
+
+	if event.Type == EventUpgraded {
+		return State{Status: StatusActive, PeriodEnd: event.PeriodEnd}, nil
+	}
+
+	if current == nil {
+		return State{}, ErrNoSubscription
+	}
+
+	next := *current
+
+	switch event.Type {
+	case EventRenewed:
+		if event.PeriodEnd.IsZero() {
+			return State{}, ErrMissingPeriodEnd
+		}
+
+		// Deliveries can arrive out of order; a late renewal must not
+		// shorten the period
+		if event.PeriodEnd.After(next.PeriodEnd) {
+			next.PeriodEnd = event.PeriodEnd
+		}
+
+		next.Status = StatusActive
+		next.GraceEnd = time.Time{}
+		next.CancelledAt = time.Time{}
+	case EventRenewalFailed:
+		if next.Status != StatusActive && next.Status != StatusPastDue {
+			return next, nil
+		}
+
+		if next.Status == StatusActive {
+			start := next.PeriodEnd
+			if start.IsZero() || start.Before(now) {
+				start = now
+			}
+
+			next.GraceEnd = start.Add(grace)
+		}
+
+		next.Status = StatusPastDue
+	case EventDowngraded:
+		if next.Status == StatusExpired || next.Status == StatusRefunded {
+			return next, nil
+		}
+
+		// Cancelled subscribers keep what they paid for. Open ended
+		// subscriptions and those in their grace period end now.
+		next.Status = StatusCancelled
+		next.CancelledAt = now
+		next.GraceEnd = time.Time{}
+
+		if next.PeriodEnd.IsZero() || !next.PeriodEnd.After(now) {
+			next.PeriodEnd = now
+		}
+	case EventExpired:
+		if next.Status != StatusRefunded {
+			next.Status = StatusExpired
+		}
+	case EventRefunded:
+		next.Status = StatusRefunded
+	}
+
+	return next, nil
+}
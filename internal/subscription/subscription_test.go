@@ -0,0 +1,117 @@
+package subscription
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const grace = 72 * time.Hour
+
+func TestLifecycle(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	periodEnd := now.Add(30 * 24 * time.Hour)
+
+	state, err := Apply(nil, Event{Type: EventUpgraded, PeriodEnd: periodEnd}, now, grace)
+	if err != nil || state.Status != StatusActive || !state.ActiveAt(now) {
+		t.Fatalf("Upgrade did not activate the subscription: %+v, %v", state, err)
+	}
+
+	if state.ActiveAt(periodEnd) {
+		t.Errorf("Subscription active after its period ended")
+	}
+
+	// A failed renewal keeps access during the grace period
+	state, _ = Apply(&state, Event{Type: EventRenewalFailed}, now, grace)
+	if state.Status != StatusPastDue || !state.GraceEnd.Equal(periodEnd.Add(grace)) {
+		t.Fatalf("Unexpected state after a failed renewal: %+v", state)
+	}
+
+	if !state.ActiveAt(periodEnd.Add(time.Hour)) || state.ActiveAt(periodEnd.Add(grace)) {
+		t.Errorf("Grace period not applied")
+	}
+
+	// Retries don't extend the grace period
+	retried, _ := Apply(&state, Event{Type: EventRenewalFailed}, periodEnd.Add(time.Hour), grace)
+	if !retried.GraceEnd.Equal(state.GraceEnd) {
+		t.Errorf("Grace period extended by a second failure")
+	}
+
+	nextPeriodEnd := periodEnd.Add(30 * 24 * time.Hour)
+	state, _ = Apply(&state, Event{Type: EventRenewed, PeriodEnd: nextPeriodEnd}, periodEnd, grace)
+	if state.Status != StatusActive || !state.PeriodEnd.Equal(nextPeriodEnd) || !state.GraceEnd.IsZero() {
+		t.Fatalf("Unexpected state after renewal: %+v", state)
+	}
+
+	// A late delivery of an older renewal keeps the longer period
+	late, _ := Apply(&state, Event{Type: EventRenewed, PeriodEnd: periodEnd}, periodEnd, grace)
+	if !late.PeriodEnd.Equal(nextPeriodEnd) {
+		t.Errorf("Renewal shortened the period to %v", late.PeriodEnd)
+	}
+
+	// Cancelling keeps access until the paid period ends
+	state, _ = Apply(&state, Event{Type: EventDowngraded}, periodEnd, grace)
+	if state.Status != StatusCancelled || !state.ActiveAt(nextPeriodEnd.Add(-time.Hour)) || state.ActiveAt(nextPeriodEnd) {
+		t.Errorf("Unexpected state after cancelling: %+v", state)
+	}
+
+	state, _ = Apply(&state, Event{Type: EventExpired}, nextPeriodEnd, grace)
+	if state.Status != StatusExpired || state.ActiveAt(nextPeriodEnd.Add(-time.Hour)) {
+		t.Errorf("Unexpected state after expiry: %+v", state)
+	}
+}
+
+func TestOpenEndedSubscription(t *testing.T) {
+	now := time.Now()
+
+	state, _ := Apply(nil, Event{Type: EventUpgraded}, now, grace)
+	if !state.ActiveAt(now.Add(10*365*24*time.Hour)) || !state.ValidUntil().IsZero() {
+		t.Errorf("Upgrade without a period end is not open ended: %+v", state)
+	}
+
+	state, _ = Apply(&state, Event{Type: EventDowngraded}, now, grace)
+	if state.ActiveAt(now) {
+		t.Errorf("Cancelled open ended subscription still active")
+	}
+}
+
+func TestRefund(t *testing.T) {
+	now := time.Now()
+
+	state, _ := Apply(nil, Event{Type: EventUpgraded, PeriodEnd: now.Add(time.Hour)}, now, grace)
+	state, _ = Apply(&state, Event{Type: EventRefunded}, now, grace)
+
+	if state.Status != StatusRefunded || state.ActiveAt(now) {
+		t.Errorf("Refund did not end the subscription: %+v", state)
+	}
+
+	// A refund is final until the next upgrade
+	for _, eventType := range []string{EventDowngraded, EventExpired, EventRenewalFailed} {
+		next, _ := Apply(&state, Event{Type: eventType}, now, grace)
+		if next.Status != StatusRefunded {
+			t.Errorf("%s changed a refunded subscription to %s", eventType, next.Status)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	now := time.Now()
+	active := State{Status: StatusActive}
+
+	cases := []struct {
+		name    string
+		current *State
+		event   Event
+		err     error
+	}{
+		{"unknown event", &active, Event{Type: "user.exploded"}, ErrUnknownEvent},
+		{"no subscription", nil, Event{Type: EventDowngraded}, ErrNoSubscription},
+		{"renewal without period", &active, Event{Type: EventRenewed}, ErrMissingPeriodEnd},
+	}
+
+	for _, c := range cases {
+		if _, err := Apply(c.current, c.event, now, grace); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
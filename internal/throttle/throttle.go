@@ -0,0 +1,156 @@
+package throttle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policy describes how failed attempts are slowed down. The first
+// FreeAttempts failures cost nothing, every failure after that doubles the
+// delay starting at BaseDelay (capped at MaxDelay), and LockoutThreshold
+// failures lock the key for LockoutDuration. Failures older than ResetAfter
+// are forgotten.
+type Policy struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	ResetAfter       time.Duration
+}
+
+// Delay is how long the key must wait after its failures-th consecutive
+// failure.
+func (p Policy) Delay(failures int) time.Duration {
+	if failures < p.FreeAttempts {
+		return 0
+	}
+
+	if p.LockoutThreshold > 0 && failures >= p.LockoutThreshold {
+		return p.LockoutDuration
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay
+}
+
+// Limiter tracks failures per key (an IP address, an email) in memory.
+type Limiter struct {
+	policy  Policy
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*entry
+	calls   int
+}
+
+type entry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// Block is a key that is currently not allowed to try again.
+type Block struct {
+	Key          string
+	Failures     int
+	BlockedUntil time.Time
+}
+
+func NewLimiter(policy Policy) *Limiter {
+	return &Limiter{
+		policy:  policy,
+		now:     time.Now,
+		entries: map[string]*entry{},
+	}
+}
+
+// Allow reports whether key may attempt again, and if not, how long it has
+// to wait.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return true, 0
+	}
+
+	wait := e.blockedUntil.Sub(l.now())
+	if wait > 0 {
+		return false, wait
+	}
+
+	return true, 0
+}
+
+// Failure records a failed attempt and returns when the key may try again.
+func (l *Limiter) Failure(key string) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	l.calls++
+	if l.calls%1000 == 0 {
+		l.prune(now)
+	}
+
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.lastFailure) > l.policy.ResetAfter {
+		e = &entry{}
+		l.entries[key] = e
+	}
+
+	e.failures++
+	e.lastFailure = now
+	e.blockedUntil = now.Add(l.policy.Delay(e.failures))
+
+	return e.blockedUntil
+}
+
+// Success forgets the failures of key.
+func (l *Limiter) Success(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+}
+
+// Blocked lists the keys that are currently blocked, longest block first.
+func (l *Limiter) Blocked() []Block {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	blocks := []Block{}
+	for key, e := range l.entries {
+		if e.blockedUntil.After(now) {
+			blocks = append(blocks, Block{Key: key, Failures: e.failures, BlockedUntil: e.blockedUntil})
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].BlockedUntil.After(blocks[j].BlockedUntil)
+	})
+
+	return blocks
+}
+
+func (l *Limiter) prune(now time.Time) {
+	for key, e := range l.entries {
+		if now.Sub(e.lastFailure) > l.policy.ResetAfter && !e.blockedUntil.After(now) {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  time.Hour,
+	ResetAfter:       24 * time.Hour,
+}
+
+func TestPolicyDelay(t *testing.T) {
+	expected := map[int]time.Duration{
+		1:  0,
+		2:  0,
+		3:  time.Second,
+		4:  2 * time.Second,
+		5:  4 * time.Second,
+		9:  time.Minute,
+		10: time.Hour,
+		50: time.Hour,
+	}
+
+	for failures, delay := range expected {
+		if got := testPolicy.Delay(failures); got != delay {
+			t.Errorf("After %d failures expected a delay of %v, got %v", failures, delay, got)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewLimiter(testPolicy)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		limiter.Failure("10.0.0.1")
+	}
+
+	if ok, _ := limiter.Allow("10.0.0.1"); !ok {
+		t.Errorf("Key blocked before using its free attempts")
+	}
+
+	limiter.Failure("10.0.0.1")
+
+	ok, wait := limiter.Allow("10.0.0.1")
+	if ok || wait != time.Second {
+		t.Errorf("Expected a 1s backoff, got allowed=%v wait=%v", ok, wait)
+	}
+
+	if ok, _ := limiter.Allow("10.0.0.2"); !ok {
+		t.Errorf("Unrelated key is blocked")
+	}
+
+	blocked := limiter.Blocked()
+	if len(blocked) != 1 || blocked[0].Key != "10.0.0.1" || blocked[0].Failures != 3 {
+		t.Errorf("Unexpected blocked keys %+v", blocked)
+	}
+
+	now = now.Add(2 * time.Second)
+	if ok, _ := limiter.Allow("10.0.0.1"); !ok {
+		t.Errorf("Key still blocked after its backoff")
+	}
+
+	// Old failures are forgotten
+	now = now.Add(25 * time.Hour)
+	limiter.Failure("10.0.0.1")
+	if ok, _ := limiter.Allow("10.0.0.1"); !ok {
+		t.Errorf("Failures were not reset after ResetAfter")
+	}
+
+	limiter.Failure("10.0.0.1")
+	limiter.Failure("10.0.0.1")
+	limiter.Success("10.0.0.1")
+	if ok, _ := limiter.Allow("10.0.0.1"); !ok {
+		t.Errorf("Success did not clear the failures")
+	}
+}
@@ -2,8 +2,10 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/mail"
 	"strings"
 )
 
@@ -63,4 +65,22 @@ func GetCorrectedString(msg string, prohibitedWords []string) CorrectedStringRet
 		CorrectedMsg: newString,
 		WasCensored: wasCensored,
 	}
-}
\ No newline at end of file
+}
+
+// ValidateEmail accepts bare addresses only ("user@example.com"), not display
+// names or groups, and requires a dotted domain.
+func ValidateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+
+	if err != nil || address.Address != email {
+		return errors.New("invalid email address")
+	}
+
+	domain := email[strings.LastIndex(email, "@")+1:]
+
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return errors.New("invalid email address")
+	}
+
+	return nil
+}
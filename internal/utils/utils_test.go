@@ -0,0 +1,20 @@
+package utils
+
+import "testing"
+
+func TestValidateEmail(t *testing.T) {
+	valid := []string{"user@example.com", "first.last+tag@mail.example.co.uk"}
+	invalid := []string{"", "user", "user@", "@example.com", "user@localhost", "User <user@example.com>", "user@example.com.", " user@example.com"}
+
+	for _, email := range valid {
+		if err := ValidateEmail(email); err != nil {
+			t.Errorf("%q was rejected: %v", email, err)
+		}
+	}
+
+	for _, email := range invalid {
+		if err := ValidateEmail(email); err == nil {
+			t.Errorf("%q was accepted", email)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Package webhooks delivers chirpy events to endpoints registered by users.
+//
+// Deliveries are signed like incoming Polka webhooks (see package signature):
+// X-Chirpy-Timestamp holds the Unix time of the attempt and
+// X-Chirpy-Signature a "v1=<hex HMAC-SHA256>" of "<timestamp>.<body>" made
+// with the endpoint's secret.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/samuelea/chirpy/internal/signature"
+)
+
+const (
+	EventChirpCreated = "chirp.created"
+	EventChirpUpdated = "chirp.updated"
+	EventChirpDeleted = "chirp.deleted"
+)
+
+// EventTypes are the events endpoints can subscribe to.
+var EventTypes = []string{EventChirpCreated, EventChirpUpdated, EventChirpDeleted}
+
+// MaxAttempts is how many times a delivery is tried before it is given up.
+const MaxAttempts = 8
+
+var ErrPrivateAddress = errors.New("webhook endpoints can't be on private networks")
+
+// ParseEventTypes checks every entry is a known event. Duplicates are dropped.
+func ParseEventTypes(eventTypes []string) ([]string, error) {
+	if len(eventTypes) == 0 {
+		return nil, errors.New("at least one event type is required")
+	}
+
+	var parsed []string
+
+	for _, eventType := range eventTypes {
+		if !slices.Contains(EventTypes, eventType) {
+			return nil, fmt.Errorf("unknown event type %q", eventType)
+		}
+		if !slices.Contains(parsed, eventType) {
+			parsed = append(parsed, eventType)
+		}
+	}
+
+	return parsed, nil
+}
+
+// ValidateURL accepts absolute https URLs, and http ones when insecure is set
+// for local development.
+func ValidateURL(rawURL string, insecure bool) error {
+	parsed, err := url.Parse(rawURL)
+
+	if err != nil || parsed.Host == "" {
+		return errors.New("the URL must be absolute")
+	}
+
+	if parsed.User != nil || parsed.Fragment != "" {
+		return errors.New("the URL can't contain credentials or a fragment")
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if insecure {
+			return nil
+		}
+	}
+
+	return errors.New("the URL must use https")
+}
+
+// NewSecret returns a random signing secret for an endpoint.
+func NewSecret() (string, error) {
+	bytes := make([]byte, 32)
+
+	_, err := rand.Read(bytes)
+
+	if err != nil {
+		return "", err
+	}
+
+	return "whsec_" + hex.EncodeToString(bytes), nil
+}
+
+// Backoff is the wait after the attempt-th failed attempt: 30 seconds,
+// doubling up to 6 hours.
+func Backoff(attempt int) time.Duration {
+	delay := 30 * time.Second
+
+	for i := 1; i < attempt && delay < 6*time.Hour; i++ {
+		delay *= 2
+	}
+
+	return min(delay, 6*time.Hour)
+}
+
+// NewClient returns the client deliveries are sent with. Unless
+// allowPrivate is set it refuses to connect to loopback, private and link
+// local addresses, after DNS resolution, so endpoints can't reach internal
+// services.
+func NewClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+				return ErrPrivateAddress
+			}
+
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		// A redirect could point anywhere; receivers must answer directly
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Delivery is one event sent to one endpoint.
+type Delivery struct {
+	ID        string
+	EventType string
+	URL       string
+	Secret    string
+	Payload   []byte
+}
+
+// Result is the outcome of an attempt. StatusCode is 0 when no response was
+// received.
+type Result struct {
+	StatusCode int
+	Duration   time.Duration
+	Err        error
+}
+
+func (r Result) OK() bool {
+	return r.Err == nil
+}
+
+// Send makes one attempt. Any 2xx answer counts as delivered.
+func Send(ctx context.Context, client *http.Client, delivery Delivery, now time.Time) Result {
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+
+	if err != nil {
+		return Result{Err: err}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1")
+	req.Header.Set("X-Chirpy-Event", delivery.EventType)
+	req.Header.Set("X-Chirpy-Delivery", delivery.ID)
+	req.Header.Set("X-Chirpy-Timestamp", fmt.Sprint(now.Unix()))
+	req.Header.Set("X-Chirpy-Signature", signature.Header([]string{delivery.Secret}, now, delivery.Payload))
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return Result{Duration: time.Since(start), Err: err}
+	}
+
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	result := Result{StatusCode: res.StatusCode, Duration: time.Since(start)}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		result.Err = fmt.Errorf("the endpoint answered %d", res.StatusCode)
+	}
+
+	return result
+}
+
+// FormatEventTypes and SplitEventTypes convert the space separated form the
+// event types are stored in.
+func FormatEventTypes(eventTypes []string) string {
+	return strings.Join(eventTypes, " ")
+}
+
+func SplitEventTypes(eventTypes string) []string {
+	return strings.Fields(eventTypes)
+}
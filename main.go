@@ -1,636 +1,5925 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/pressly/goose/v3"
 	"github.com/samuelea/chirpy/internal/auth"
+	"github.com/samuelea/chirpy/internal/config"
 	"github.com/samuelea/chirpy/internal/database"
+	"github.com/samuelea/chirpy/internal/entitlements"
+	"github.com/samuelea/chirpy/internal/fixtures"
+	"github.com/samuelea/chirpy/internal/health"
+	"github.com/samuelea/chirpy/internal/mail"
+	"github.com/samuelea/chirpy/internal/metrics"
+	"github.com/samuelea/chirpy/internal/migrations"
+	"github.com/samuelea/chirpy/internal/oauth"
+	"github.com/samuelea/chirpy/internal/oidc"
+	"github.com/samuelea/chirpy/internal/signature"
+	"github.com/samuelea/chirpy/internal/subscription"
+	"github.com/samuelea/chirpy/internal/throttle"
 	"github.com/samuelea/chirpy/internal/utils"
+	"github.com/samuelea/chirpy/internal/webhooks"
 )
 
 var genericErrorMessage string =  "Something went wrong"
 
 type apiConfig struct {
-	fileserverHits 	atomic.Int32
-	jwtSecret				string
+	metrics					*serverMetrics
+	jwtKeys					*auth.KeyRing
+	passwords				*auth.PasswordHasher
+	passwordPolicy	auth.PasswordPolicy
 	polkaApiKey			string
+	polkaVerifier		*signature.Verifier
+	db							*database.Queries
+	mailer					mail.Sender
+	mailFrom				string
+	requireVerifiedEmail	bool
+	trustProxyHeaders			bool
+	oidcProviders					map[string]*oidc.Provider
+	subscriptionGracePeriod	time.Duration
+	tiers										entitlements.Tiers
+	webhookClient						*http.Client
+	webhooksAllowPrivate		bool
+	webhookDisableAfter			int
+	webhookMaxEndpoints			int
+	adminToken							string
+	adminTokenEmail					string
 }
 
-func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
+// clientIP is the address login throttling is keyed on. X-Forwarded-For is
+// only trusted when chirpy runs behind a proxy that sets it.
+func (cfg *apiConfig) clientIP(r *http.Request) string {
+	if cfg.trustProxyHeaders {
+		forwarded := r.Header.Get("X-Forwarded-For")
+		if forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// serverMetrics are exposed at GET /metrics.
+type serverMetrics struct {
+	registry				*metrics.Registry
+	requests				*metrics.Counter
+	requestDuration	*metrics.Histogram
+	inFlight				*metrics.Gauge
+	queryDuration		*metrics.Histogram
+	queryErrors			*metrics.Counter
+	chirpsCreated		*metrics.Counter
+	logins					*metrics.Counter
+	loginFailures		*metrics.Counter
+	webhookAttempts	*metrics.Counter
+	// visitsBaseline is the request count at the last POST /admin/reset
+	visitsBaseline	atomic.Int64
+}
+
+func newServerMetrics() *serverMetrics {
+	registry := metrics.NewRegistry()
+
+	m := &serverMetrics{
+		registry: registry,
+		requests: registry.NewCounter("chirpy_http_requests_total", "HTTP requests by route and status code.", "route", "code"),
+		requestDuration: registry.NewHistogram("chirpy_http_request_duration_seconds", "HTTP request latency by route.", metrics.DefaultBuckets, "route"),
+		inFlight: registry.NewGauge("chirpy_http_requests_in_flight", "HTTP requests being served."),
+		queryDuration: registry.NewHistogram("chirpy_db_query_duration_seconds", "Database query latency by query.", metrics.DefaultBuckets, "query"),
+		queryErrors: registry.NewCounter("chirpy_db_query_errors_total", "Failed database queries by query.", "query"),
+		chirpsCreated: registry.NewCounter("chirpy_chirps_created_total", "Chirps posted, immediately or from a schedule.", "kind"),
+		logins: registry.NewCounter("chirpy_logins_total", "Sessions issued by successful logins."),
+		loginFailures: registry.NewCounter("chirpy_login_failures_total", "Failed logins by reason.", "reason"),
+		webhookAttempts: registry.NewCounter("chirpy_webhook_delivery_attempts_total", "Outgoing webhook delivery attempts by result.", "result"),
+	}
+
+	registry.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+
+	return m
+}
+
+// observeQuery is the database.Observer for every query chirpy makes
+func (m *serverMetrics) observeQuery(query string, duration time.Duration, err error) {
+	m.queryDuration.Observe(duration.Seconds(), query)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		m.queryErrors.Inc(query)
+	}
+}
+
+// visits is the number of requests since the last reset, shown on the
+// admin page
+func (m *serverMetrics) visits() int64 {
+	return int64(m.requests.Sum()) - m.visitsBaseline.Load()
+}
+
+// statusRecorder remembers the status code a handler answered with and how
+// many bytes of body it wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status	int
+	bytes		int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// middleware records every request under the route pattern that served it.
+// The mux sets r.Pattern, so it wraps the whole mux; requests no route
+// matched share one label to keep the number of series bounded.
+func (m *serverMetrics) middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits.Add(1)
-		next.ServeHTTP(w, r)
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		next.ServeHTTP(recorder, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		m.requests.Inc(route, strconv.Itoa(recorder.status))
+		m.requestDuration.Observe(time.Since(start).Seconds(), route)
 	})
 }
 
-var prohibitedWords = []string{"kerfuffle", "sharbert", "fornax"}
+type contextKey string
 
-func main() {
-	godotenv.Load()
+const principalContextKey contextKey = "principal"
+const requestLogContextKey contextKey = "requestLog"
 
-	var apiCfg = apiConfig{
-		fileserverHits: atomic.Int32{},
-		jwtSecret: os.Getenv("JWT_SECRET"),
-		polkaApiKey: os.Getenv("POLKA_API_KEY"),
+const requestIDHeader = "X-Request-ID"
+
+// requestLog is what the access log reports about a request beyond what the
+// middleware sees itself. Handlers fill it in through the request context.
+type requestLog struct {
+	id			string
+	userID	uuid.NullUUID
+}
+
+func getRequestLog(ctx context.Context) *requestLog {
+	entry, _ := ctx.Value(requestLogContextKey).(*requestLog)
+	return entry
+}
+
+// requestID keeps the client's X-Request-ID when it is short and printable,
+// so requests can be traced through proxies, and makes one up otherwise.
+func requestID(header string) string {
+	if header == "" || len(header) > 128 {
+		return uuid.NewString()
 	}
 
-	db, err := sql.Open("postgres", os.Getenv("DB_URL"))
-	
-	if err != nil {
-		log.Fatal(err)
+	for _, c := range header {
+		if c < '!' || c > '~' {
+			return uuid.NewString()
+		}
 	}
 
-	defer db.Close()
+	return header
+}
 
-	dbQueries := database.New(db)
+// contextLogHandler adds the request ID to records logged with a request's
+// context, so errors can be matched with their access log line.
+type contextLogHandler struct {
+	slog.Handler
+}
 
-	serveMux := http.NewServeMux()
+func (h contextLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if entry := getRequestLog(ctx); entry != nil {
+		record.AddAttrs(slog.String("request_id", entry.id))
+	}
 
-	assetsHandler := http.StripPrefix("/app/assets", http.FileServer(http.Dir("assets")))
-	serveMux.Handle("/app/assets/", apiCfg.middlewareMetricsInc(assetsHandler))
+	return h.Handler.Handle(ctx, record)
+}
 
-	rootHandler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
-	serveMux.Handle("/app", apiCfg.middlewareMetricsInc(rootHandler))
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{h.Handler.WithAttrs(attrs)}
+}
 
-	healthHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(200)
-		w.Write([]byte("OK"))
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{h.Handler.WithGroup(name)}
+}
+
+// newLogger writes JSON lines to stdout.
+func newLogger(level slog.Level) *slog.Logger {
+	return slog.New(contextLogHandler{slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})})
+}
+
+// middlewareLogging writes one access log line per request. Like the metrics
+// middleware it wraps the whole mux, and reads the route pattern the mux set
+// on the request.
+func middlewareLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &requestLog{id: requestID(r.Header.Get(requestIDHeader))}
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		w.Header().Set(requestIDHeader, entry.id)
+
+		r = r.WithContext(context.WithValue(r.Context(), requestLogContextKey, entry))
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", r.Pattern),
+			slog.Int("status", recorder.status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", recorder.bytes),
+		}
+
+		if entry.userID.Valid {
+			attrs = append(attrs, slog.String("user_id", entry.userID.UUID.String()))
+		}
+
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
 	})
-	serveMux.Handle("GET /api/healthz", apiCfg.middlewareMetricsInc(healthHandler))
-	
-	createChirp := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
-		token, err := auth.GetBearerToken(&r.Header)
+}
+
+// logRequestError logs the error behind a failed request with its request ID.
+func logRequestError(r *http.Request, err error) {
+	slog.ErrorContext(r.Context(), "request failed", "method", r.Method, "route", r.Pattern, "error", err)
+}
+
+// respondWithInternalError logs err and answers 500 without exposing it.
+func respondWithInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	logRequestError(r, err)
+	utils.RespondWithError(w, 500, genericErrorMessage)
+}
+
+// middlewareMaxBodySize makes reading more than limit bytes of a request body
+// fail, so handlers decoding JSON answer 400 instead of buffering it all.
+func middlewareMaxBodySize(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middlewareRequireRole only lets users holding role, or a role above it,
+// through. Roles need a full session: API keys and tokens issued to OAuth
+// clients are refused, and the role is read from the database so demoting a
+// user takes effect at once. The admin token, when configured, acts as the
+// account it is assigned to, so automation goes through the same role check
+// and shows up as that account.
+func (cfg *apiConfig) middlewareRequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearerToken, err := auth.GetBearerToken(&r.Header)
 
 		if err != nil {
 			utils.RespondWithError(w, 401, err.Error())
 			return
 		}
 
-		authenticatedUserId, err := auth.ValidateJWT(token, apiCfg.jwtSecret)
+		serveAs := func(user database.User, viaAdminToken bool) {
+			if entry := getRequestLog(r.Context()); entry != nil {
+				entry.userID = uuid.NullUUID{UUID: user.ID, Valid: true}
+			}
 
-		if err != nil {
-			utils.RespondWithJSon(w, 401, err.Error())
-			return
-		}
+			if !auth.HasRole(user.Role, role) {
+				utils.RespondWithError(w, 403, fmt.Sprintf("Requires the %s role", role))
+				return
+			}
 
-		type successResponse struct {
-			Id				uuid.UUID	`json:"id"`
-			UserId		uuid.UUID	`json:"user_id"`
-			CreatedAt time.Time `json:"created_at"`
-			UpdatedAt time.Time `json:"updated_at"`
-			Body			string		`json:"body"`
+			ctx := context.WithValue(r.Context(), principalContextKey, principal{
+				UserID: user.ID,
+				Scopes: auth.AllScopes,
+				AdminToken: viaAdminToken,
+			})
+
+			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 
-		type reqBody struct {
-			Body 		string `json:"body"`
-		} 
+		if cfg.adminToken != "" && subtle.ConstantTimeCompare([]byte(bearerToken), []byte(cfg.adminToken)) == 1 {
+			user, err := cfg.db.GetUser(r.Context(), cfg.adminTokenEmail)
 
-		var decodedRedBody reqBody
+			if errors.Is(err, sql.ErrNoRows) {
+				utils.RespondWithError(w, 401, "The admin token's account doesn't exist")
+				return
+			}
 
-		decoder := json.NewDecoder(r.Body)
-		
-		err = decoder.Decode(&decodedRedBody)
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+
+			serveAs(user, true)
+			return
+		}
+
+		if auth.IsAPIKey(bearerToken) {
+			utils.RespondWithError(w, 403, "API keys can't be used for admin endpoints")
+			return
+		}
+
+		claims, err := cfg.jwtKeys.ParseJWT(bearerToken)
 
 		if err != nil {
-			utils.RespondWithError(w, 500, genericErrorMessage)
+			utils.RespondWithError(w, 401, err.Error())
+			return
+		}
+
+		if claims.Scope != "" {
+			utils.RespondWithError(w, 403, "Admin endpoints require a full session")
 			return
 		}
 
-		isValid := len(decodedRedBody.Body) <= 140
+		userID, err := uuid.Parse(claims.Subject)
 
-		if !isValid {
-			utils.RespondWithError(w, 400, "Chirp is too long")
+		if err != nil {
+			utils.RespondWithError(w, 401, err.Error())
 			return
-		}		
+		}
 
-		cleanMsg := utils.GetCorrectedString(decodedRedBody.Body, prohibitedWords)
+		user, err := cfg.db.GetUserByID(r.Context(), userID)
 
-		chirp, err := dbQueries.CreateChirp(r.Context(), database.CreateChirpParams{
-			UserID: authenticatedUserId,
-			Body: cleanMsg.CorrectedMsg,
-		})
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.RespondWithError(w, 401, "Unauthorized")
+			return
+		}
 
 		if err != nil {
-			utils.RespondWithError(w, 500, genericErrorMessage)
+			respondWithInternalError(w, r, err)
+			return
 		}
 
-		utils.RespondWithJSon(w, 201, successResponse{
-			Id: chirp.ID,
-			UserId: chirp.UserID,
-			CreatedAt: chirp.CreatedAt,
-			UpdatedAt: chirp.UpdatedAt,
-			Body: chirp.Body,
-		})
+		if issuedBefore(claims, user.TokensValidAfter) {
+			utils.RespondWithError(w, 401, "Token has been revoked")
+			return
+		}
+
+		serveAs(user, false)
 	})
+}
 
-	serveMux.Handle("POST /api/chirps", apiCfg.middlewareMetricsInc(createChirp))
+// runPeriodically runs job every interval until stop is closed. Runs get ctx,
+// which is only cancelled when they are taking too long to finish on
+// shutdown; wg tracks the goroutine so shutdown can wait for it. The returned
+// status is what readiness checks the job with.
+func runPeriodically(stop <-chan struct{}, ctx context.Context, wg *sync.WaitGroup, name string, interval time.Duration, job func(context.Context) error) *health.Job {
+	status := health.NewJob(interval)
 
-	metricsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html" )
-		w.WriteHeader(200)
-		w.Write([]byte(fmt.Sprintf(
-`
-		<html>
-  		<body>
-    		<h1>Welcome, Chirpy Admin</h1>
-   			<p>Chirpy has been visited %d times!</p>
- 			</body>
-		</html>
-`, apiCfg.fileserverHits.Load())))
-	})
-	serveMux.Handle("GET /admin/metrics", metricsHandler)
+	wg.Add(1)
 
-	resetHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		environment := os.Getenv("PLATFORM")
-		
-		if environment == "dev" {
-			err := dbQueries.ClearUsers(r.Context())
-			if err != nil {
-				utils.RespondWithError(w, 500, "Failed to reset users")
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				status.Started()
+				err := job(ctx)
+				status.Finished(err)
+
+				if err != nil {
+					slog.Error("background job failed", "job", name, "error", err)
+				}
 			}
 		}
+	}()
 
-		apiCfg.fileserverHits.Store(0)
-		w.WriteHeader(200)
-	})
+	return status
+}
 
+// openDatabase opens the connection pool of the database the URL's scheme
+// selects; it doesn't connect yet.
+func openDatabase(settings config.Database) (*sql.DB, database.Dialect, error) {
+	db, dialect, err := database.Open(settings.URL)
 
-	createUser := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		type Input struct {
-			Email 		string `json:"email"`
-			Password 	string `json:"password"`
-		}	
+	if err != nil {
+		return nil, dialect, err
+	}
 
-		decoder := json.NewDecoder(r.Body)
+	db.SetMaxOpenConns(settings.MaxOpenConns)
+	db.SetMaxIdleConns(settings.MaxIdleConns)
+	db.SetConnMaxLifetime(settings.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(settings.ConnMaxIdleTime)
 
-		var decodedInput Input
+	return db, dialect, nil
+}
 
-		err := decoder.Decode(&decodedInput)
+// runMigrateCommand runs "chirpy migrate up|down|status|redo" and prints
+// what it did to out.
+func runMigrateCommand(ctx context.Context, migrator *migrations.Migrator, command string, out io.Writer) error {
+	var results []*goose.MigrationResult
+	var err error
+
+	switch command {
+	case "up":
+		results, err = migrator.Up(ctx)
+	case "down":
+		results, err = migrator.Down(ctx)
+	case "redo":
+		results, err = migrator.Redo(ctx)
+	case "status":
+		statuses, err := migrator.Status(ctx)
 
 		if err != nil {
-			utils.RespondWithError(w, 400, "Wrong input data")
-			return
+			return err
 		}
 
-		hashedPassword, err := auth.HashPassword(decodedInput.Password)
-		
+		fmt.Fprintf(out, "%-24s %s\n", "Applied At", "Migration")
+
+		for _, status := range statuses {
+			appliedAt := "Pending"
+
+			if status.State == goose.StateApplied {
+				appliedAt = status.AppliedAt.UTC().Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(out, "%-24s %s\n", appliedAt, status.Source.Path)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down, status or redo", command)
+	}
+
+	for _, result := range results {
+		fmt.Fprintln(out, result)
+	}
+
+	if err == nil && len(results) == 0 {
+		fmt.Fprintln(out, "no migrations to run")
+	}
+
+	return err
+}
+
+// runCreateAdmin makes the account with email an admin, creating it with the
+// password on the first line of in when there is none. It only bootstraps
+// the first admin and refuses once there is one.
+func runCreateAdmin(ctx context.Context, db *database.Queries, passwords *auth.PasswordHasher, policy auth.PasswordPolicy, email string, in io.Reader, out io.Writer) error {
+	err := utils.ValidateEmail(email)
+
+	if err != nil {
+		return err
+	}
+
+	admins, err := db.CountUsersWithRole(ctx, auth.RoleAdmin)
+
+	if err != nil {
+		return err
+	}
+
+	if admins > 0 {
+		return errors.New("an admin already exists")
+	}
+
+	user, err := db.GetUser(ctx, email)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		password, _ := bufio.NewReader(in).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+
+		if password == "" {
+			return fmt.Errorf("%s has no account, pass its password on stdin to create one", email)
+		}
+
+		violations, err := policy.Check(password, email)
+
 		if err != nil {
-			utils.RespondWithError(w, 500, genericErrorMessage)
-			return
+			return err
 		}
 
-		user, err := dbQueries.CreateUser(r.Context(), database.CreateUserParams{
-			Email: decodedInput.Email,
+		for _, violation := range violations {
+			err = errors.Join(err, errors.New(violation.Message))
+		}
+
+		if err != nil {
+			return fmt.Errorf("password does not meet the password policy:\n%w", err)
+		}
+
+		hashedPassword, err := passwords.Hash(password)
+
+		if err != nil {
+			return err
+		}
+
+		user, err = db.CreateUser(ctx, database.CreateUserParams{
+			Email: email,
 			HashedPassword: hashedPassword,
 		})
 
 		if err != nil {
-			utils.RespondWithError(w, 500, "a user with that email already exists")
-			return
+			return err
 		}
 
-		type CreateUserResponse struct {
-			ID 					uuid.UUID `json:"id"`
-			CreatedAt 	time.Time `json:"created_at"`
-			UpdatedAt		time.Time	`json:"updated_at"`
-			Email				string		`json:"email"`
-			IsChirpyRed	bool			`json:"is_chirpy_red"`
+		// Whoever runs the command vouches for the address
+		_, err = db.MarkEmailVerified(ctx, database.MarkEmailVerifiedParams{ID: user.ID, Email: email})
+
+		if err != nil {
+			return err
 		}
 
-		utils.RespondWithJSon(w, 201, CreateUserResponse{
-			ID: user.ID,
-			CreatedAt: user.CreatedAt,
-			UpdatedAt: user.UpdatedAt,
-			Email: user.Email,
-			IsChirpyRed: user.IsChirpyRed,	
-		})
-	})
+		fmt.Fprintf(out, "created %s\n", email)
+	} else if err != nil {
+		return err
+	}
 
-	serveMux.Handle("POST /api/users", apiCfg.middlewareMetricsInc(createUser))
+	_, err = db.SetUserRole(ctx, database.SetUserRoleParams{Role: auth.RoleAdmin, ID: user.ID})
 
-	updateUser := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		type Input struct {
-			Email 		string `json:"email"`
-			Password 	string `json:"password"`
-		}	
+	if err != nil {
+		return err
+	}
 
-		decoder := json.NewDecoder(r.Body)
+	fmt.Fprintf(out, "%s is now an admin\n", email)
+
+	return nil
+}
+
+// principal is the caller authenticated by middlewareAuthenticate, either
+// through an access token or a personal API key, or by middlewareRequireRole.
+type principal struct {
+	UserID		uuid.UUID
+	Scopes		[]string
+	APIKeyID	uuid.NullUUID
+	// AdminToken is set when the admin token was used instead of a session
+	AdminToken	bool
+}
+
+func getPrincipal(r *http.Request) principal {
+	caller, _ := r.Context().Value(principalContextKey).(principal)
+	return caller
+}
+
+// middlewareAuthenticate rejects requests whose bearer token is invalid or
+// was not granted scope, and stores the caller in the request context.
+func (cfg *apiConfig) middlewareAuthenticate(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearerToken, err := auth.GetBearerToken(&r.Header)
+
+		if err != nil {
+			utils.RespondWithError(w, 401, err.Error())
+			return
+		}
+
+		caller, err := cfg.authenticate(r.Context(), bearerToken)
+
+		if err != nil {
+			utils.RespondWithError(w, 401, err.Error())
+			return
+		}
+
+		if !auth.HasScope(caller.Scopes, scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			utils.RespondWithError(w, 403, fmt.Sprintf("Missing required scope %s", scope))
+			return
+		}
+
+		if entry := getRequestLog(r.Context()); entry != nil {
+			entry.userID = uuid.NullUUID{UUID: caller.UserID, Valid: true}
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey, caller)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (cfg *apiConfig) authenticate(ctx context.Context, bearerToken string) (principal, error) {
+	if auth.IsAPIKey(bearerToken) {
+		key, err := cfg.db.GetApiKeyByHash(ctx, auth.HashToken(bearerToken))
+
+		if err != nil {
+			return principal{}, errors.New("invalid API key")
+		}
+
+		isExpired := key.ExpiresAt.Valid && time.Now().After(key.ExpiresAt.Time)
+
+		if key.RevokedAt.Valid || isExpired {
+			return principal{}, errors.New("invalid API key")
+		}
+
+		// Only tracks last use, so a failure doesn't reject the request
+		err = cfg.db.TouchApiKey(ctx, key.ID)
+
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to record API key use", "api_key_id", key.ID, "error", err)
+		}
+
+		return principal{
+			UserID: key.UserID,
+			Scopes: strings.Fields(key.Scopes),
+			APIKeyID: uuid.NullUUID{UUID: key.ID, Valid: true},
+		}, nil
+	}
+
+	claims, err := cfg.jwtKeys.ParseJWT(bearerToken)
+
+	if err != nil {
+		return principal{}, err
+	}
+
+	userID, err := uuid.Parse(claims.Subject)
+
+	if err != nil {
+		return principal{}, err
+	}
+
+	tokensValidAfter, err := cfg.db.GetUserTokensValidAfter(ctx, userID)
+
+	if err != nil {
+		return principal{}, errors.New("invalid token")
+	}
+
+	if issuedBefore(claims, tokensValidAfter) {
+		return principal{}, errors.New("token has been revoked")
+	}
+
+	scopes := auth.AllScopes
+	if claims.Scope != "" {
+		scopes = strings.Fields(claims.Scope)
+	}
+
+	return principal{UserID: userID, Scopes: scopes}, nil
+}
+
+// issuedBefore reports whether a JWT predates cutoff, the last time the
+// user's access tokens were revoked. iat only has second precision, so tokens
+// from the cutoff's own second are let through: rejecting them would also
+// reject a login made right after a password reset.
+func issuedBefore(claims *auth.Claims, cutoff sql.NullTime) bool {
+	if !cutoff.Valid {
+		return false
+	}
+
+	if claims.IssuedAt == nil {
+		return true
+	}
+
+	return claims.IssuedAt.Time.Before(cutoff.Time.Truncate(time.Second))
+}
+
+// redirectOauthError sends the user back to the client with an RFC 6749
+// section 4.1.2.1 error.
+func redirectOauthError(w http.ResponseWriter, r *http.Request, redirectUri, state, code, description string) {
+	http.Redirect(w, r, oauth.RedirectURL(redirectUri, url.Values{
+		"error": {code},
+		"error_description": {description},
+		"state": {state},
+	}), http.StatusSeeOther)
+}
+
+// Statuses of stored webhook events
+const (
+	webhookStatusProcessed = "processed"
+	webhookStatusIgnored = "ignored"
+	webhookStatusFailed = "failed"
+)
+
+// Statuses of outgoing webhook deliveries
+const (
+	webhookDeliveryPending = "pending"
+	webhookDeliveryDelivered = "delivered"
+	webhookDeliveryFailed = "failed"
+)
+
+var errInvalidCredentials = errors.New("Invalid email or password")
+
+var errOidcEmailNotVerified = errors.New("The identity provider did not share a verified email address")
+
+var errOidcAccountExists = errors.New("An account with this email address already exists, sign in to it and link this identity from POST /api/users/identities/{provider}")
+
+var errOidcIdentityTaken = errors.New("This identity is already linked to another account")
+
+type loginThrottledError struct {
+	retryAfter	time.Duration
+}
+
+func (e *loginThrottledError) Error() string {
+	return "too many failed login attempts"
+}
+
+// revokeCredentials signs a user out everywhere: refresh tokens and API keys
+// are revoked, and access tokens issued until now are rejected.
+func revokeCredentials(ctx context.Context, q *database.Queries, userID uuid.UUID) error {
+	err := q.RevokeAllUserTokens(ctx, userID)
+
+	if err != nil {
+		return err
+	}
+
+	err = q.SetTokensValidAfter(ctx, database.SetTokensValidAfterParams{
+		TokensValidAfter: sql.NullTime{Time: time.Now(), Valid: true},
+		ID: userID,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return q.RevokeAllUserApiKeys(ctx, userID)
+}
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// planEntitlements turns the configured limits of a plan into entitlements.
+func planEntitlements(plan config.Plan) entitlements.Entitlements {
+	return entitlements.Entitlements{
+		MaxChirpLength: plan.MaxChirpLength,
+		EditWindow: plan.ChirpEditWindow,
+		MaxScheduledChirps: plan.MaxScheduledChirps,
+		ChirpsPerHour: plan.ChirpsPerHour,
+	}
+}
+
+func subscriptionState(s database.Subscription) subscription.State {
+	return subscription.State{
+		Status: s.Status,
+		PeriodEnd: s.CurrentPeriodEnd.Time,
+		GraceEnd: s.GracePeriodEnd.Time,
+		CancelledAt: s.CancelledAt.Time,
+	}
+}
+
+// loadOidcProviders creates the configured OIDC providers, keyed by name.
+func loadOidcProviders(configs []config.OIDCProvider) (map[string]*oidc.Provider, error) {
+	providers := map[string]*oidc.Provider{}
+
+	for _, c := range configs {
+		provider, err := oidc.NewProvider(oidc.Config{
+			Name: c.Name,
+			Issuer: c.Issuer,
+			ClientID: c.ClientID,
+			ClientSecret: c.ClientSecret,
+			RedirectURL: c.RedirectURL,
+			Scopes: c.Scopes,
+		}, nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("OIDC provider %s: %w", c.Name, err)
+		}
+
+		providers[c.Name] = provider
+	}
+
+	return providers, nil
+}
+
+var prohibitedWords = []string{"kerfuffle", "sharbert", "fornax"}
+
+func main() {
+	configPath := flag.String("config", "", "YAML configuration `file`, CONFIG_FILE by default; the environment overrides it")
+	printConfig := flag.Bool("print-config", false, "print the configuration with secrets redacted and exit")
+	flag.Parse()
+
+	settings, err := config.Load(*configPath)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *printConfig {
+		out, err := settings.Redacted().YAML()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		os.Stdout.Write(out)
+
+		err = settings.Validate()
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if settings.Database.URL == "" {
+			log.Fatal("DB_URL is required")
+		}
+
+		db, dialect, err := openDatabase(settings.Database)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer db.Close()
+
+		migrator, err := migrations.New(db, dialect)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = runMigrateCommand(context.Background(), migrator, flag.Arg(1), os.Stdout)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if flag.NArg() > 0 && flag.Arg(0) != "create-admin" {
+		log.Fatalf("unknown command %q, expected migrate or create-admin", flag.Arg(0))
+	}
+
+	err = settings.Validate()
+
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+
+	slog.SetDefault(newLogger(settings.LogLevel))
+
+	jwtKeys, err := auth.LoadKeyRing(settings.JWT.KeysDir, settings.JWT.ActiveKeyID, settings.JWT.Secret)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwords, err := auth.NewPasswordHasher(settings.Passwords.Argon2Params())
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwordPolicy := auth.PasswordPolicy{
+		MinLength: settings.Passwords.MinLength,
+		MaxLength: settings.Passwords.MaxLength,
+		RequireLower: settings.Passwords.RequireLower,
+		RequireUpper: settings.Passwords.RequireUpper,
+		RequireDigit: settings.Passwords.RequireDigit,
+		RequireSymbol: settings.Passwords.RequireSymbol,
+		DisallowEmail: !settings.Passwords.AllowEmail,
+		Breached: auth.BundledBreachedPasswords(),
+	}
+
+	switch breachedPath := settings.Passwords.BreachedPasswordsPath; breachedPath {
+	case "":
+	case "off":
+		passwordPolicy.Breached = nil
+	default:
+		passwordPolicy.Breached, err = auth.LoadBreachedPasswords(breachedPath)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var apiCfg = apiConfig{
+		metrics: newServerMetrics(),
+		jwtKeys: jwtKeys,
+		passwords: passwords,
+		passwordPolicy: passwordPolicy,
+		polkaApiKey: settings.Polka.APIKey,
+		adminToken: settings.Admin.Token,
+		adminTokenEmail: settings.Admin.TokenEmail,
+		mailer: mail.LogSender{},
+		mailFrom: settings.Mail.From,
+		requireVerifiedEmail: settings.Mail.RequireVerifiedEmail,
+		trustProxyHeaders: settings.Server.TrustProxyHeaders,
+		subscriptionGracePeriod: settings.Subscriptions.GracePeriod,
+		tiers: entitlements.Tiers{
+			Free: planEntitlements(settings.Plans.Free),
+			Red: planEntitlements(settings.Plans.Red),
+		},
+	}
+
+	apiCfg.webhooksAllowPrivate = settings.Webhooks.AllowPrivate
+	apiCfg.webhookClient = webhooks.NewClient(10 * time.Second, apiCfg.webhooksAllowPrivate)
+	apiCfg.webhookDisableAfter = settings.Webhooks.DisableAfter
+	apiCfg.webhookMaxEndpoints = settings.Webhooks.MaxEndpoints
+
+	if len(settings.Polka.WebhookSecrets) > 0 {
+		apiCfg.polkaVerifier, err = signature.NewVerifier(settings.Polka.WebhookSecrets, settings.Polka.WebhookTolerance)
+
+		if err != nil {
+			log.Fatalf("invalid POLKA_WEBHOOK_SECRETS: %v", err)
+		}
+	}
+
+	apiCfg.oidcProviders, err = loadOidcProviders(settings.OIDC)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if settings.Mail.OutboxDir != "" {
+		apiCfg.mailer = mail.OutboxSender{Dir: settings.Mail.OutboxDir}
+	}
+
+	// Set when the server fails. Deferred first so the process only exits
+	// after the rest of the cleanup has run.
+	exitCode := 0
+
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	db, dialect, err := openDatabase(settings.Database)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer db.Close()
+
+	migrator, err := migrations.New(db, dialect)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if settings.Database.AutoMigrate {
+		// Other instances wait on the advisory lock, then find nothing to do
+		results, err := migrator.Up(context.Background())
+
+		for _, result := range results {
+			slog.Info("applied migration", "migration", result.Source.Path, "direction", result.Direction, "duration", result.Duration)
+		}
+
+		if err != nil {
+			log.Fatalf("migrating the database: %v", err)
+		}
+	}
+
+	err = migrator.Check(context.Background())
+
+	if errors.Is(err, migrations.ErrSchemaAhead) {
+		log.Fatalf("refusing to start: %v", err)
+	}
+
+	if err != nil {
+		slog.Warn("database schema not up to date", "error", err)
+	}
+
+	var dbtx database.DBTX = db
+
+	if dialect == database.SQLite {
+		dbtx = database.ForSQLite(db)
+	}
+
+	dbtx = database.Observe(dbtx, apiCfg.metrics.observeQuery)
+	dbQueries := database.New(dbtx)
+
+	if flag.Arg(0) == "create-admin" {
+		err = runCreateAdmin(context.Background(), dbQueries, passwords, passwordPolicy, flag.Arg(1), os.Stdin, os.Stdout)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	apiCfg.metrics.registry.NewGaugeFunc("chirpy_db_open_connections", "Open database connections.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+
+	apiCfg.metrics.registry.NewGaugeFunc("chirpy_db_in_use_connections", "Database connections in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	apiCfg.db = dbQueries
+
+	serveMux := http.NewServeMux()
+
+	assetsHandler := http.StripPrefix("/app/assets", http.FileServer(http.Dir("assets")))
+	serveMux.Handle("/app/assets/", assetsHandler)
+
+	rootHandler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
+	serveMux.Handle("/app", rootHandler)
+
+	healthHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	})
+
+	jwksHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		utils.RespondWithJSon(w, 200, apiCfg.jwtKeys.JWKS())
+	})
+	serveMux.Handle("GET /.well-known/jwks.json", jwksHandler)
+	
+	// entitlementsOf is where every feature limit is looked up, so plans are
+	// only ever compared in one place
+	entitlementsOf := func(user database.User) entitlements.Entitlements {
+		return apiCfg.tiers.For(user.IsChirpyRed)
+	}
+
+	entitlementsFor := func(ctx context.Context, userID uuid.UUID) (database.User, entitlements.Entitlements, error) {
+		user, err := dbQueries.GetUserByID(ctx, userID)
+
+		if err != nil {
+			return user, entitlements.Entitlements{}, err
+		}
+
+		return user, entitlementsOf(user), nil
+	}
+
+	type chirpEventData struct {
+		Id				uuid.UUID	`json:"id"`
+		UserId		uuid.UUID	`json:"user_id"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+		Body			string		`json:"body"`
+	}
+
+	toChirpEventData := func(chirp database.Chirp) chirpEventData {
+		return chirpEventData{
+			Id: chirp.ID,
+			UserId: chirp.UserID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+			Body: chirp.Body,
+		}
+	}
+
+	// enqueueWebhookEvent adds an event about a change to ownerID's data to
+	// the outbox. q should be bound to the transaction making the change so
+	// the event is recorded if and only if the change is. The dispatcher
+	// queues it for the owner's endpoints later.
+	enqueueWebhookEvent := func(ctx context.Context, q *database.Queries, ownerID uuid.UUID, eventType string, data any) error {
+		type event struct {
+			Id				uuid.UUID	`json:"id"`
+			Type			string		`json:"type"`
+			CreatedAt	time.Time	`json:"created_at"`
+			Data			any				`json:"data"`
+		}
+
+		eventID := uuid.New()
+
+		payload, err := json.Marshal(event{
+			Id: eventID,
+			Type: eventType,
+			CreatedAt: time.Now().UTC(),
+			Data: data,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return q.CreateWebhookOutboxEvent(ctx, database.CreateWebhookOutboxEventParams{
+			ID: eventID,
+			UserID: ownerID,
+			EventType: eventType,
+			Payload: string(payload),
+		})
+	}
+
+	// createChirpWithEvent posts a chirp and records its chirp.created event
+	// together
+	createChirpWithEvent := func(ctx context.Context, params database.CreateChirpParams) (database.Chirp, error) {
+		tx, err := db.BeginTx(ctx, nil)
+
+		if err != nil {
+			return database.Chirp{}, err
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		chirp, err := txQueries.CreateChirp(ctx, params)
+
+		if err != nil {
+			return chirp, err
+		}
+
+		err = enqueueWebhookEvent(ctx, txQueries, chirp.UserID, webhooks.EventChirpCreated, toChirpEventData(chirp))
+
+		if err != nil {
+			return chirp, err
+		}
+
+		err = tx.Commit()
+
+		if err == nil {
+			apiCfg.metrics.chirpsCreated.Inc("immediate")
+		}
+
+		return chirp, err
+	}
+
+	type scheduledChirpResponse struct {
+		Id				uuid.UUID	`json:"id"`
+		UserId		uuid.UUID	`json:"user_id"`
+		CreatedAt	time.Time	`json:"created_at"`
+		PublishAt	time.Time	`json:"publish_at"`
+		Body			string		`json:"body"`
+		Error			string		`json:"error,omitempty"`
+	}
+
+	toScheduledChirpResponse := func(chirp database.ScheduledChirp) scheduledChirpResponse {
+		return scheduledChirpResponse{
+			Id: chirp.ID,
+			UserId: chirp.UserID,
+			CreatedAt: chirp.CreatedAt,
+			PublishAt: chirp.PublishAt,
+			Body: chirp.Body,
+			Error: chirp.Error.String,
+		}
+	}
+
+	createChirp := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		authenticatedUserId := getPrincipal(r).UserID
+
+		user, userEntitlements, err := entitlementsFor(r.Context(), authenticatedUserId)
+
+		if err != nil {
+			utils.RespondWithError(w, 401, "user not found")
+			return
+		}
+
+		if apiCfg.requireVerifiedEmail && !user.EmailVerifiedAt.Valid {
+			utils.RespondWithError(w, 403, "Verify your email address before chirping")
+			return
+		}
+
+		type successResponse struct {
+			Id				uuid.UUID	`json:"id"`
+			UserId		uuid.UUID	`json:"user_id"`
+			CreatedAt time.Time `json:"created_at"`
+			UpdatedAt time.Time `json:"updated_at"`
+			Body			string		`json:"body"`
+		}
+
+		type reqBody struct {
+			Body 			string 			`json:"body"`
+			PublishAt	*time.Time	`json:"publish_at"`
+		} 
+
+		var decodedRedBody reqBody
+
+		decoder := json.NewDecoder(r.Body)
+		
+		err = decoder.Decode(&decodedRedBody)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, genericErrorMessage)
+			return
+		}
+
+		err = userEntitlements.CheckChirpLength(decodedRedBody.Body)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}		
+
+		recentChirps, err := dbQueries.CountChirpsByUserSince(r.Context(), database.CountChirpsByUserSinceParams{
+			UserID: authenticatedUserId,
+			Since: time.Now().Add(-time.Hour),
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if !userEntitlements.AllowChirp(recentChirps) {
+			utils.RespondWithError(w, 429, fmt.Sprintf("You can post %d chirps per hour", userEntitlements.ChirpsPerHour))
+			return
+		}
+
+		cleanMsg := utils.GetCorrectedString(decodedRedBody.Body, prohibitedWords)
+
+		if decodedRedBody.PublishAt != nil {
+			if !userEntitlements.CanSchedule() {
+				utils.RespondWithError(w, 403, "Your plan doesn't include scheduled chirps")
+				return
+			}
+
+			if !decodedRedBody.PublishAt.After(time.Now()) {
+				utils.RespondWithError(w, 400, "publish_at must be in the future")
+				return
+			}
+
+			pending, err := dbQueries.CountPendingScheduledChirps(r.Context(), authenticatedUserId)
+
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+
+			if pending >= int64(userEntitlements.MaxScheduledChirps) {
+				utils.RespondWithError(w, 403, fmt.Sprintf("You can have %d scheduled chirps", userEntitlements.MaxScheduledChirps))
+				return
+			}
+
+			scheduled, err := dbQueries.CreateScheduledChirp(r.Context(), database.CreateScheduledChirpParams{
+				UserID: authenticatedUserId,
+				Body: cleanMsg.CorrectedMsg,
+				PublishAt: *decodedRedBody.PublishAt,
+			})
+
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+
+			utils.RespondWithJSon(w, 202, toScheduledChirpResponse(scheduled))
+			return
+		}
+
+		chirp, err := createChirpWithEvent(r.Context(), database.CreateChirpParams{
+			UserID: authenticatedUserId,
+			Body: cleanMsg.CorrectedMsg,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 201, successResponse{
+			Id: chirp.ID,
+			UserId: chirp.UserID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+			Body: chirp.Body,
+		})
+	})
+
+	serveMux.Handle("POST /api/chirps", apiCfg.middlewareAuthenticate(auth.ScopeChirpsWrite, createChirp))
+
+	listScheduledChirps := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chirps, err := dbQueries.ListScheduledChirpsByUser(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := []scheduledChirpResponse{}
+		for _, chirp := range chirps {
+			response = append(response, toScheduledChirpResponse(chirp))
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("GET /api/chirps/scheduled", apiCfg.middlewareAuthenticate(auth.ScopeChirpsRead, listScheduledChirps))
+
+	deleteScheduledChirp := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		deleted, err := dbQueries.DeleteScheduledChirp(r.Context(), database.DeleteScheduledChirpParams{
+			ID: chirpID,
+			UserID: getPrincipal(r).UserID,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if deleted == 0 {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("DELETE /api/chirps/scheduled/{chirpID}", apiCfg.middlewareAuthenticate(auth.ScopeChirpsWrite, deleteScheduledChirp))
+
+	// publishScheduledChirp posts a due chirp if its author's current plan,
+	// which may have changed since it was scheduled, still allows it. The
+	// author stays locked until the transaction ends, so their plan can't
+	// change in between. A chirp over the hourly limit is moved to when the
+	// limit frees up; one breaking another rule is set aside with the reason.
+	// It reports whether the chirp was posted.
+	publishScheduledChirp := func(ctx context.Context, scheduled database.ScheduledChirp) (bool, error) {
+		tx, err := db.BeginTx(ctx, nil)
+
+		if err != nil {
+			return false, err
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		user, err := txQueries.GetUserForUpdate(ctx, scheduled.UserID)
+
+		if err != nil {
+			return false, err
+		}
+
+		userEntitlements := entitlementsOf(user)
+
+		rejection := ""
+
+		if !userEntitlements.CanSchedule() {
+			rejection = "Your plan doesn't include scheduled chirps"
+		} else if err := userEntitlements.CheckChirpLength(scheduled.Body); err != nil {
+			rejection = err.Error()
+		}
+
+		if rejection != "" {
+			err = txQueries.FailScheduledChirp(ctx, database.FailScheduledChirpParams{
+				Error: sql.NullString{String: rejection, Valid: true},
+				ID: scheduled.ID,
+			})
+
+			if err != nil {
+				return false, err
+			}
+
+			return false, tx.Commit()
+		}
+
+		since := time.Now().Add(-time.Hour)
+
+		recentChirps, err := txQueries.CountChirpsByUserSince(ctx, database.CountChirpsByUserSinceParams{
+			UserID: scheduled.UserID,
+			Since: since,
+		})
+
+		if err != nil {
+			return false, err
+		}
+
+		if !userEntitlements.AllowChirp(recentChirps) {
+			oldest, err := txQueries.OldestChirpByUserSince(ctx, database.OldestChirpByUserSinceParams{
+				UserID: scheduled.UserID,
+				Since: since,
+			})
+
+			if err != nil {
+				return false, err
+			}
+
+			err = txQueries.RescheduleScheduledChirp(ctx, database.RescheduleScheduledChirpParams{
+				PublishAt: oldest.Add(time.Hour),
+				ID: scheduled.ID,
+			})
+
+			if err != nil {
+				return false, err
+			}
+
+			return false, tx.Commit()
+		}
+
+		claimed, err := txQueries.ClaimScheduledChirp(ctx, scheduled.ID)
+
+		if err != nil || claimed == 0 {
+			return false, err
+		}
+
+		chirp, err := txQueries.CreateChirp(ctx, database.CreateChirpParams{
+			UserID: scheduled.UserID,
+			Body: scheduled.Body,
+		})
+
+		if err != nil {
+			return false, err
+		}
+
+		err = enqueueWebhookEvent(ctx, txQueries, chirp.UserID, webhooks.EventChirpCreated, toChirpEventData(chirp))
+
+		if err != nil {
+			return false, err
+		}
+
+		err = tx.Commit()
+
+		return err == nil, err
+	}
+
+	// publishScheduledChirps posts the scheduled chirps that are due. Each
+	// one is handled in its own transaction so a chirp that can't be posted
+	// is set aside without holding up the others.
+	publishScheduledChirps := func(ctx context.Context) error {
+		due, err := dbQueries.ListDueScheduledChirps(ctx, 100)
+
+		if err != nil {
+			return err
+		}
+
+		for _, scheduled := range due {
+			published, err := publishScheduledChirp(ctx, scheduled)
+
+			if published {
+				apiCfg.metrics.chirpsCreated.Inc("scheduled")
+			}
+
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to publish scheduled chirp", "chirp_id", scheduled.ID, "error", err)
+
+				err = dbQueries.FailScheduledChirp(ctx, database.FailScheduledChirpParams{
+					Error: sql.NullString{String: "The chirp could not be posted", Valid: true},
+					ID: scheduled.ID,
+				})
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	metricsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html" )
+		w.WriteHeader(200)
+		w.Write([]byte(fmt.Sprintf(
+`
+		<html>
+  		<body>
+    		<h1>Welcome, Chirpy Admin</h1>
+   			<p>Chirpy has been visited %d times!</p>
+ 			</body>
+		</html>
+`, apiCfg.metrics.visits())))
+	})
+	serveMux.Handle("GET /admin/metrics", apiCfg.middlewareRequireRole(auth.RoleAdmin, metricsHandler))
+
+	// Scrapers authenticate with METRICS_TOKEN when it is set
+	metricsToken := settings.Server.MetricsToken
+
+	prometheusHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if metricsToken != "" {
+			token, err := auth.GetBearerToken(&r.Header)
+
+			if err != nil || subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+				utils.RespondWithError(w, 401, "Unauthorized")
+				return
+			}
+		}
+
+		apiCfg.metrics.registry.Handler().ServeHTTP(w, r)
+	})
+
+	serveMux.Handle("GET /metrics", prometheusHandler)
+
+	// Only resets the visit count; tests reseed the database with fixtures
+	resetHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiCfg.metrics.visitsBaseline.Store(int64(apiCfg.metrics.requests.Sum()))
+		w.WriteHeader(200)
+	})
+
+	loadFixture := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !settings.Fixtures.TestMode {
+			utils.RespondWithError(w, 403, "Fixtures can only be loaded with TEST_MODE on")
+			return
+		}
+
+		confirmToken := r.Header.Get("X-Confirm-Token")
+
+		if subtle.ConstantTimeCompare([]byte(confirmToken), []byte(settings.Fixtures.ConfirmToken)) != 1 {
+			utils.RespondWithError(w, 403, "Missing or wrong X-Confirm-Token")
+			return
+		}
+
+		type Input struct {
+			// Tables to reseed, all the fixture's tables when empty
+			Tables	[]string	`json:"tables"`
+		}
+
+		var decodedInput Input
+
+		err := json.NewDecoder(r.Body).Decode(&decodedInput)
+
+		if err != nil && !errors.Is(err, io.EOF) {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		name := r.PathValue("name")
+
+		fixture, err := fixtures.Load(os.DirFS(settings.Fixtures.Dir), name)
+
+		if errors.Is(err, fs.ErrNotExist) {
+			utils.RespondWithError(w, 404, "Fixture not found")
+			return
+		}
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		defer tx.Rollback()
+
+		results, err := fixture.Apply(r.Context(), database.WrapTx(dbtx, tx), decodedInput.Tables, fixtures.Options{
+			HashPassword: apiCfg.passwords.Hash,
+		})
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		slog.WarnContext(r.Context(), "fixture loaded", "fixture", name, "tables", results)
+
+		utils.RespondWithJSon(w, 200, results)
+	})
+
+	// Background work, periodic jobs and emails alike, is tracked by jobs so
+	// shutdown can wait for it, and gets jobsCtx, which is cancelled when it
+	// is still running at the drain deadline
+	jobsCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+
+	var jobs sync.WaitGroup
+
+	// sendEmail sends message in the background so the response doesn't wait
+	// for the mail server
+	sendEmail := func(ctx context.Context, message mail.Message) {
+		jobs.Add(1)
+
+		go func() {
+			defer jobs.Done()
+
+			err := apiCfg.mailer.Send(jobsCtx, message)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to send email", "subject", message.Subject, "error", err)
+			}
+		}()
+	}
+
+	emailVerificationTokenLifetime := settings.Tokens.EmailVerificationTokenLifetime
+
+	// createEmailVerification stores a verification token for email through
+	// q, so it is only kept if the caller's transaction commits, and returns
+	// the email to send afterwards
+	createEmailVerification := func(ctx context.Context, q *database.Queries, userID uuid.UUID, email string) (mail.Message, error) {
+		verificationToken, err := auth.MakeRefreshToken()
+
+		if err != nil {
+			return mail.Message{}, err
+		}
+
+		err = q.CreateEmailVerificationToken(ctx, database.CreateEmailVerificationTokenParams{
+			TokenHash: auth.HashToken(verificationToken),
+			UserID: userID,
+			Email: email,
+			ExpiresAt: time.Now().Add(emailVerificationTokenLifetime),
+		})
+
+		if err != nil {
+			return mail.Message{}, err
+		}
+
+		return mail.Message{
+			From: apiCfg.mailFrom,
+			To: email,
+			Subject: "Verify your Chirpy email address",
+			Body: fmt.Sprintf(
+				"Confirm that %s is your email address by sending this token to POST /api/users/verify:\n\n" +
+				"%s\n\nThe token expires in %s.\n",
+				email, verificationToken, emailVerificationTokenLifetime,
+			),
+		}, nil
+	}
+
+
+	// checkPasswordPolicy answers 400 with every rule password breaks and
+	// returns false when it can't be used
+	checkPasswordPolicy := func(w http.ResponseWriter, r *http.Request, password, email string) bool {
+		type violationsResponse struct {
+			Error				string									`json:"error"`
+			Violations	[]auth.PolicyViolation	`json:"violations"`
+		}
+
+		violations, err := apiCfg.passwordPolicy.Check(password, email)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return false
+		}
+
+		if len(violations) > 0 {
+			utils.RespondWithJSon(w, 400, violationsResponse{
+				Error: "Password does not meet the password policy",
+				Violations: violations,
+			})
+			return false
+		}
+
+		return true
+	}
+
+	createUser := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type Input struct {
+			Email 		string `json:"email"`
+			Password 	string `json:"password"`
+		}	
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedInput Input
+
+		err := decoder.Decode(&decodedInput)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		err = utils.ValidateEmail(decodedInput.Email)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		if !checkPasswordPolicy(w, r, decodedInput.Password, decodedInput.Email) {
+			return
+		}
+
+		hashedPassword, err := apiCfg.passwords.Hash(decodedInput.Password)
+		
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		user, err := txQueries.CreateUser(r.Context(), database.CreateUserParams{
+			Email: decodedInput.Email,
+			HashedPassword: hashedPassword,
+		})
+
+		if err != nil {
+			logRequestError(r, err)
+			utils.RespondWithError(w, 500, "a user with that email already exists")
+			return
+		}
+
+		verificationEmail, err := createEmailVerification(r.Context(), txQueries, user.ID, user.Email)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		sendEmail(r.Context(), verificationEmail)
+
+		type CreateUserResponse struct {
+			ID 						uuid.UUID `json:"id"`
+			CreatedAt 		time.Time `json:"created_at"`
+			UpdatedAt			time.Time	`json:"updated_at"`
+			Email					string		`json:"email"`
+			IsChirpyRed		bool			`json:"is_chirpy_red"`
+			EmailVerified	bool			`json:"email_verified"`
+		}
+
+		utils.RespondWithJSon(w, 201, CreateUserResponse{
+			ID: user.ID,
+			CreatedAt: user.CreatedAt,
+			UpdatedAt: user.UpdatedAt,
+			Email: user.Email,
+			IsChirpyRed: user.IsChirpyRed,	
+			EmailVerified: user.EmailVerifiedAt.Valid,
+		})
+	})
+
+	serveMux.Handle("POST /api/users", createUser)
+
+	updateUser := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type Input struct {
+			Email 		string `json:"email"`
+			Password 	string `json:"password"`
+		}	
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedInput Input
+
+		err := decoder.Decode(&decodedInput)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		userId := getPrincipal(r).UserID
+
+		err = utils.ValidateEmail(decodedInput.Email)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		previousUser, err := dbQueries.GetUserByID(r.Context(), userId)
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "user not found")
+			return
+		}
+
+		if !checkPasswordPolicy(w, r, decodedInput.Password, decodedInput.Email) {
+			return
+		}
+
+		hashedPassword, err := apiCfg.passwords.Hash(decodedInput.Password)
+		
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		user, err := txQueries.UpdateUser(r.Context(), database.UpdateUserParams{
+			ID: userId,
+			Email: decodedInput.Email,
+			HashedPassword: hashedPassword,
+		})
+
+		if err != nil {
+			logRequestError(r, err)
+			utils.RespondWithError(w, 500, "a user with that email already exists")
+			return
+		}
+
+		// UpdateUser clears email_verified_at when the address changes
+		emailChanged := user.Email != previousUser.Email
+
+		var verificationEmail mail.Message
+
+		if emailChanged {
+			verificationEmail, err = createEmailVerification(r.Context(), txQueries, user.ID, user.Email)
+
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if emailChanged {
+			sendEmail(r.Context(), verificationEmail)
+		}
+
+		type UpdateUserResponse struct {
+			Email					string		`json:"email"`
+			EmailVerified	bool			`json:"email_verified"`
+		}
+
+		utils.RespondWithJSon(w, 200, UpdateUserResponse{
+			Email: user.Email,
+			EmailVerified: user.EmailVerifiedAt.Valid,
+		})
+	})
+	serveMux.Handle("PUT /api/users", apiCfg.middlewareAuthenticate(auth.ScopeProfileWrite, updateUser))
+
+	verifyEmail := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			Token	string	`json:"token"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedBody body
+
+		err := decoder.Decode(&decodedBody)
+
+		if err != nil || decodedBody.Token == "" {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		verification, err := txQueries.ConsumeEmailVerificationToken(r.Context(), auth.HashToken(decodedBody.Token))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "Invalid or expired verification token")
+			return
+		}
+
+		// Fails if the user changed their email after the token was sent.
+		// Rolling back keeps the token.
+		verified, err := txQueries.MarkEmailVerified(r.Context(), database.MarkEmailVerifiedParams{
+			ID: verification.UserID,
+			Email: verification.Email,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if verified == 0 {
+			utils.RespondWithError(w, 400, "Invalid or expired verification token")
+			return
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("POST /api/users/verify", verifyEmail)
+
+	resendEmailVerification := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := dbQueries.GetUserByID(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "user not found")
+			return
+		}
+
+		if user.EmailVerifiedAt.Valid {
+			utils.RespondWithError(w, 409, "Email address is already verified")
+			return
+		}
+
+		verificationEmail, err := createEmailVerification(r.Context(), dbQueries, user.ID, user.Email)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		sendEmail(r.Context(), verificationEmail)
+
+		utils.RespondWithJSon(w, 202, nil)
+	})
+
+	serveMux.Handle("POST /api/users/verify/resend", apiCfg.middlewareAuthenticate(auth.ScopeProfileWrite, resendEmailVerification))
+	
+	accountLoginPolicy := throttle.Policy{
+		FreeAttempts: 3,
+		BaseDelay: time.Second,
+		MaxDelay: 5 * time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter: 24 * time.Hour,
+	}
+
+	ipLoginLimiter := throttle.NewLimiter(throttle.Policy{
+		FreeAttempts: 10,
+		BaseDelay: time.Second,
+		MaxDelay: 5 * time.Minute,
+		LockoutThreshold: 50,
+		LockoutDuration: time.Hour,
+		ResetAfter: time.Hour,
+	})
+
+	// Emails without an account are throttled in memory with the account
+	// policy so they behave exactly like real accounts
+	unknownAccountLimiter := throttle.NewLimiter(accountLoginPolicy)
+
+	// Compared against when the email is unknown so both failure paths cost
+	// one hash check
+	dummyPasswordHash, err := apiCfg.passwords.Hash("chirpy-dummy-password")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	respondWithTooManyAttempts := func(w http.ResponseWriter, retryAfter time.Duration) {
+		w.Header().Set("Retry-After", fmt.Sprint(int(retryAfter.Seconds()) + 1))
+		utils.RespondWithError(w, 429, "Too many failed login attempts, try again later")
+	}
+
+	recordFailedLogin := func(ctx context.Context, userID uuid.UUID) error {
+		failures, err := dbQueries.RecordFailedLogin(ctx, database.RecordFailedLoginParams{
+			ID: userID,
+			ResetBefore: sql.NullTime{Time: time.Now().Add(-accountLoginPolicy.ResetAfter), Valid: true},
+		})
+
+		if err != nil {
+			return err
+		}
+
+		delay := accountLoginPolicy.Delay(int(failures))
+
+		if delay == 0 {
+			return nil
+		}
+
+		return dbQueries.LockUser(ctx, database.LockUserParams{
+			ID: userID,
+			LockedUntil: sql.NullTime{Time: time.Now().Add(delay), Valid: true},
+		})
+	}
+
+	// checkLogin verifies an email and password under the login throttles and
+	// upgrades outdated password hashes on success
+	checkLogin := func(ctx context.Context, ip, email, password string) (database.User, error) {
+		if allowed, retryAfter := ipLoginLimiter.Allow(ip); !allowed {
+			apiCfg.metrics.loginFailures.Inc("throttled")
+			return database.User{}, &loginThrottledError{retryAfter: retryAfter}
+		}
+
+		user, err := dbQueries.GetUser(ctx, email)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			email = strings.ToLower(email)
+
+			if allowed, retryAfter := unknownAccountLimiter.Allow(email); !allowed {
+				apiCfg.metrics.loginFailures.Inc("throttled")
+				return database.User{}, &loginThrottledError{retryAfter: retryAfter}
+			}
+
+			apiCfg.passwords.Check(password, dummyPasswordHash)
+			unknownAccountLimiter.Failure(email)
+			ipLoginLimiter.Failure(ip)
+			apiCfg.metrics.loginFailures.Inc("invalid_credentials")
+			return database.User{}, errInvalidCredentials
+		}
+
+		if err != nil {
+			return database.User{}, err
+		}
+
+		if user.LockedUntil.Valid && time.Now().Before(user.LockedUntil.Time) {
+			apiCfg.metrics.loginFailures.Inc("locked")
+			return database.User{}, &loginThrottledError{retryAfter: time.Until(user.LockedUntil.Time)}
+		}
+
+		err = apiCfg.passwords.Check(password, user.HashedPassword)
+
+		if err != nil {
+			apiCfg.metrics.loginFailures.Inc("invalid_credentials")
+			ipLoginLimiter.Failure(ip)
+			err = recordFailedLogin(ctx, user.ID)
+
+			if err != nil {
+				return database.User{}, err
+			}
+
+			return database.User{}, errInvalidCredentials
+		}
+
+		// Upgrade bcrypt and outdated argon2id hashes while the plain
+		// password is at hand. Failing to do so doesn't fail the login.
+		if apiCfg.passwords.NeedsRehash(user.HashedPassword) {
+			newHash, err := apiCfg.passwords.Hash(password)
+
+			if err == nil {
+				err = dbQueries.UpdateUserPassword(ctx, database.UpdateUserPasswordParams{
+					ID: user.ID,
+					HashedPassword: newHash,
+				})
+			}
+
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to rehash password", "user_id", user.ID, "error", err)
+			}
+		}
+
+		return user, nil
+	}
+
+	respondWithLoginError := func(w http.ResponseWriter, r *http.Request, err error) {
+		var throttled *loginThrottledError
+
+		switch {
+		case errors.As(err, &throttled):
+			respondWithTooManyAttempts(w, throttled.retryAfter)
+		case errors.Is(err, errInvalidCredentials):
+			utils.RespondWithError(w, 401, errInvalidCredentials.Error())
+		default:
+			respondWithInternalError(w, r, err)
+		}
+	}
+
+	type sessionResponse struct {
+		Id						uuid.UUID	`json:"id"`
+		UpdatedAt			time.Time	`json:"updated_at"`
+		CreatedAt			time.Time	`json:"created_at"`
+		Email					string		`json:"email"`
+		Token					string		`json:"token"`
+		RefreshToken	string		`json:"refresh_token"`
+		IsChirpyRed		bool			`json:"is_chirpy_red"`
+		EmailVerified	bool			`json:"email_verified"`
+		Role					string		`json:"role"`
+	}
+
+	// respondWithSession issues the access and refresh tokens that end every
+	// successful login
+	respondWithSession := func(w http.ResponseWriter, r *http.Request, user database.User) {
+		err := dbQueries.ResetFailedLogins(r.Context(), user.ID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		apiCfg.metrics.logins.Inc()
+
+		token, err := apiCfg.jwtKeys.MakeJWT(user.ID, settings.Tokens.AccessTokenLifetime)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+
+		refreshTokenExpiration := time.Now().Add(settings.Tokens.RefreshTokenLifetime)
+
+		refreshToken, err := auth.MakeRefreshToken()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		_, err = dbQueries.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
+			Token: sql.NullString{String: auth.HashToken(refreshToken), Valid: true},
+			UserID: uuid.NullUUID{UUID: user.ID, Valid: true},
+			ExpiresAt: sql.NullTime{Time: refreshTokenExpiration, Valid: true},
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := sessionResponse{
+			Id: user.ID,
+			CreatedAt: user.CreatedAt,
+			UpdatedAt: user.UpdatedAt,
+			Email: user.Email,
+			Token: token,
+			RefreshToken: refreshToken,
+			IsChirpyRed: user.IsChirpyRed,
+			EmailVerified: user.EmailVerifiedAt.Valid,
+			Role: user.Role,
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	}
+
+	twoFactorChallengeLifetime := 5 * time.Minute
+
+	// respondWithLogin ends a successful first factor check: accounts with
+	// two-factor authentication get a challenge, others a session
+	respondWithLogin := func(w http.ResponseWriter, r *http.Request, user database.User) {
+		type challengeResponse struct {
+			MfaRequired			bool		`json:"mfa_required"`
+			ChallengeToken	string	`json:"challenge_token"`
+		}
+
+		if user.TotpEnabledAt.Valid {
+			challengeToken, err := apiCfg.jwtKeys.MakeChallengeJWT(user.ID, twoFactorChallengeLifetime)
+
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+
+			utils.RespondWithJSon(w, 200, challengeResponse{
+				MfaRequired: true,
+				ChallengeToken: challengeToken,
+			})
+			return
+		}
+
+		respondWithSession(w, r, user)
+	}
+
+	login := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			Email							string	`json:"email"`
+			Password					string	`json:"password"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		
+		var decodedBody body
+
+		err := decoder.Decode(&decodedBody)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, genericErrorMessage)
+			return
+		}
+
+		user, err := checkLogin(r.Context(), apiCfg.clientIP(r), decodedBody.Email, decodedBody.Password)
+
+		if err != nil {
+			respondWithLoginError(w, r, err)
+			return
+		}
+
+		respondWithLogin(w, r, user)
+	})
+
+	serveMux.Handle("POST /api/login", login)
+
+	oidcLoginLifetime := 10 * time.Minute
+	oidcStateCookie := "chirpy_oidc_state"
+
+	listOidcProviders := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names := []string{}
+		for name := range apiCfg.oidcProviders {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		utils.RespondWithJSon(w, 200, names)
+	})
+
+	serveMux.Handle("GET /api/oidc/providers", listOidcProviders)
+
+	// startOidcLogin records a login with provider and sets the cookie tying
+	// its callback to this browser, so a login can't be forced onto someone
+	// else. It returns the URL to send the browser to. linkUserID is set when
+	// a signed in user links the identity instead of signing in with it.
+	startOidcLogin := func(w http.ResponseWriter, r *http.Request, provider *oidc.Provider, linkUserID uuid.NullUUID) (string, bool) {
+		state, errState := auth.MakeRefreshToken()
+		nonce, errNonce := auth.MakeRefreshToken()
+		codeVerifier, errVerifier := auth.MakeRefreshToken()
+
+		if err := errors.Join(errState, errNonce, errVerifier); err != nil {
+			respondWithInternalError(w, r, err)
+			return "", false
+		}
+
+		authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, codeVerifier)
+
+		if err != nil {
+			logRequestError(r, fmt.Errorf("OIDC provider %s: %w", provider.Name(), err))
+			utils.RespondWithError(w, 502, "The identity provider is unavailable")
+			return "", false
+		}
+
+		// Abandoned logins are cleaned up as new ones start
+		err = dbQueries.DeleteExpiredOidcLoginStates(r.Context())
+
+		if err == nil {
+			err = dbQueries.CreateOidcLoginState(r.Context(), database.CreateOidcLoginStateParams{
+				StateHash: auth.HashToken(state),
+				Provider: provider.Name(),
+				Nonce: nonce,
+				CodeVerifier: codeVerifier,
+				ExpiresAt: time.Now().Add(oidcLoginLifetime),
+				LinkUserID: linkUserID,
+			})
+		}
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return "", false
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name: oidcStateCookie,
+			Value: state,
+			Path: "/api/oidc/",
+			MaxAge: int(oidcLoginLifetime.Seconds()),
+			HttpOnly: true,
+			Secure: r.TLS != nil || (apiCfg.trustProxyHeaders && r.Header.Get("X-Forwarded-Proto") == "https"),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		return authURL, true
+	}
+
+	oidcLogin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := apiCfg.oidcProviders[r.PathValue("provider")]
+
+		if !ok {
+			utils.RespondWithError(w, 404, "Unknown identity provider")
+			return
+		}
+
+		authURL, ok := startOidcLogin(w, r, provider, uuid.NullUUID{})
+
+		if !ok {
+			return
+		}
+
+		http.Redirect(w, r, authURL, http.StatusFound)
+	})
+
+	serveMux.Handle("GET /api/oidc/{provider}/login", oidcLogin)
+
+	// findOrCreateOidcUser returns the user linked to the external identity.
+	// Unknown identities get a new account, but only when the provider vouches
+	// for the address. They are never linked to an existing account with the
+	// same email: whoever controls the address at the provider would take the
+	// account over.
+	findOrCreateOidcUser := func(ctx context.Context, provider string, idToken *oidc.IDToken) (database.User, error) {
+		identity, err := dbQueries.GetUserIdentity(ctx, database.GetUserIdentityParams{
+			Provider: provider,
+			Subject: idToken.Subject,
+		})
+
+		if err == nil {
+			err = dbQueries.TouchUserIdentity(ctx, database.TouchUserIdentityParams{
+				Email: idToken.Email,
+				ID: identity.ID,
+			})
+
+			if err != nil {
+				return database.User{}, err
+			}
+
+			return dbQueries.GetUserByID(ctx, identity.UserID)
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return database.User{}, err
+		}
+
+		if idToken.Email == "" || !idToken.EmailVerified {
+			return database.User{}, errOidcEmailNotVerified
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+
+		if err != nil {
+			return database.User{}, err
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		_, err = txQueries.GetUser(ctx, idToken.Email)
+
+		if err == nil {
+			return database.User{}, errOidcAccountExists
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return database.User{}, err
+		}
+
+		// The account has no usable password until one is set through
+		// POST /api/password/forgot
+		randomPassword, err := auth.MakeRefreshToken()
+
+		if err != nil {
+			return database.User{}, err
+		}
+
+		hashedPassword, err := apiCfg.passwords.Hash(randomPassword)
+
+		if err != nil {
+			return database.User{}, err
+		}
+
+		user, err := txQueries.CreateUser(ctx, database.CreateUserParams{
+			Email: idToken.Email,
+			HashedPassword: hashedPassword,
+		})
+
+		if err != nil {
+			return database.User{}, err
+		}
+
+		_, err = txQueries.MarkEmailVerified(ctx, database.MarkEmailVerifiedParams{
+			ID: user.ID,
+			Email: user.Email,
+		})
+
+		if err != nil {
+			return database.User{}, err
+		}
+
+		_, err = txQueries.CreateUserIdentity(ctx, database.CreateUserIdentityParams{
+			UserID: user.ID,
+			Provider: provider,
+			Subject: idToken.Subject,
+			Email: idToken.Email,
+		})
+
+		if err != nil {
+			return database.User{}, err
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			return database.User{}, err
+		}
+
+		return dbQueries.GetUserByID(ctx, user.ID)
+	}
+
+	// linkOidcUser links the external identity to the signed in user who
+	// started the login. The provider's email doesn't matter: the user proved
+	// they control both accounts.
+	linkOidcUser := func(ctx context.Context, userID uuid.UUID, provider string, idToken *oidc.IDToken) error {
+		identity, err := dbQueries.GetUserIdentity(ctx, database.GetUserIdentityParams{
+			Provider: provider,
+			Subject: idToken.Subject,
+		})
+
+		if err == nil {
+			if identity.UserID != userID {
+				return errOidcIdentityTaken
+			}
+
+			return nil
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		_, err = dbQueries.CreateUserIdentity(ctx, database.CreateUserIdentityParams{
+			UserID: userID,
+			Provider: provider,
+			Subject: idToken.Subject,
+			Email: idToken.Email,
+		})
+
+		return err
+	}
+
+	oidcCallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := apiCfg.oidcProviders[r.PathValue("provider")]
+
+		if !ok {
+			utils.RespondWithError(w, 404, "Unknown identity provider")
+			return
+		}
+
+		query := r.URL.Query()
+
+		if query.Get("error") != "" {
+			utils.RespondWithError(w, 401, fmt.Sprintf("Sign in failed: %s", query.Get("error")))
+			return
+		}
+
+		cookie, err := r.Cookie(oidcStateCookie)
+
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+			utils.RespondWithError(w, 401, "Invalid or expired sign in attempt")
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc/", MaxAge: -1})
+
+		loginState, err := dbQueries.ConsumeOidcLoginState(r.Context(), database.ConsumeOidcLoginStateParams{
+			StateHash: auth.HashToken(cookie.Value),
+			Provider: provider.Name(),
+		})
+
+		if err != nil {
+			utils.RespondWithError(w, 401, "Invalid or expired sign in attempt")
+			return
+		}
+
+		idToken, err := provider.Exchange(r.Context(), query.Get("code"), loginState.CodeVerifier, loginState.Nonce)
+
+		if err != nil {
+			logRequestError(r, fmt.Errorf("OIDC provider %s: %w", provider.Name(), err))
+			utils.RespondWithError(w, 401, "Sign in with the identity provider failed")
+			return
+		}
+
+		if loginState.LinkUserID.Valid {
+			err = linkOidcUser(r.Context(), loginState.LinkUserID.UUID, provider.Name(), idToken)
+
+			if errors.Is(err, errOidcIdentityTaken) {
+				utils.RespondWithError(w, 409, err.Error())
+				return
+			}
+
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+
+			utils.RespondWithJSon(w, 204, nil)
+			return
+		}
+
+		user, err := findOrCreateOidcUser(r.Context(), provider.Name(), idToken)
+
+		if errors.Is(err, errOidcEmailNotVerified) {
+			utils.RespondWithError(w, 403, err.Error())
+			return
+		}
+
+		if errors.Is(err, errOidcAccountExists) {
+			utils.RespondWithError(w, 409, err.Error())
+			return
+		}
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		respondWithLogin(w, r, user)
+	})
+
+	serveMux.Handle("GET /api/oidc/{provider}/callback", oidcCallback)
+
+	// Answers with the URL to send the browser to instead of redirecting, as
+	// the request carries the caller's access token. The callback then links
+	// the identity to the caller's account.
+	linkOidcIdentity := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type successResponse struct {
+			AuthorizationURL	string	`json:"authorization_url"`
+		}
+
+		provider, ok := apiCfg.oidcProviders[r.PathValue("provider")]
+
+		if !ok {
+			utils.RespondWithError(w, 404, "Unknown identity provider")
+			return
+		}
+
+		authURL, ok := startOidcLogin(w, r, provider, uuid.NullUUID{UUID: getPrincipal(r).UserID, Valid: true})
+
+		if !ok {
+			return
+		}
+
+		utils.RespondWithJSon(w, 200, successResponse{AuthorizationURL: authURL})
+	})
+
+	serveMux.Handle("POST /api/users/identities/{provider}", apiCfg.middlewareAuthenticate(auth.ScopeSecurityManage, linkOidcIdentity))
+
+	listIdentities := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type identityResponse struct {
+			Provider		string			`json:"provider"`
+			Email				string			`json:"email"`
+			CreatedAt		time.Time		`json:"created_at"`
+			LastLoginAt	*time.Time	`json:"last_login_at"`
+		}
+
+		identities, err := dbQueries.ListUserIdentitiesByUser(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := []identityResponse{}
+		for _, identity := range identities {
+			item := identityResponse{
+				Provider: identity.Provider,
+				Email: identity.Email,
+				CreatedAt: identity.CreatedAt,
+			}
+
+			if identity.LastLoginAt.Valid {
+				item.LastLoginAt = &identity.LastLoginAt.Time
+			}
+
+			response = append(response, item)
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("GET /api/users/identities", apiCfg.middlewareAuthenticate(auth.ScopeSecurityManage, listIdentities))
+
+	// checkSecondFactor accepts either a current TOTP code or an unused
+	// recovery code. Both are single use.
+	checkSecondFactor := func(ctx context.Context, user database.User, code string, recoveryCode string) (bool, error) {
+		if recoveryCode != "" {
+			used, err := dbQueries.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+				UserID: user.ID,
+				CodeHash: auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)),
+			})
+
+			return used == 1, err
+		}
+
+		counter, ok := auth.ValidateTOTP(user.TotpSecret.String, code, time.Now())
+
+		if !ok {
+			return false, nil
+		}
+
+		used, err := dbQueries.UseTotpCounter(ctx, database.UseTotpCounterParams{
+			ID: user.ID,
+			TotpLastCounter: counter,
+		})
+
+		return used == 1, err
+	}
+
+	verifyTwoFactor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			ChallengeToken	string	`json:"challenge_token"`
+			Code						string	`json:"code"`
+			RecoveryCode		string	`json:"recovery_code"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedBody body
+
+		err := decoder.Decode(&decodedBody)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		ip := apiCfg.clientIP(r)
+
+		if allowed, retryAfter := ipLoginLimiter.Allow(ip); !allowed {
+			respondWithTooManyAttempts(w, retryAfter)
+			return
+		}
+
+		challenge, err := apiCfg.jwtKeys.ValidateChallengeJWT(decodedBody.ChallengeToken)
+
+		if err != nil {
+			utils.RespondWithError(w, 401, "Invalid or expired challenge")
+			return
+		}
+
+		user, err := dbQueries.GetUserByID(r.Context(), challenge.UserID)
+
+		if err != nil || !user.TotpEnabledAt.Valid {
+			utils.RespondWithError(w, 401, "Invalid or expired challenge")
+			return
+		}
+
+		if user.LockedUntil.Valid && time.Now().Before(user.LockedUntil.Time) {
+			respondWithTooManyAttempts(w, time.Until(user.LockedUntil.Time))
+			return
+		}
+
+		ok, err := checkSecondFactor(r.Context(), user, decodedBody.Code, decodedBody.RecoveryCode)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		// Wrong codes count like wrong passwords so codes can't be brute forced
+		if !ok {
+			apiCfg.metrics.loginFailures.Inc("invalid_second_factor")
+			ipLoginLimiter.Failure(ip)
+			err = recordFailedLogin(r.Context(), user.ID)
+
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+
+			utils.RespondWithError(w, 401, "Invalid code")
+			return
+		}
+
+		// A challenge is redeemed once, so a captured one is useless even
+		// with a fresh code. Expired ones are cleaned up as others are
+		// redeemed.
+		err = dbQueries.DeleteExpiredTwoFactorChallenges(r.Context())
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		redeemed, err := dbQueries.UseTwoFactorChallenge(r.Context(), database.UseTwoFactorChallengeParams{
+			Jti: challenge.ID,
+			UserID: user.ID,
+			ExpiresAt: challenge.ExpiresAt,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if redeemed == 0 {
+			utils.RespondWithError(w, 401, "Invalid or expired challenge")
+			return
+		}
+
+		respondWithSession(w, r, user)
+	})
+
+	serveMux.Handle("POST /api/2fa/verify", verifyTwoFactor)
+
+	enrollTwoFactor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type successResponse struct {
+			Secret			string	`json:"secret"`
+			OtpauthURI	string	`json:"otpauth_uri"`
+		}
+
+		user, err := dbQueries.GetUserByID(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "user not found")
+			return
+		}
+
+		if user.TotpEnabledAt.Valid {
+			utils.RespondWithError(w, 409, "Two-factor authentication is already enabled")
+			return
+		}
+
+		secret, err := auth.GenerateTOTPSecret()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		// The secret stays inactive until a code generated from it is confirmed
+		err = dbQueries.SetTotpSecret(r.Context(), database.SetTotpSecretParams{
+			ID: user.ID,
+			TotpSecret: sql.NullString{String: secret, Valid: true},
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 200, successResponse{
+			Secret: secret,
+			OtpauthURI: auth.TOTPURI(secret, "Chirpy", user.Email),
+		})
+	})
+
+	serveMux.Handle("POST /api/2fa/enroll", apiCfg.middlewareAuthenticate(auth.ScopeSecurityManage, enrollTwoFactor))
+
+	recoveryCodeCount := 10
+
+	confirmTwoFactor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			Code	string	`json:"code"`
+		}
+
+		type successResponse struct {
+			RecoveryCodes	[]string	`json:"recovery_codes"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedBody body
+
+		err := decoder.Decode(&decodedBody)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		user, err := dbQueries.GetUserByID(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "user not found")
+			return
+		}
+
+		if user.TotpEnabledAt.Valid {
+			utils.RespondWithError(w, 409, "Two-factor authentication is already enabled")
+			return
+		}
+
+		if !user.TotpSecret.Valid {
+			utils.RespondWithError(w, 400, "Start enrollment with POST /api/2fa/enroll first")
+			return
+		}
+
+		counter, ok := auth.ValidateTOTP(user.TotpSecret.String, decodedBody.Code, time.Now())
+
+		if !ok {
+			utils.RespondWithError(w, 400, "Invalid code")
+			return
+		}
+
+		recoveryCodes, err := auth.MakeRecoveryCodes(recoveryCodeCount)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		err = txQueries.DeleteRecoveryCodes(r.Context(), user.ID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		for _, code := range recoveryCodes {
+			err = txQueries.CreateRecoveryCode(r.Context(), database.CreateRecoveryCodeParams{
+				UserID: user.ID,
+				CodeHash: auth.HashToken(auth.NormalizeRecoveryCode(code)),
+			})
+
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+		}
+
+		err = txQueries.EnableTotp(r.Context(), database.EnableTotpParams{
+			ID: user.ID,
+			TotpLastCounter: counter,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		// Recovery codes are only stored hashed, this is the only time they are shown
+		utils.RespondWithJSon(w, 200, successResponse{
+			RecoveryCodes: recoveryCodes,
+		})
+	})
+
+	serveMux.Handle("POST /api/2fa/confirm", apiCfg.middlewareAuthenticate(auth.ScopeSecurityManage, confirmTwoFactor))
+
+	disableTwoFactor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			Code					string	`json:"code"`
+			RecoveryCode	string	`json:"recovery_code"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedBody body
+
+		err := decoder.Decode(&decodedBody)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		user, err := dbQueries.GetUserByID(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "user not found")
+			return
+		}
+
+		if !user.TotpEnabledAt.Valid {
+			utils.RespondWithError(w, 409, "Two-factor authentication is not enabled")
+			return
+		}
+
+		ok, err := checkSecondFactor(r.Context(), user, decodedBody.Code, decodedBody.RecoveryCode)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if !ok {
+			utils.RespondWithError(w, 401, "Invalid code")
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		err = txQueries.DisableTotp(r.Context(), user.ID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		err = txQueries.DeleteRecoveryCodes(r.Context(), user.ID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("POST /api/2fa/disable", apiCfg.middlewareAuthenticate(auth.ScopeSecurityManage, disableTwoFactor))
+
+	getChirps := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type successResponse struct {
+			Id				uuid.UUID	`json:"id"`
+			UserId		uuid.UUID	`json:"user_id"`
+			CreatedAt time.Time `json:"created_at"`
+			UpdatedAt time.Time `json:"updated_at"`
+			Body			string		`json:"body"`
+		}
+
+		type response []successResponse
+
+		searchByAuthorId := r.URL.Query().Get("author_id");
+
+		var chirps []database.Chirp
+		if searchByAuthorId == "" {
+			chirps, err = dbQueries.GetChirps(r.Context())
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+		} else {
+			authorId, err := uuid.Parse(searchByAuthorId)
+			if err != nil {
+				utils.RespondWithError(w, 400, genericErrorMessage)
+				return
+			}
+			chirps, err = dbQueries.GetChirpsByUserID(r.Context(), authorId)
+
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+		}
+
+		sort_order := r.URL.Query().Get("sort");
+
+		if (sort_order == "desc") {
+			sort.Slice(chirps, func(i, j int) bool {
+				return time.Time(chirps[i].CreatedAt).After(time.Time(chirps[j].CreatedAt))
+			})
+		}
+		
+		var chirpList response
+		for i := range(len(chirps)) {
+			chirp := chirps[i]
+			chirpList = append(chirpList, successResponse{
+				Id: chirp.ID,
+				UserId: chirp.UserID,
+				CreatedAt: chirp.CreatedAt,
+				UpdatedAt: chirp.UpdatedAt,
+				Body: chirp.Body,
+			})
+		}
+
+		utils.RespondWithJSon(w, 200, &chirpList)
+	})
+
+	serveMux.Handle("GET /api/chirps", getChirps)
+
+	deleteChirp := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chirpID := r.PathValue("chirpID")
+
+		userID := getPrincipal(r).UserID
+
+		parsedChirpID, err := uuid.Parse(chirpID)
+	
+		if err != nil {
+			utils.RespondWithError(w, 400, genericErrorMessage)
+			return
+		}
+
+		chirp, err := dbQueries.GetChirp(r.Context(), parsedChirpID)
+
+		if err != nil {
+			utils.RespondWithError(w, 404, genericErrorMessage)
+			return
+		}
+		if userID != chirp.UserID {
+			utils.RespondWithError(w, 403, "Unauthorized")
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		err = txQueries.DeleteChirp(r.Context(), chirp.ID)
+		if err != nil {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		err = enqueueWebhookEvent(r.Context(), txQueries, chirp.UserID, webhooks.EventChirpDeleted, toChirpEventData(chirp))
+
+		if err == nil {
+			err = tx.Commit()
+		}
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+	
+	serveMux.Handle("DELETE /api/chirps/{chirpID}", apiCfg.middlewareAuthenticate(auth.ScopeChirpsWrite, deleteChirp))
+
+	editChirp := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type reqBody struct {
+			Body	string	`json:"body"`
+		}
+
+		type successResponse struct {
+			Id				uuid.UUID	`json:"id"`
+			UserId		uuid.UUID	`json:"user_id"`
+			CreatedAt time.Time `json:"created_at"`
+			UpdatedAt time.Time `json:"updated_at"`
+			Body			string		`json:"body"`
+		}
+
+		chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		userID := getPrincipal(r).UserID
+
+		chirp, err := dbQueries.GetChirp(r.Context(), chirpID)
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		if chirp.UserID != userID {
+			utils.RespondWithError(w, 403, "Unauthorized")
+			return
+		}
+
+		_, userEntitlements, err := entitlementsFor(r.Context(), userID)
+
+		if err != nil {
+			utils.RespondWithError(w, 401, "user not found")
+			return
+		}
+
+		if !userEntitlements.CanEdit(chirp.CreatedAt, time.Now()) {
+			utils.RespondWithError(w, 403, "This chirp can no longer be edited")
+			return
+		}
+
+		var decodedBody reqBody
+
+		err = json.NewDecoder(r.Body).Decode(&decodedBody)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, genericErrorMessage)
+			return
+		}
+
+		err = userEntitlements.CheckChirpLength(decodedBody.Body)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		cleanMsg := utils.GetCorrectedString(decodedBody.Body, prohibitedWords)
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		chirp, err = txQueries.UpdateChirpBody(r.Context(), database.UpdateChirpBodyParams{
+			Body: cleanMsg.CorrectedMsg,
+			ID: chirp.ID,
+		})
+
+		if err == nil {
+			err = enqueueWebhookEvent(r.Context(), txQueries, chirp.UserID, webhooks.EventChirpUpdated, toChirpEventData(chirp))
+		}
+
+		if err == nil {
+			err = tx.Commit()
+		}
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 200, successResponse{
+			Id: chirp.ID,
+			UserId: chirp.UserID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+			Body: chirp.Body,
+		})
+	})
+
+	serveMux.Handle("PUT /api/chirps/{chirpID}", apiCfg.middlewareAuthenticate(auth.ScopeChirpsWrite, editChirp))
+
+	getChirp := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chirpID := r.PathValue("chirpID")
+
+		uChirpID, err := uuid.Parse(chirpID)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+		
+		chirp, err := dbQueries.GetChirp(r.Context(), uChirpID)
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "user not found")
+			return
+		}
+
+		type successResponse struct {
+			Id				uuid.UUID	`json:"id"`
+			CreatedAt	time.Time `json:"created_at"`
+			UpdatedAt time.Time	`json:"updated_at"`
+			Body 			string 		`json:"body"`	
+			UserId 		uuid.UUID `json:"user_id"`
+		}
+
+		res := successResponse{
+			Id: chirp.ID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+			Body: chirp.Body,
+			UserId: chirp.UserID,
+		}
+
+		utils.RespondWithJSon(w, 200, res)
+	})
+
+	refresh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type SuccessResponse struct {
+			Token	string	`json:"token"`
+		}
+
+		bearerToken, err := auth.GetBearerToken(&r.Header)
+	
+		if err != nil {
+			utils.RespondWithError(w, 401, "Invalid refresh token")
+			return
+		}
+
+		user, err := dbQueries.GetUserFromRefreshToken(r.Context(), sql.NullString{String: auth.HashToken(bearerToken), Valid: true})
+
+		if err != nil {
+			utils.RespondWithError(w, 401, "Invalid refresh token")
+			return
+		}
+		
+		tokenExpiration := user.ExpiresAt
+		isExpired := time.Now().After(tokenExpiration)
+
+		isRevoked := user.RevokedAt.Valid && !user.RevokedAt.Time.IsZero()
+
+		// Tokens issued to OAuth clients are refreshed through POST /oauth/token
+		// so they keep their scopes
+		if isExpired || isRevoked || user.ClientID.Valid {
+			utils.RespondWithError(w, 401, "Invalid refresh token")
+			return
+		}
+
+		jwtToken, err := apiCfg.jwtKeys.MakeJWT(user.UserID, settings.Tokens.AccessTokenLifetime)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := SuccessResponse{
+			Token: jwtToken,
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("POST /api/refresh", refresh)
+
+	revoke := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearerToken, err := auth.GetBearerToken(&r.Header)
+	
+		if err != nil {
+			utils.RespondWithError(w, 401, "Invalid refresh token")
+			return
+		}
+
+		err = dbQueries.RevokeToken(r.Context(), sql.NullString{String: auth.HashToken(bearerToken), Valid: true})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("POST /api/revoke", revoke)
+	
+	serveMux.Handle("GET /api/chirps/{chirpID}", getChirp)
+
+	passwordResetTokenLifetime := settings.Tokens.PasswordResetTokenLifetime
+
+	// createPasswordResetToken stores a reset token for userID and returns
+	// it, to be mailed to the user
+	createPasswordResetToken := func(ctx context.Context, q *database.Queries, userID uuid.UUID) (string, error) {
+		resetToken, err := auth.MakeRefreshToken()
+
+		if err != nil {
+			return "", err
+		}
+
+		err = q.CreatePasswordResetToken(ctx, database.CreatePasswordResetTokenParams{
+			TokenHash: auth.HashToken(resetToken),
+			UserID: userID,
+			ExpiresAt: time.Now().Add(passwordResetTokenLifetime),
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		return resetToken, nil
+	}
+
+	forgotPassword := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			Email	string	`json:"email"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedBody body
+
+		err := decoder.Decode(&decodedBody)
+
+		if err != nil || decodedBody.Email == "" {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		// Unknown emails get the same response so accounts can't be enumerated
+		user, err := dbQueries.GetUser(r.Context(), decodedBody.Email)
+
+		if err != nil {
+			utils.RespondWithJSon(w, 202, nil)
+			return
+		}
+
+		resetToken, err := createPasswordResetToken(r.Context(), dbQueries, user.ID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		message := mail.Message{
+			From: apiCfg.mailFrom,
+			To: user.Email,
+			Subject: "Reset your Chirpy password",
+			Body: fmt.Sprintf(
+				"Someone asked to reset the password of your Chirpy account.\n\n" +
+				"Your reset token is: %s\n\n" +
+				"Send it with your new password to POST /api/password/reset within %s. " +
+				"If this wasn't you, you can ignore this email.\n",
+				resetToken, passwordResetTokenLifetime,
+			),
+		}
+
+		// Sent in the background so response times don't reveal whether the
+		// account exists
+		sendEmail(r.Context(), message)
+
+		utils.RespondWithJSon(w, 202, nil)
+	})
+
+	serveMux.Handle("POST /api/password/forgot", forgotPassword)
+
+	resetPassword := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			Token			string	`json:"token"`
+			Password	string	`json:"password"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedBody body
+
+		err := decoder.Decode(&decodedBody)
+
+		if err != nil || decodedBody.Token == "" {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		userID, err := txQueries.ConsumePasswordResetToken(r.Context(), auth.HashToken(decodedBody.Token))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "Invalid or expired reset token")
+			return
+		}
+
+		user, err := txQueries.GetUserByID(r.Context(), userID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		// Rolling back leaves the token usable for another attempt
+		if !checkPasswordPolicy(w, r, decodedBody.Password, user.Email) {
+			return
+		}
+
+		hashedPassword, err := apiCfg.passwords.Hash(decodedBody.Password)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		err = txQueries.UpdateUserPassword(r.Context(), database.UpdateUserPasswordParams{
+			ID: userID,
+			HashedPassword: hashedPassword,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		// Log out everywhere and burn any other reset links
+		err = revokeCredentials(r.Context(), txQueries, userID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		err = txQueries.InvalidatePasswordResetTokens(r.Context(), userID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("POST /api/password/reset", resetPassword)
+
+	type apiKeyResponse struct {
+		Id					uuid.UUID		`json:"id"`
+		Name				string			`json:"name"`
+		Prefix			string			`json:"prefix"`
+		Scopes			[]string		`json:"scopes"`
+		CreatedAt		time.Time		`json:"created_at"`
+		ExpiresAt		*time.Time	`json:"expires_at"`
+		LastUsedAt	*time.Time	`json:"last_used_at"`
+		RevokedAt		*time.Time	`json:"revoked_at"`
+		Key					string			`json:"key,omitempty"`
+	}
+
+	toApiKeyResponse := func(key database.ApiKey) apiKeyResponse {
+		nullableTime := func(t sql.NullTime) *time.Time {
+			if !t.Valid {
+				return nil
+			}
+			return &t.Time
+		}
+
+		return apiKeyResponse{
+			Id: key.ID,
+			Name: key.Name,
+			Prefix: key.Prefix,
+			Scopes: strings.Fields(key.Scopes),
+			CreatedAt: key.CreatedAt,
+			ExpiresAt: nullableTime(key.ExpiresAt),
+			LastUsedAt: nullableTime(key.LastUsedAt),
+			RevokedAt: nullableTime(key.RevokedAt),
+		}
+	}
+
+	createApiKey := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			Name					string		`json:"name"`
+			Scopes				[]string	`json:"scopes"`
+			ExpiresInDays	int				`json:"expires_in_days"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedBody body
+
+		err := decoder.Decode(&decodedBody)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		if decodedBody.Name == "" {
+			utils.RespondWithError(w, 400, "name is required")
+			return
+		}
+
+		scopes, err := auth.ParseScopes(strings.Join(decodedBody.Scopes, " "), auth.DelegableScopes)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		if len(scopes) == 0 {
+			utils.RespondWithError(w, 400, "at least one scope is required")
+			return
+		}
+
+		if decodedBody.ExpiresInDays < 0 {
+			utils.RespondWithError(w, 400, "expires_in_days must be positive")
+			return
+		}
+
+		expiresAt := sql.NullTime{}
+		if decodedBody.ExpiresInDays > 0 {
+			expiresAt = sql.NullTime{
+				Time: time.Now().Add(time.Duration(decodedBody.ExpiresInDays) * 24 * time.Hour),
+				Valid: true,
+			}
+		}
+
+		key, prefix, err := auth.MakeAPIKey()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		apiKey, err := dbQueries.CreateApiKey(r.Context(), database.CreateApiKeyParams{
+			UserID: getPrincipal(r).UserID,
+			Name: decodedBody.Name,
+			Prefix: prefix,
+			HashedKey: auth.HashToken(key),
+			Scopes: auth.FormatScopes(scopes),
+			ExpiresAt: expiresAt,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		// The key itself is only ever returned here
+		response := toApiKeyResponse(apiKey)
+		response.Key = key
+
+		utils.RespondWithJSon(w, 201, response)
+	})
+
+	serveMux.Handle("POST /api/keys", apiCfg.middlewareAuthenticate(auth.ScopeKeysManage, createApiKey))
+
+	listApiKeys := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys, err := dbQueries.ListApiKeysByUser(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := []apiKeyResponse{}
+		for _, key := range keys {
+			response = append(response, toApiKeyResponse(key))
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("GET /api/keys", apiCfg.middlewareAuthenticate(auth.ScopeKeysManage, listApiKeys))
+
+	revokeApiKey := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyID, err := uuid.Parse(r.PathValue("keyID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		revoked, err := dbQueries.RevokeApiKey(r.Context(), database.RevokeApiKeyParams{
+			ID: keyID,
+			UserID: getPrincipal(r).UserID,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if revoked == 0 {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("DELETE /api/keys/{keyID}", apiCfg.middlewareAuthenticate(auth.ScopeKeysManage, revokeApiKey))
+
+	type oauthClientResponse struct {
+		ClientId			uuid.UUID	`json:"client_id"`
+		Name					string		`json:"name"`
+		RedirectUris	[]string	`json:"redirect_uris"`
+		Scopes				[]string	`json:"scopes"`
+		Confidential	bool			`json:"confidential"`
+		CreatedAt			time.Time	`json:"created_at"`
+		ClientSecret	string		`json:"client_secret,omitempty"`
+	}
+
+	toOauthClientResponse := func(client database.OauthClient) oauthClientResponse {
+		return oauthClientResponse{
+			ClientId: client.ID,
+			Name: client.Name,
+			RedirectUris: strings.Fields(client.RedirectUris),
+			Scopes: strings.Fields(client.Scopes),
+			Confidential: client.HashedSecret.Valid,
+			CreatedAt: client.CreatedAt,
+		}
+	}
+
+	createOauthClient := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			Name					string		`json:"name"`
+			RedirectUris	[]string	`json:"redirect_uris"`
+			Scopes				[]string	`json:"scopes"`
+			Confidential	bool			`json:"confidential"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+
+		var decodedBody body
+
+		err := decoder.Decode(&decodedBody)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
+		}
+
+		if decodedBody.Name == "" {
+			utils.RespondWithError(w, 400, "name is required")
+			return
+		}
+
+		if len(decodedBody.RedirectUris) == 0 {
+			utils.RespondWithError(w, 400, "at least one redirect URI is required")
+			return
+		}
+
+		for _, redirectUri := range decodedBody.RedirectUris {
+			err = oauth.ValidateRedirectURI(redirectUri)
+
+			if err != nil {
+				utils.RespondWithError(w, 400, err.Error())
+				return
+			}
+
+			// Redirect URIs are stored space separated
+			if strings.ContainsAny(redirectUri, " \t\n") {
+				utils.RespondWithError(w, 400, "redirect URIs must not contain spaces")
+				return
+			}
+		}
+
+		scopes, err := auth.ParseScopes(strings.Join(decodedBody.Scopes, " "), auth.DelegableScopes)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		if len(scopes) == 0 {
+			utils.RespondWithError(w, 400, "at least one scope is required")
+			return
+		}
+
+		clientSecret := ""
+		hashedSecret := sql.NullString{}
+
+		if decodedBody.Confidential {
+			clientSecret, err = auth.MakeRefreshToken()
+
+			if err != nil {
+				respondWithInternalError(w, r, err)
+				return
+			}
+
+			hashedSecret = sql.NullString{String: auth.HashToken(clientSecret), Valid: true}
+		}
+
+		client, err := dbQueries.CreateOauthClient(r.Context(), database.CreateOauthClientParams{
+			UserID: getPrincipal(r).UserID,
+			Name: decodedBody.Name,
+			HashedSecret: hashedSecret,
+			RedirectUris: strings.Join(decodedBody.RedirectUris, " "),
+			Scopes: auth.FormatScopes(scopes),
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		// The secret itself is only ever returned here
+		response := toOauthClientResponse(client)
+		response.ClientSecret = clientSecret
+
+		utils.RespondWithJSon(w, 201, response)
+	})
+
+	serveMux.Handle("POST /api/oauth/clients", apiCfg.middlewareAuthenticate(auth.ScopeClientsManage, createOauthClient))
+
+	listOauthClients := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients, err := dbQueries.ListOauthClientsByUser(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := []oauthClientResponse{}
+		for _, client := range clients {
+			response = append(response, toOauthClientResponse(client))
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("GET /api/oauth/clients", apiCfg.middlewareAuthenticate(auth.ScopeClientsManage, listOauthClients))
+
+	deleteOauthClient := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, err := uuid.Parse(r.PathValue("clientID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		// Pending authorization codes and refresh tokens are deleted with it
+		deleted, err := dbQueries.DeleteOauthClient(r.Context(), database.DeleteOauthClientParams{
+			ID: clientID,
+			UserID: getPrincipal(r).UserID,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if deleted == 0 {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("DELETE /api/oauth/clients/{clientID}", apiCfg.middlewareAuthenticate(auth.ScopeClientsManage, deleteOauthClient))
+
+	oauthCodeLifetime := 10 * time.Minute
+	oauthAccessTokenLifetime := settings.Tokens.AccessTokenLifetime
+	oauthRefreshTokenLifetime := settings.Tokens.RefreshTokenLifetime
+
+	type authorizationRequest struct {
+		client				database.OauthClient
+		redirectUri		string
+		state					string
+		scopes				[]string
+		codeChallenge	string
+	}
+
+	// parseAuthorizationRequest validates the parameters of GET and POST
+	// /oauth/authorize. Until the client and redirect URI are known to be
+	// good, errors are shown to the user instead of being redirected.
+	parseAuthorizationRequest := func(w http.ResponseWriter, r *http.Request, params url.Values) (authorizationRequest, bool) {
+		request := authorizationRequest{state: params.Get("state")}
+
+		clientID, err := uuid.Parse(params.Get("client_id"))
+
+		if err == nil {
+			request.client, err = dbQueries.GetOauthClient(r.Context(), clientID)
+		}
+
+		if err != nil {
+			http.Error(w, "Unknown OAuth client", 400)
+			return request, false
+		}
+
+		registered := strings.Fields(request.client.RedirectUris)
+		request.redirectUri = params.Get("redirect_uri")
+
+		if request.redirectUri == "" && len(registered) == 1 {
+			request.redirectUri = registered[0]
+		}
+
+		if !oauth.MatchRedirectURI(registered, request.redirectUri) {
+			http.Error(w, "Redirect URI is not registered for this client", 400)
+			return request, false
+		}
+
+		redirectError := func(code, description string) (authorizationRequest, bool) {
+			redirectOauthError(w, r, request.redirectUri, request.state, code, description)
+			return request, false
+		}
+
+		if params.Get("response_type") != "code" {
+			return redirectError(oauth.ErrUnsupportedResponseType, "only the authorization code flow is supported")
+		}
+
+		request.codeChallenge = params.Get("code_challenge")
+
+		if params.Get("code_challenge_method") != oauth.CodeChallengeMethod || !oauth.ValidCodeChallenge(request.codeChallenge) {
+			return redirectError(oauth.ErrInvalidRequest, "PKCE with the S256 method is required")
+		}
+
+		request.scopes, err = auth.ParseScopes(params.Get("scope"), strings.Fields(request.client.Scopes))
+
+		if err != nil {
+			return redirectError(oauth.ErrInvalidScope, err.Error())
+		}
+
+		if len(request.scopes) == 0 {
+			request.scopes = strings.Fields(request.client.Scopes)
+		}
+
+		return request, true
+	}
+
+	renderConsentPage := func(w http.ResponseWriter, status int, request authorizationRequest, email, message string) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		// The page asks for a password, so it must not be framed by the client
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+		w.WriteHeader(status)
+
+		err := oauth.RenderConsentPage(w, oauth.ConsentPage{
+			ClientName: request.client.Name,
+			Scopes: request.scopes,
+			Params: map[string]string{
+				"response_type": "code",
+				"client_id": request.client.ID.String(),
+				"redirect_uri": request.redirectUri,
+				"scope": auth.FormatScopes(request.scopes),
+				"state": request.state,
+				"code_challenge": request.codeChallenge,
+				"code_challenge_method": oauth.CodeChallengeMethod,
+			},
+			Email: email,
+			Error: message,
+		})
+
+		if err != nil {
+			slog.Error("failed to render consent page", "error", err)
+		}
+	}
+
+	authorizeForm := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request, ok := parseAuthorizationRequest(w, r, r.URL.Query())
+
+		if !ok {
+			return
+		}
+
+		renderConsentPage(w, 200, request, "", "")
+	})
+
+	serveMux.Handle("GET /oauth/authorize", authorizeForm)
+
+	authorize := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+
+		if err != nil {
+			http.Error(w, "Malformed form", 400)
+			return
+		}
+
+		request, ok := parseAuthorizationRequest(w, r, r.PostForm)
+
+		if !ok {
+			return
+		}
+
+		if r.PostForm.Get("decision") != "allow" {
+			redirectOauthError(w, r, request.redirectUri, request.state, oauth.ErrAccessDenied, "the user denied the request")
+			return
+		}
+
+		email := r.PostForm.Get("email")
+		ip := apiCfg.clientIP(r)
+
+		user, err := checkLogin(r.Context(), ip, email, r.PostForm.Get("password"))
+
+		var throttled *loginThrottledError
+
+		switch {
+		case errors.As(err, &throttled):
+			renderConsentPage(w, 429, request, email, "Too many failed login attempts, try again later")
+			return
+		case errors.Is(err, errInvalidCredentials):
+			renderConsentPage(w, 401, request, email, errInvalidCredentials.Error())
+			return
+		case err != nil:
+			logRequestError(r, err)
+			renderConsentPage(w, 500, request, email, genericErrorMessage)
+			return
+		}
+
+		if user.TotpEnabledAt.Valid {
+			code := strings.TrimSpace(r.PostForm.Get("code"))
+			recoveryCode := ""
+
+			// Recovery codes are typed in the same field
+			if len(code) != 6 {
+				code, recoveryCode = "", code
+			}
+
+			ok, err := checkSecondFactor(r.Context(), user, code, recoveryCode)
+
+			if err != nil {
+				logRequestError(r, err)
+				renderConsentPage(w, 500, request, email, genericErrorMessage)
+				return
+			}
+
+			if !ok {
+				apiCfg.metrics.loginFailures.Inc("invalid_second_factor")
+				ipLoginLimiter.Failure(ip)
+				err = recordFailedLogin(r.Context(), user.ID)
+
+				if err != nil {
+					logRequestError(r, err)
+					renderConsentPage(w, 500, request, email, genericErrorMessage)
+					return
+				}
+
+				renderConsentPage(w, 401, request, email, "Invalid two-factor code")
+				return
+			}
+		}
+
+		err = dbQueries.ResetFailedLogins(r.Context(), user.ID)
+
+		if err != nil {
+			logRequestError(r, err)
+			renderConsentPage(w, 500, request, email, genericErrorMessage)
+			return
+		}
+
+		code, err := auth.MakeRefreshToken()
+
+		if err == nil {
+			err = dbQueries.CreateOauthAuthorizationCode(r.Context(), database.CreateOauthAuthorizationCodeParams{
+				CodeHash: auth.HashToken(code),
+				ClientID: request.client.ID,
+				UserID: user.ID,
+				RedirectUri: request.redirectUri,
+				Scopes: auth.FormatScopes(request.scopes),
+				CodeChallenge: request.codeChallenge,
+				ExpiresAt: time.Now().Add(oauthCodeLifetime),
+			})
+		}
+
+		if err != nil {
+			redirectOauthError(w, r, request.redirectUri, request.state, oauth.ErrServerError, "")
+			return
+		}
+
+		http.Redirect(w, r, oauth.RedirectURL(request.redirectUri, url.Values{
+			"code": {code},
+			"state": {request.state},
+		}), http.StatusSeeOther)
+	})
+
+	serveMux.Handle("POST /oauth/authorize", authorize)
+
+	// authenticateOauthClient reads the client credentials of token and
+	// revocation requests, from HTTP basic auth or the form. Public clients
+	// only send their client_id.
+	authenticateOauthClient := func(r *http.Request) (database.OauthClient, *oauth.Error) {
+		clientIDParam, clientSecret, hasBasicAuth := r.BasicAuth()
+
+		if !hasBasicAuth {
+			clientIDParam = r.PostForm.Get("client_id")
+			clientSecret = r.PostForm.Get("client_secret")
+		}
+
+		invalidClient := &oauth.Error{Code: oauth.ErrInvalidClient, Description: "client authentication failed"}
+
+		clientID, err := uuid.Parse(clientIDParam)
+
+		if err != nil {
+			return database.OauthClient{}, invalidClient
+		}
+
+		client, err := dbQueries.GetOauthClient(r.Context(), clientID)
+
+		if err != nil {
+			return database.OauthClient{}, invalidClient
+		}
+
+		if client.HashedSecret.Valid {
+			hashedSecret := auth.HashToken(clientSecret)
+
+			if subtle.ConstantTimeCompare([]byte(hashedSecret), []byte(client.HashedSecret.String)) != 1 {
+				return database.OauthClient{}, invalidClient
+			}
+		} else if clientSecret != "" {
+			return database.OauthClient{}, invalidClient
+		}
+
+		return client, nil
+	}
+
+	respondWithOauthError := func(w http.ResponseWriter, oauthErr *oauth.Error) {
+		status := 400
+
+		if oauthErr.Code == oauth.ErrInvalidClient {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+			status = 401
+		}
+
+		if oauthErr.Code == oauth.ErrServerError {
+			status = 500
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		utils.RespondWithJSon(w, status, oauthErr)
+	}
+
+	type oauthTokenResponse struct {
+		AccessToken		string	`json:"access_token"`
+		TokenType			string	`json:"token_type"`
+		ExpiresIn			int			`json:"expires_in"`
+		RefreshToken	string	`json:"refresh_token,omitempty"`
+		Scope					string	`json:"scope"`
+	}
+
+	oauthToken := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+
+		if err != nil {
+			respondWithOauthError(w, &oauth.Error{Code: oauth.ErrInvalidRequest, Description: "malformed form"})
+			return
+		}
+
+		client, oauthErr := authenticateOauthClient(r)
+
+		if oauthErr != nil {
+			respondWithOauthError(w, oauthErr)
+			return
+		}
+
+		invalidGrant := &oauth.Error{Code: oauth.ErrInvalidGrant, Description: "the grant is invalid, expired or was issued to another client"}
+
+		var userID uuid.UUID
+		var scopes []string
+		refreshToken := ""
+
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			grant, err := dbQueries.ConsumeOauthAuthorizationCode(r.Context(), database.ConsumeOauthAuthorizationCodeParams{
+				CodeHash: auth.HashToken(r.PostForm.Get("code")),
+				ClientID: client.ID,
+			})
+
+			if err != nil || grant.RedirectUri != r.PostForm.Get("redirect_uri") {
+				respondWithOauthError(w, invalidGrant)
+				return
+			}
+
+			if !oauth.VerifyCodeChallenge(r.PostForm.Get("code_verifier"), grant.CodeChallenge) {
+				respondWithOauthError(w, &oauth.Error{Code: oauth.ErrInvalidGrant, Description: "code_verifier does not match the code challenge"})
+				return
+			}
+
+			userID = grant.UserID
+			scopes = strings.Fields(grant.Scopes)
+
+			refreshToken, err = auth.MakeRefreshToken()
+
+			if err == nil {
+				err = dbQueries.CreateOauthRefreshToken(r.Context(), database.CreateOauthRefreshTokenParams{
+					Token: auth.HashToken(refreshToken),
+					UserID: userID,
+					ExpiresAt: time.Now().Add(oauthRefreshTokenLifetime),
+					ClientID: uuid.NullUUID{UUID: client.ID, Valid: true},
+					Scopes: sql.NullString{String: grant.Scopes, Valid: true},
+				})
+			}
+
+			if err != nil {
+				respondWithOauthError(w, &oauth.Error{Code: oauth.ErrServerError})
+				return
+			}
+		case "refresh_token":
+			storedToken, err := dbQueries.GetOauthRefreshToken(r.Context(), database.GetOauthRefreshTokenParams{
+				Token: auth.HashToken(r.PostForm.Get("refresh_token")),
+				ClientID: uuid.NullUUID{UUID: client.ID, Valid: true},
+			})
+
+			if err != nil || storedToken.RevokedAt.Valid || time.Now().After(storedToken.ExpiresAt) {
+				respondWithOauthError(w, invalidGrant)
+				return
+			}
+
+			userID = storedToken.UserID
+			scopes = strings.Fields(storedToken.Scopes.String)
+
+			// A client may ask for fewer scopes than it was granted
+			if requested := r.PostForm.Get("scope"); requested != "" {
+				scopes, err = auth.ParseScopes(requested, scopes)
+
+				if err != nil {
+					respondWithOauthError(w, &oauth.Error{Code: oauth.ErrInvalidScope, Description: err.Error()})
+					return
+				}
+			}
+		default:
+			respondWithOauthError(w, &oauth.Error{Code: oauth.ErrUnsupportedGrantType})
+			return
+		}
+
+		accessToken, err := apiCfg.jwtKeys.MakeScopedJWT(userID, scopes, oauthAccessTokenLifetime)
+
+		if err != nil {
+			respondWithOauthError(w, &oauth.Error{Code: oauth.ErrServerError})
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		utils.RespondWithJSon(w, 200, oauthTokenResponse{
+			AccessToken: accessToken,
+			TokenType: "Bearer",
+			ExpiresIn: int(oauthAccessTokenLifetime.Seconds()),
+			RefreshToken: refreshToken,
+			Scope: auth.FormatScopes(scopes),
+		})
+	})
+
+	serveMux.Handle("POST /oauth/token", oauthToken)
+
+	// Access tokens are short lived JWTs, so only refresh tokens can be
+	// revoked. Unknown tokens are not an error (RFC 7009 section 2.2).
+	oauthRevoke := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+
+		if err != nil {
+			respondWithOauthError(w, &oauth.Error{Code: oauth.ErrInvalidRequest, Description: "malformed form"})
+			return
+		}
+
+		client, oauthErr := authenticateOauthClient(r)
+
+		if oauthErr != nil {
+			respondWithOauthError(w, oauthErr)
+			return
+		}
+
+		err = dbQueries.RevokeOauthRefreshToken(r.Context(), database.RevokeOauthRefreshTokenParams{
+			Token: auth.HashToken(r.PostForm.Get("token")),
+			ClientID: uuid.NullUUID{UUID: client.ID, Valid: true},
+		})
+
+		if err != nil {
+			respondWithOauthError(w, &oauth.Error{Code: oauth.ErrServerError})
+			return
+		}
+
+		w.WriteHeader(200)
+	})
+
+	serveMux.Handle("POST /oauth/revoke", oauthRevoke)
+
+	type polkaEvent struct {
+		ID		string	`json:"id"`
+		Event	string	`json:"event"`
+		Data	struct {
+			UserId			uuid.UUID		`json:"user_id"`
+			PeriodEnd		time.Time		`json:"period_end"`
+		}	`json:"data"`
+	}
+
+	// applyPolkaEvent performs the effect of a Polka event with q, which is
+	// bound to the transaction processing the event
+	applyPolkaEvent := func(ctx context.Context, q *database.Queries, payload []byte) (string, error) {
+		var event polkaEvent
+
+		err := json.Unmarshal(payload, &event)
+
+		if err != nil {
+			return "", err
+		}
+
+		if !subscription.KnownEvent(event.Event) {
+			return webhookStatusIgnored, nil
+		}
+
+		_, err = q.GetUserByID(ctx, event.Data.UserId)
+
+		if err != nil {
+			return "", err
+		}
+
+		var current *subscription.State
+
+		existing, err := q.GetSubscriptionByUser(ctx, event.Data.UserId)
+
+		if err == nil {
+			state := subscriptionState(existing)
+			current = &state
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+
+		next, err := subscription.Apply(current, subscription.Event{
+			Type: event.Event,
+			PeriodEnd: event.Data.PeriodEnd,
+		}, time.Now(), apiCfg.subscriptionGracePeriod)
+
+		if errors.Is(err, subscription.ErrNoSubscription) {
+			return webhookStatusIgnored, nil
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		_, err = q.UpsertSubscription(ctx, database.UpsertSubscriptionParams{
+			UserID: event.Data.UserId,
+			Plan: subscription.PlanChirpyRed,
+			Status: next.Status,
+			CurrentPeriodEnd: nullTime(next.PeriodEnd),
+			GracePeriodEnd: nullTime(next.GraceEnd),
+			CancelledAt: nullTime(next.CancelledAt),
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		_, err = q.SyncChirpyRedStatus(ctx, event.Data.UserId)
+
+		if err != nil {
+			return "", err
+		}
+
+		return webhookStatusProcessed, nil
+	}
+
+	webhookHandlers := map[string]func(ctx context.Context, q *database.Queries, payload []byte) (string, error){
+		"polka": applyPolkaEvent,
+	}
+
+	// processWebhookEvent applies a stored event at most once. The event is
+	// claimed, applied and marked done in one transaction, so concurrent or
+	// repeated deliveries can't apply it twice. Failures are recorded on the
+	// event so it can be replayed.
+	processWebhookEvent := func(ctx context.Context, event database.WebhookEvent) (string, error) {
+		apply, ok := webhookHandlers[event.Source]
+
+		if !ok {
+			return "", fmt.Errorf("unknown webhook source %q", event.Source)
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+
+		if err != nil {
+			return "", err
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		claimed, err := txQueries.ClaimWebhookEvent(ctx, event.ID)
+
+		if err != nil {
+			return "", err
+		}
+
+		// Another delivery of the event already handled it
+		if claimed == 0 {
+			current, err := txQueries.GetWebhookEvent(ctx, event.ID)
+			return current.Status, err
+		}
+
+		status, err := apply(ctx, txQueries, []byte(event.Payload))
+
+		if err == nil {
+			err = txQueries.FinishWebhookEvent(ctx, database.FinishWebhookEventParams{
+				Status: status,
+				ID: event.ID,
+			})
+		}
+
+		if err == nil {
+			err = tx.Commit()
+		}
+
+		if err != nil {
+			tx.Rollback()
+
+			finishErr := dbQueries.FinishWebhookEvent(ctx, database.FinishWebhookEventParams{
+				Status: webhookStatusFailed,
+				Error: sql.NullString{String: err.Error(), Valid: true},
+				ID: event.ID,
+			})
+
+			if finishErr != nil {
+				slog.ErrorContext(ctx, "failed to record failure of webhook event", "event_id", event.ID, "error", finishErr)
+			}
+
+			return webhookStatusFailed, err
+		}
+
+		return status, nil
+	}
+
+	polkaHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiCfg.polkaApiKey == "" && apiCfg.polkaVerifier == nil {
+			utils.RespondWithError(w, 401, "Polka webhooks are not configured")
+			return
+		}
+
+		if apiCfg.polkaApiKey != "" {
+			polApiKey, err := auth.GetApiKey(r.Header)
+
+			if err != nil || subtle.ConstantTimeCompare([]byte(polApiKey), []byte(apiCfg.polkaApiKey)) != 1 {
+				utils.RespondWithError(w, 401, genericErrorMessage)
+				return
+			}
+		}
+
+		// The signature covers the raw body, so it is read before decoding
+		rawBody, err := io.ReadAll(io.LimitReader(r.Body, 1 << 20))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, genericErrorMessage)
+			return
+		}
+
+		if apiCfg.polkaVerifier != nil {
+			err = apiCfg.polkaVerifier.Verify(r.Header.Get("X-Polka-Signature"), r.Header.Get("X-Polka-Timestamp"), rawBody)
+
+			if err != nil {
+				utils.RespondWithError(w, 401, err.Error())
+				return
+			}
+		}
+
+		var decodedBody polkaEvent
+
+		err = json.Unmarshal(rawBody, &decodedBody)
+
+		if err != nil {
+			utils.RespondWithJSon(w, 400, genericErrorMessage)
+			return
+		}
+
+		// Deliveries are deduplicated by their id. Without one every delivery
+		// is a new event.
+		eventID := decodedBody.ID
+		if eventID == "" {
+			eventID = uuid.NewString()
+		}
+
+		event, err := dbQueries.CreateWebhookEvent(r.Context(), database.CreateWebhookEventParams{
+			Source: "polka",
+			EventID: eventID,
+			EventType: decodedBody.Event,
+			Payload: string(rawBody),
+		})
+
+		if errors.Is(err, sql.ErrNoRows) {
+			event, err = dbQueries.GetWebhookEventByEventID(r.Context(), database.GetWebhookEventByEventIDParams{
+				Source: "polka",
+				EventID: eventID,
+			})
+		}
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		_, err = processWebhookEvent(r.Context(), event)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.RespondWithError(w, 404, genericErrorMessage)
+			return
+		}
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("POST /api/polka/webhooks", polkaHandler)
+
+	// expireSubscriptions ends subscriptions whose period and grace period
+	// are over and takes Chirpy Red away from their users
+	expireSubscriptions := func(ctx context.Context) error {
+		tx, err := db.BeginTx(ctx, nil)
+
+		if err != nil {
+			return err
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		userIDs, err := txQueries.ExpireLapsedSubscriptions(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		for _, userID := range userIDs {
+			_, err = txQueries.SyncChirpyRedStatus(ctx, userID)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			return err
+		}
+
+		if len(userIDs) > 0 {
+			slog.InfoContext(ctx, "expired subscriptions", "count", len(userIDs))
+		}
+
+		return nil
+	}
+
+	getSubscription := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type subscriptionResponse struct {
+			Plan							string			`json:"plan,omitempty"`
+			Status						string			`json:"status"`
+			Active						bool				`json:"active"`
+			CurrentPeriodEnd	*time.Time	`json:"current_period_end"`
+			GracePeriodEnd		*time.Time	`json:"grace_period_end"`
+			CancelledAt				*time.Time	`json:"cancelled_at"`
+			ValidUntil				*time.Time	`json:"valid_until"`
+		}
+
+		existing, err := dbQueries.GetSubscriptionByUser(r.Context(), getPrincipal(r).UserID)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.RespondWithJSon(w, 200, subscriptionResponse{Status: "none"})
+			return
+		}
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := subscriptionResponse{
+			Plan: existing.Plan,
+			Status: existing.Status,
+			Active: subscriptionState(existing).ActiveAt(time.Now()),
+		}
+
+		if existing.CurrentPeriodEnd.Valid {
+			response.CurrentPeriodEnd = &existing.CurrentPeriodEnd.Time
+		}
+
+		if existing.GracePeriodEnd.Valid {
+			response.GracePeriodEnd = &existing.GracePeriodEnd.Time
+		}
+
+		if existing.CancelledAt.Valid {
+			response.CancelledAt = &existing.CancelledAt.Time
+		}
+
+		if validUntil := subscriptionState(existing).ValidUntil(); !validUntil.IsZero() && response.Active {
+			response.ValidUntil = &validUntil
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("GET /api/users/me/subscription", apiCfg.middlewareAuthenticate(auth.ScopeProfileRead, getSubscription))
+
+	getEntitlements := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type entitlementsResponse struct {
+			entitlements.Entitlements
+			EditWindowSeconds	int64	`json:"edit_window_seconds"`
+		}
+
+		_, userEntitlements, err := entitlementsFor(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			utils.RespondWithError(w, 401, "user not found")
+			return
+		}
+
+		utils.RespondWithJSon(w, 200, entitlementsResponse{
+			Entitlements: userEntitlements,
+			EditWindowSeconds: int64(userEntitlements.EditWindow.Seconds()),
+		})
+	})
+
+	serveMux.Handle("GET /api/users/me/entitlements", apiCfg.middlewareAuthenticate(auth.ScopeProfileRead, getEntitlements))
+
+	type webhookEventResponse struct {
+		Id						uuid.UUID				`json:"id"`
+		Source				string					`json:"source"`
+		EventId				string					`json:"event_id"`
+		EventType			string					`json:"event_type"`
+		Payload				json.RawMessage	`json:"payload"`
+		Status				string					`json:"status"`
+		Error					string					`json:"error,omitempty"`
+		Attempts			int32						`json:"attempts"`
+		ReceivedAt		time.Time				`json:"received_at"`
+		LastAttemptAt	*time.Time			`json:"last_attempt_at"`
+	}
+
+	toWebhookEventResponse := func(event database.WebhookEvent) webhookEventResponse {
+		response := webhookEventResponse{
+			Id: event.ID,
+			Source: event.Source,
+			EventId: event.EventID,
+			EventType: event.EventType,
+			Payload: json.RawMessage(event.Payload),
+			Status: event.Status,
+			Error: event.Error.String,
+			Attempts: event.Attempts,
+			ReceivedAt: event.ReceivedAt,
+		}
+
+		if event.LastAttemptAt.Valid {
+			response.LastAttemptAt = &event.LastAttemptAt.Time
+		}
+
+		return response
+	}
+
+	listWebhookEvents := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := 50
+
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			parsed, err := strconv.Atoi(limitParam)
+
+			if err != nil || parsed < 1 || parsed > 500 {
+				utils.RespondWithError(w, 400, "limit must be between 1 and 500")
+				return
+			}
+
+			limit = parsed
+		}
+
+		events, err := dbQueries.ListWebhookEvents(r.Context(), database.ListWebhookEventsParams{
+			Status: r.URL.Query().Get("status"),
+			MaxEvents: int32(limit),
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := []webhookEventResponse{}
+		for _, event := range events {
+			response = append(response, toWebhookEventResponse(event))
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("GET /admin/webhooks/events", apiCfg.middlewareRequireRole(auth.RoleAdmin, listWebhookEvents))
+
+	getWebhookEvent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		eventID, err := uuid.Parse(r.PathValue("eventID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		event, err := dbQueries.GetWebhookEvent(r.Context(), eventID)
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		utils.RespondWithJSon(w, 200, toWebhookEventResponse(event))
+	})
+
+	serveMux.Handle("GET /admin/webhooks/events/{eventID}", apiCfg.middlewareRequireRole(auth.RoleAdmin, getWebhookEvent))
+
+	// Replaying applies the event again even if it was processed before
+	replayWebhookEvent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		eventID, err := uuid.Parse(r.PathValue("eventID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		reset, err := dbQueries.ResetWebhookEvent(r.Context(), eventID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if reset == 0 {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		event, err := dbQueries.GetWebhookEvent(r.Context(), eventID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		// The outcome, including failures, is recorded on the event
+		processWebhookEvent(r.Context(), event)
+
+		event, err = dbQueries.GetWebhookEvent(r.Context(), eventID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 200, toWebhookEventResponse(event))
+	})
+
+	serveMux.Handle("POST /admin/webhooks/events/{eventID}/replay", apiCfg.middlewareRequireRole(auth.RoleAdmin, replayWebhookEvent))
+
+	type webhookEndpointResponse struct {
+		Id									uuid.UUID		`json:"id"`
+		Url									string			`json:"url"`
+		EventTypes					[]string		`json:"event_types"`
+		Enabled							bool				`json:"enabled"`
+		ConsecutiveFailures	int32				`json:"consecutive_failures"`
+		DisabledAt					*time.Time	`json:"disabled_at"`
+		DisabledReason			string			`json:"disabled_reason,omitempty"`
+		CreatedAt						time.Time		`json:"created_at"`
+		// Only returned when the endpoint is created
+		Secret							string			`json:"secret,omitempty"`
+	}
+
+	toWebhookEndpointResponse := func(endpoint database.WebhookEndpoint) webhookEndpointResponse {
+		response := webhookEndpointResponse{
+			Id: endpoint.ID,
+			Url: endpoint.Url,
+			EventTypes: webhooks.SplitEventTypes(endpoint.EventTypes),
+			Enabled: endpoint.Enabled,
+			ConsecutiveFailures: endpoint.ConsecutiveFailures,
+			DisabledReason: endpoint.DisabledReason.String,
+			CreatedAt: endpoint.CreatedAt,
+		}
+
+		if endpoint.DisabledAt.Valid {
+			response.DisabledAt = &endpoint.DisabledAt.Time
+		}
+
+		return response
+	}
+
+	createWebhookEndpoint := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type reqBody struct {
+			Url					string		`json:"url"`
+			EventTypes	[]string	`json:"event_types"`
+		}
+
+		var decodedBody reqBody
+
+		err := json.NewDecoder(r.Body).Decode(&decodedBody)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, genericErrorMessage)
+			return
+		}
+
+		err = webhooks.ValidateURL(decodedBody.Url, apiCfg.webhooksAllowPrivate)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		eventTypes, err := webhooks.ParseEventTypes(decodedBody.EventTypes)
+
+		if err != nil {
+			utils.RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		endpointCount, err := dbQueries.CountWebhookEndpointsByUser(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if endpointCount >= int64(apiCfg.webhookMaxEndpoints) {
+			utils.RespondWithError(w, 403, fmt.Sprintf("You can have %d webhook endpoints", apiCfg.webhookMaxEndpoints))
+			return
+		}
+
+		secret, err := webhooks.NewSecret()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		endpoint, err := dbQueries.CreateWebhookEndpoint(r.Context(), database.CreateWebhookEndpointParams{
+			UserID: getPrincipal(r).UserID,
+			Url: decodedBody.Url,
+			Secret: secret,
+			EventTypes: webhooks.FormatEventTypes(eventTypes),
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := toWebhookEndpointResponse(endpoint)
+		response.Secret = endpoint.Secret
+
+		utils.RespondWithJSon(w, 201, response)
+	})
+
+	serveMux.Handle("POST /api/webhooks", apiCfg.middlewareAuthenticate(auth.ScopeWebhooksManage, createWebhookEndpoint))
+
+	listWebhookEndpoints := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoints, err := dbQueries.ListWebhookEndpointsByUser(r.Context(), getPrincipal(r).UserID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := []webhookEndpointResponse{}
+		for _, endpoint := range endpoints {
+			response = append(response, toWebhookEndpointResponse(endpoint))
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("GET /api/webhooks", apiCfg.middlewareAuthenticate(auth.ScopeWebhooksManage, listWebhookEndpoints))
+
+	// getOwnWebhookEndpoint loads the endpoint in the path, answering 404 if
+	// it doesn't belong to the caller
+	getOwnWebhookEndpoint := func(w http.ResponseWriter, r *http.Request) (database.WebhookEndpoint, bool) {
+		endpointID, err := uuid.Parse(r.PathValue("endpointID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return database.WebhookEndpoint{}, false
+		}
+
+		endpoint, err := dbQueries.GetWebhookEndpoint(r.Context(), database.GetWebhookEndpointParams{
+			ID: endpointID,
+			UserID: getPrincipal(r).UserID,
+		})
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "not found")
+			return endpoint, false
+		}
+
+		return endpoint, true
+	}
+
+	getWebhookEndpoint := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint, ok := getOwnWebhookEndpoint(w, r)
+
+		if !ok {
+			return
+		}
+
+		utils.RespondWithJSon(w, 200, toWebhookEndpointResponse(endpoint))
+	})
+
+	serveMux.Handle("GET /api/webhooks/{endpointID}", apiCfg.middlewareAuthenticate(auth.ScopeWebhooksManage, getWebhookEndpoint))
+
+	deleteWebhookEndpoint := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpointID, err := uuid.Parse(r.PathValue("endpointID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		deleted, err := dbQueries.DeleteWebhookEndpoint(r.Context(), database.DeleteWebhookEndpointParams{
+			ID: endpointID,
+			UserID: getPrincipal(r).UserID,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if deleted == 0 {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("DELETE /api/webhooks/{endpointID}", apiCfg.middlewareAuthenticate(auth.ScopeWebhooksManage, deleteWebhookEndpoint))
+
+	// Re-enabling resumes the deliveries that were pending when the endpoint
+	// was disabled
+	enableWebhookEndpoint := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint, ok := getOwnWebhookEndpoint(w, r)
+
+		if !ok {
+			return
+		}
+
+		_, err := dbQueries.EnableWebhookEndpoint(r.Context(), database.EnableWebhookEndpointParams{
+			ID: endpoint.ID,
+			UserID: endpoint.UserID,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("POST /api/webhooks/{endpointID}/enable", apiCfg.middlewareAuthenticate(auth.ScopeWebhooksManage, enableWebhookEndpoint))
+
+	type webhookDeliveryResponse struct {
+		Id									uuid.UUID		`json:"id"`
+		EventId							uuid.UUID		`json:"event_id"`
+		EventType						string			`json:"event_type"`
+		Status							string			`json:"status"`
+		Attempts						int32				`json:"attempts"`
+		CreatedAt						time.Time		`json:"created_at"`
+		NextAttemptAt				*time.Time	`json:"next_attempt_at"`
+		LastAttemptAt				*time.Time	`json:"last_attempt_at"`
+		LastResponseStatus	int32				`json:"last_response_status,omitempty"`
+		LastError						string			`json:"last_error,omitempty"`
+		DeliveredAt					*time.Time	`json:"delivered_at"`
+	}
+
+	toWebhookDeliveryResponse := func(delivery database.WebhookDelivery) webhookDeliveryResponse {
+		response := webhookDeliveryResponse{
+			Id: delivery.ID,
+			EventId: delivery.EventID,
+			EventType: delivery.EventType,
+			Status: delivery.Status,
+			Attempts: delivery.Attempts,
+			CreatedAt: delivery.CreatedAt,
+			LastResponseStatus: delivery.LastResponseStatus.Int32,
+			LastError: delivery.LastError.String,
+		}
+
+		if delivery.Status == webhookDeliveryPending {
+			response.NextAttemptAt = &delivery.NextAttemptAt
+		}
+
+		if delivery.LastAttemptAt.Valid {
+			response.LastAttemptAt = &delivery.LastAttemptAt.Time
+		}
+
+		if delivery.DeliveredAt.Valid {
+			response.DeliveredAt = &delivery.DeliveredAt.Time
+		}
+
+		return response
+	}
+
+	listWebhookDeliveries := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint, ok := getOwnWebhookEndpoint(w, r)
+
+		if !ok {
+			return
+		}
+
+		deliveries, err := dbQueries.ListWebhookDeliveriesByEndpoint(r.Context(), database.ListWebhookDeliveriesByEndpointParams{
+			EndpointID: endpoint.ID,
+			MaxDeliveries: 100,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := []webhookDeliveryResponse{}
+		for _, delivery := range deliveries {
+			response = append(response, toWebhookDeliveryResponse(delivery))
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("GET /api/webhooks/{endpointID}/deliveries", apiCfg.middlewareAuthenticate(auth.ScopeWebhooksManage, listWebhookDeliveries))
+
+	getWebhookDelivery := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type attemptResponse struct {
+			AttemptedAt			time.Time	`json:"attempted_at"`
+			ResponseStatus	int32			`json:"response_status,omitempty"`
+			Error						string		`json:"error,omitempty"`
+			DurationMs			int32			`json:"duration_ms"`
+		}
+
+		type deliveryResponse struct {
+			webhookDeliveryResponse
+			Payload		json.RawMessage		`json:"payload"`
+			Log				[]attemptResponse	`json:"log"`
+		}
+
+		endpoint, ok := getOwnWebhookEndpoint(w, r)
+
+		if !ok {
+			return
+		}
+
+		deliveryID, err := uuid.Parse(r.PathValue("deliveryID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		delivery, err := dbQueries.GetWebhookDelivery(r.Context(), database.GetWebhookDeliveryParams{
+			ID: deliveryID,
+			EndpointID: endpoint.ID,
+		})
+
+		if err != nil {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		attempts, err := dbQueries.ListWebhookDeliveryAttempts(r.Context(), delivery.ID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		response := deliveryResponse{
+			webhookDeliveryResponse: toWebhookDeliveryResponse(delivery),
+			Payload: json.RawMessage(delivery.Payload),
+			Log: []attemptResponse{},
+		}
+
+		for _, attempt := range attempts {
+			response.Log = append(response.Log, attemptResponse{
+				AttemptedAt: attempt.AttemptedAt,
+				ResponseStatus: attempt.ResponseStatus.Int32,
+				Error: attempt.Error.String,
+				DurationMs: attempt.DurationMs,
+			})
+		}
+
+		utils.RespondWithJSon(w, 200, response)
+	})
+
+	serveMux.Handle("GET /api/webhooks/{endpointID}/deliveries/{deliveryID}", apiCfg.middlewareAuthenticate(auth.ScopeWebhooksManage, getWebhookDelivery))
+
+	// attemptWebhookDelivery sends one delivery and records the outcome.
+	// Failures are retried with exponential backoff until webhooks.MaxAttempts,
+	// and an endpoint is disabled after webhookDisableAfter failed attempts in
+	// a row.
+	attemptWebhookDelivery := func(ctx context.Context, delivery database.ListDueWebhookDeliveriesRow) error {
+		now := time.Now()
+
+		result := webhooks.Send(ctx, apiCfg.webhookClient, webhooks.Delivery{
+			ID: delivery.ID.String(),
+			EventType: delivery.EventType,
+			URL: delivery.Url,
+			Secret: delivery.Secret,
+			Payload: []byte(delivery.Payload),
+		}, now)
+
+		if result.OK() {
+			apiCfg.metrics.webhookAttempts.Inc("delivered")
+		} else {
+			apiCfg.metrics.webhookAttempts.Inc("failed")
+		}
+
+		responseStatus := sql.NullInt32{Int32: int32(result.StatusCode), Valid: result.StatusCode != 0}
+		resultError := sql.NullString{}
+		if result.Err != nil {
+			resultError = sql.NullString{String: result.Err.Error(), Valid: true}
+		}
+
+		err := dbQueries.CreateWebhookDeliveryAttempt(ctx, database.CreateWebhookDeliveryAttemptParams{
+			DeliveryID: delivery.ID,
+			ResponseStatus: responseStatus,
+			Error: resultError,
+			DurationMs: int32(result.Duration.Milliseconds()),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		status := webhookDeliveryDelivered
+		nextAttemptAt := now
+
+		if !result.OK() {
+			status = webhookDeliveryPending
+			nextAttemptAt = now.Add(webhooks.Backoff(int(delivery.Attempts) + 1))
+
+			if int(delivery.Attempts) + 1 >= webhooks.MaxAttempts {
+				status = webhookDeliveryFailed
+			}
+		}
+
+		err = dbQueries.FinishWebhookDeliveryAttempt(ctx, database.FinishWebhookDeliveryAttemptParams{
+			Status: status,
+			NextAttemptAt: nextAttemptAt,
+			LastResponseStatus: responseStatus,
+			LastError: resultError,
+			ID: delivery.ID,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if result.OK() {
+			return dbQueries.ResetWebhookEndpointFailures(ctx, delivery.EndpointID)
+		}
+
+		failures, err := dbQueries.RecordWebhookEndpointFailure(ctx, delivery.EndpointID)
+
+		if err != nil {
+			return err
+		}
+
+		if int(failures) >= apiCfg.webhookDisableAfter {
+			slog.WarnContext(ctx, "disabling webhook endpoint", "endpoint_id", delivery.EndpointID, "failed_deliveries", failures)
+
+			return dbQueries.DisableWebhookEndpoint(ctx, database.DisableWebhookEndpointParams{
+				Reason: sql.NullString{String: fmt.Sprintf("%d failed deliveries in a row", failures), Valid: true},
+				ID: delivery.EndpointID,
+			})
+		}
+
+		return nil
+	}
+
+	// fanOutWebhookEvent queues a delivery of an outbox event for each of its
+	// owner's endpoints subscribed to it. The event leaves the outbox in the
+	// same transaction, so another instance can't queue it again.
+	fanOutWebhookEvent := func(ctx context.Context, event database.WebhookOutbox) error {
+		tx, err := db.BeginTx(ctx, nil)
+
+		if err != nil {
+			return err
+		}
+
+		defer tx.Rollback()
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		taken, err := txQueries.DeleteWebhookOutboxEvent(ctx, event.ID)
+
+		if err != nil || taken == 0 {
+			return err
+		}
+
+		_, err = txQueries.EnqueueWebhookDeliveries(ctx, database.EnqueueWebhookDeliveriesParams{
+			EventID: event.ID,
+			EventType: event.EventType,
+			Payload: event.Payload,
+			OwnerID: event.UserID,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	// dispatchWebhooks fans out new events, then sends the deliveries that
+	// are due. Each delivery is leased first so another instance doesn't send
+	// it at the same time.
+	dispatchWebhooks := func(ctx context.Context) error {
+		events, err := dbQueries.ListWebhookOutboxEvents(ctx, 100)
+
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			err = fanOutWebhookEvent(ctx, event)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		due, err := dbQueries.ListDueWebhookDeliveries(ctx, 50)
+
+		if err != nil {
+			return err
+		}
+
+		for _, delivery := range due {
+			claimed, err := dbQueries.ClaimWebhookDelivery(ctx, database.ClaimWebhookDeliveryParams{
+				LeaseUntil: time.Now().Add(5 * time.Minute),
+				ID: delivery.ID,
+			})
+
+			if err != nil {
+				return err
+			}
+
+			if claimed == 0 {
+				continue
+			}
+
+			err = attemptWebhookDelivery(ctx, delivery)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	lockoutsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type lockedAccount struct {
+			Id								uuid.UUID	`json:"id"`
+			Email							string		`json:"email"`
+			FailedLoginCount	int32			`json:"failed_login_count"`
+			LastFailedLoginAt	time.Time	`json:"last_failed_login_at"`
+			LockedUntil				time.Time	`json:"locked_until"`
+		}
+
+		type blockedAddress struct {
+			IP						string		`json:"ip"`
+			Failures			int				`json:"failures"`
+			BlockedUntil	time.Time	`json:"blocked_until"`
+		}
+
+		type response struct {
+			Accounts	[]lockedAccount		`json:"accounts"`
+			IPs				[]blockedAddress	`json:"ips"`
+		}
+
+		lockedUsers, err := dbQueries.ListLockedUsers(r.Context())
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		res := response{
+			Accounts: []lockedAccount{},
+			IPs: []blockedAddress{},
+		}
+
+		for _, user := range lockedUsers {
+			res.Accounts = append(res.Accounts, lockedAccount{
+				Id: user.ID,
+				Email: user.Email,
+				FailedLoginCount: user.FailedLoginCount,
+				LastFailedLoginAt: user.LastFailedLoginAt.Time,
+				LockedUntil: user.LockedUntil.Time,
+			})
+		}
+
+		for _, block := range ipLoginLimiter.Blocked() {
+			res.IPs = append(res.IPs, blockedAddress{
+				IP: block.Key,
+				Failures: block.Failures,
+				BlockedUntil: block.BlockedUntil,
+			})
+		}
+
+		utils.RespondWithJSon(w, 200, res)
+	})
+
+	serveMux.Handle("GET /admin/lockouts", apiCfg.middlewareRequireRole(auth.RoleModerator, lockoutsHandler))
+
+	unlockHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(r.PathValue("userID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		err = dbQueries.ResetFailedLogins(r.Context(), userID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("DELETE /admin/lockouts/{userID}", apiCfg.middlewareRequireRole(auth.RoleModerator, unlockHandler))
+
+	type adminUserResponse struct {
+		Id								uuid.UUID		`json:"id"`
+		CreatedAt					time.Time		`json:"created_at"`
+		UpdatedAt					time.Time		`json:"updated_at"`
+		Email							string			`json:"email"`
+		EmailVerified			bool				`json:"email_verified"`
+		IsChirpyRed				bool				`json:"is_chirpy_red"`
+		Role							string			`json:"role"`
+		TwoFactorEnabled	bool				`json:"two_factor_enabled"`
+		LockedUntil				*time.Time	`json:"locked_until"`
+	}
+
+	toAdminUserResponse := func(user database.User) adminUserResponse {
+		response := adminUserResponse{
+			Id: user.ID,
+			CreatedAt: user.CreatedAt,
+			UpdatedAt: user.UpdatedAt,
+			Email: user.Email,
+			EmailVerified: user.EmailVerifiedAt.Valid,
+			IsChirpyRed: user.IsChirpyRed,
+			Role: user.Role,
+			TwoFactorEnabled: user.TotpEnabledAt.Valid,
+		}
+
+		if user.LockedUntil.Valid && time.Now().Before(user.LockedUntil.Time) {
+			response.LockedUntil = &user.LockedUntil.Time
+		}
+
+		return response
+	}
+
+	// likeEscaper makes a search match its text literally in LIKE patterns
+	likeEscaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+	listAdminUsers := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type response struct {
+			Users	[]adminUserResponse	`json:"users"`
+			Total	int64								`json:"total"`
+		}
+
+		limit := 50
+		offset := 0
+
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			parsed, err := strconv.Atoi(limitParam)
+
+			if err != nil || parsed < 1 || parsed > 500 {
+				utils.RespondWithError(w, 400, "limit must be between 1 and 500")
+				return
+			}
+
+			limit = parsed
+		}
+
+		if offsetParam := r.URL.Query().Get("offset"); offsetParam != "" {
+			parsed, err := strconv.Atoi(offsetParam)
+
+			if err != nil || parsed < 0 || parsed > math.MaxInt32 {
+				utils.RespondWithError(w, 400, "offset must be a positive number")
+				return
+			}
+
+			offset = parsed
+		}
+
+		search := likeEscaper.Replace(r.URL.Query().Get("search"))
+
+		users, err := dbQueries.ListUsers(r.Context(), database.ListUsersParams{
+			Search: search,
+			MaxUsers: int32(limit),
+			Skip: int32(offset),
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		total, err := dbQueries.CountUsers(r.Context(), search)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		res := response{Users: []adminUserResponse{}, Total: total}
+
+		for _, user := range users {
+			res.Users = append(res.Users, toAdminUserResponse(user))
+		}
+
+		utils.RespondWithJSon(w, 200, res)
+	})
+
+	serveMux.Handle("GET /admin/users", apiCfg.middlewareRequireRole(auth.RoleModerator, listAdminUsers))
+
+	getAdminUser := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type subscriptionResponse struct {
+			Plan							string			`json:"plan"`
+			Status						string			`json:"status"`
+			CurrentPeriodEnd	*time.Time	`json:"current_period_end"`
+		}
+
+		type sessionResponse struct {
+			CreatedAt	time.Time		`json:"created_at"`
+			ExpiresAt	time.Time		`json:"expires_at"`
+			ClientId	*uuid.UUID	`json:"client_id"`
+		}
+
+		type auditEntryResponse struct {
+			Id				uuid.UUID		`json:"id"`
+			CreatedAt		time.Time		`json:"created_at"`
+			ActorId			*uuid.UUID		`json:"actor_id"`
+			ViaAdminToken	bool			`json:"via_admin_token"`
+			Action			string			`json:"action"`
+			Details			json.RawMessage	`json:"details"`
+		}
+
+		type response struct {
+			adminUserResponse
+			Subscription	*subscriptionResponse	`json:"subscription"`
+			Sessions			[]sessionResponse			`json:"sessions"`
+			Chirps				int64									`json:"chirps"`
+			Audit					[]auditEntryResponse	`json:"audit"`
+		}
+
+		userID, err := uuid.Parse(r.PathValue("userID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		user, err := dbQueries.GetUserByID(r.Context(), userID)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.RespondWithError(w, 404, "not found")
+			return
+		}
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		res := response{
+			adminUserResponse: toAdminUserResponse(user),
+			Sessions: []sessionResponse{},
+			Audit: []auditEntryResponse{},
+		}
+
+		sub, err := dbQueries.GetSubscriptionByUser(r.Context(), userID)
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		if err == nil {
+			res.Subscription = &subscriptionResponse{Plan: sub.Plan, Status: sub.Status}
+
+			if sub.CurrentPeriodEnd.Valid {
+				res.Subscription.CurrentPeriodEnd = &sub.CurrentPeriodEnd.Time
+			}
+		}
+
+		sessions, err := dbQueries.ListActiveSessionsByUser(r.Context(), userID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		for _, session := range sessions {
+			entry := sessionResponse{CreatedAt: session.CreatedAt, ExpiresAt: session.ExpiresAt}
+
+			if session.ClientID.Valid {
+				entry.ClientId = &session.ClientID.UUID
+			}
+
+			res.Sessions = append(res.Sessions, entry)
+		}
+
+		res.Chirps, err = dbQueries.CountChirpsByUser(r.Context(), userID)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		entries, err := dbQueries.ListAdminAuditEntriesByTarget(r.Context(), database.ListAdminAuditEntriesByTargetParams{
+			TargetUserID: userID,
+			MaxEntries: 50,
+		})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+
+		for _, entry := range entries {
+			audit := auditEntryResponse{
+				Id: entry.ID,
+				CreatedAt: entry.CreatedAt,
+				ViaAdminToken: entry.ViaAdminToken,
+				Action: entry.Action,
+				Details: json.RawMessage(entry.Details),
+			}
+
+			if entry.ActorID.Valid {
+				audit.ActorId = &entry.ActorID.UUID
+			}
+
+			res.Audit = append(res.Audit, audit)
+		}
+
+		utils.RespondWithJSon(w, 200, res)
+	})
+
+	serveMux.Handle("GET /admin/users/{userID}", apiCfg.middlewareRequireRole(auth.RoleModerator, getAdminUser))
+
+	// loadAdminTarget starts the transaction an admin action runs in and
+	// loads the user named in the path. It answers the request itself and
+	// returns false when it can't.
+	loadAdminTarget := func(w http.ResponseWriter, r *http.Request) (*sql.Tx, *database.Queries, database.User, bool) {
+		userID, err := uuid.Parse(r.PathValue("userID"))
+
+		if err != nil {
+			utils.RespondWithError(w, 400, "invalid id")
+			return nil, nil, database.User{}, false
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return nil, nil, database.User{}, false
+		}
+
+		txQueries := dbQueries.WithObservedTx(tx)
+
+		user, err := txQueries.GetUserByID(r.Context(), userID)
+
+		if err != nil {
+			tx.Rollback()
+
+			if errors.Is(err, sql.ErrNoRows) {
+				utils.RespondWithError(w, 404, "not found")
+			} else {
+				respondWithInternalError(w, r, err)
+			}
+
+			return nil, nil, database.User{}, false
+		}
+
+		return tx, txQueries, user, true
+	}
+
+	// auditAdminAction records what the caller did to target, in the
+	// action's transaction so neither is kept without the other. It refuses
+	// to record an action nobody took, which fails the action too.
+	auditAdminAction := func(r *http.Request, q *database.Queries, action string, target uuid.UUID, details map[string]any) error {
+		caller := getPrincipal(r)
+
+		if caller.UserID == uuid.Nil {
+			return errors.New("admin action without an authenticated caller")
+		}
+
+		encoded, err := json.Marshal(details)
+
+		if err != nil {
+			return err
+		}
 
-		var decodedInput Input
+		return q.CreateAdminAuditEntry(r.Context(), database.CreateAdminAuditEntryParams{
+			ActorID: uuid.NullUUID{UUID: caller.UserID, Valid: true},
+			Action: action,
+			TargetUserID: target,
+			Details: string(encoded),
+			ViaAdminToken: caller.AdminToken,
+		})
+	}
 
-		err := decoder.Decode(&decodedInput)
+	// isLastAdmin reports whether user is the only admin left, who can't be
+	// demoted or deleted. The admins stay locked until the transaction ends,
+	// so two admins removed at once can't each count the other.
+	isLastAdmin := func(ctx context.Context, q *database.Queries, user database.User) (bool, error) {
+		admins, err := q.LockUsersWithRole(ctx, auth.RoleAdmin)
 
 		if err != nil {
-			utils.RespondWithError(w, 400, "Wrong input data")
-			return
+			return false, err
 		}
 
-		bearerToken, err := auth.GetBearerToken(&r.Header)
+		return len(admins) == 1 && admins[0] == user.ID, nil
+	}
 
-		if err != nil {
-			utils.RespondWithError(w, 401, genericErrorMessage)
+	// Like accounts created by OIDC logins, the account has no usable
+	// password until the user sets one with the emailed token
+	forcePasswordReset := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tx, txQueries, user, ok := loadAdminTarget(w, r)
+
+		if !ok {
 			return
 		}
 
-		userId, err := auth.ValidateJWT(bearerToken, apiCfg.jwtSecret)
+		defer tx.Rollback()
+
+		randomPassword, err := auth.MakeRefreshToken()
 
 		if err != nil {
-			utils.RespondWithError(w, 401, err.Error())
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		hashedPassword, err := auth.HashPassword(decodedInput.Password)
-		
+		hashedPassword, err := apiCfg.passwords.Hash(randomPassword)
+
 		if err != nil {
-			utils.RespondWithError(w, 500, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		user, err := dbQueries.UpdateUser(r.Context(), database.UpdateUserParams{
-			ID: userId,
-			Email: decodedInput.Email,
+		err = txQueries.UpdateUserPassword(r.Context(), database.UpdateUserPasswordParams{
+			ID: user.ID,
 			HashedPassword: hashedPassword,
 		})
 
 		if err != nil {
-			utils.RespondWithError(w, 500, "a user with that email already exists")
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		type UpdateUserResponse struct {
-			Email			string		`json:"email"`
-		}
+		err = revokeCredentials(r.Context(), txQueries, user.ID)
 
-		utils.RespondWithJSon(w, 200, UpdateUserResponse{
-			Email: user.Email,
-		})
-	})
-	serveMux.Handle("PUT /api/users", apiCfg.middlewareMetricsInc(updateUser))
-	
-	login := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		type body struct {
-			Email							string	`json:"email"`
-			Password					string	`json:"password"`
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
 		}
 
-		type sucessResponse struct {
-			Id						uuid.UUID	`json:"id"`
-			UpdatedAt			time.Time	`json:"updated_at"`
-			CreatedAt			time.Time	`json:"created_at"`
-			Email					string		`json:"email"`
-			Token					string		`json:"token"`
-			RefreshToken	string		`json:"refresh_token"`
-			IsChirpyRed		bool			`json:"is_chirpy_red"`
-		}
+		err = txQueries.InvalidatePasswordResetTokens(r.Context(), user.ID)
 
-		decoder := json.NewDecoder(r.Body)
-		
-		var decodedBody body
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
 
-		err := decoder.Decode(&decodedBody)
+		resetToken, err := createPasswordResetToken(r.Context(), txQueries, user.ID)
 
 		if err != nil {
-			utils.RespondWithError(w, 400, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		user, err := dbQueries.GetUser(r.Context(), decodedBody.Email)	
+		err = auditAdminAction(r, txQueries, "force_password_reset", user.ID, map[string]any{})
 
 		if err != nil {
-			utils.RespondWithError(w, 401, "Invalid email or password")
+			respondWithInternalError(w, r, err)
+			return
 		}
 
-		err = auth.CheckPasswordHash(decodedBody.Password, user.HashedPassword)
+		err = tx.Commit()
 
 		if err != nil {
-			utils.RespondWithError(w, 401, "Invalid email or password")
+			respondWithInternalError(w, r, err)
+			return
 		}
 
-		jwtExpiration := time.Duration(3600) * time.Second
-
-		if jwtExpiration == 0 {
-			jwtExpiration = time.Duration(1) * time.Hour
+		message := mail.Message{
+			From: apiCfg.mailFrom,
+			To: user.Email,
+			Subject: "Your Chirpy password was reset",
+			Body: fmt.Sprintf(
+				"An administrator reset the password of your Chirpy account and signed you out everywhere.\n\n" +
+				"Your reset token is: %s\n\n" +
+				"Send it with your new password to POST /api/password/reset within %s. " +
+				"Afterwards, use POST /api/password/forgot to get a new one.\n",
+				resetToken, passwordResetTokenLifetime,
+			),
 		}
 
-		token, err := auth.MakeJWT(user.ID, apiCfg.jwtSecret, jwtExpiration)
+		sendEmail(r.Context(), message)
 
-		if err != nil {
-			utils.RespondWithJSon(w, 500, genericErrorMessage)
+		utils.RespondWithJSon(w, 204, nil)
+	})
+
+	serveMux.Handle("POST /admin/users/{userID}/password-reset", apiCfg.middlewareRequireRole(auth.RoleAdmin, forcePasswordReset))
+
+	// Signs the user out everywhere, including access tokens and API keys
+	revokeUserSessions := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tx, txQueries, user, ok := loadAdminTarget(w, r)
+
+		if !ok {
 			return
 		}
 
+		defer tx.Rollback()
 
-		refreshTokenExpiration := time.Now().Add(60 * 24 * time.Hour)
-
-		refreshToken, err := auth.MakeRefreshToken()
+		err := revokeCredentials(r.Context(), txQueries, user.ID)
 
 		if err != nil {
-			utils.RespondWithError(w, 500, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		_, err = dbQueries.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
-			Token: sql.NullString{String: refreshToken, Valid: true},
-			UserID: uuid.NullUUID{UUID: user.ID, Valid: true},
-			ExpiresAt: sql.NullTime{Time: refreshTokenExpiration, Valid: true},
-		})
+		err = auditAdminAction(r, txQueries, "revoke_sessions", user.ID, map[string]any{})
 
 		if err != nil {
-			utils.RespondWithError(w, 500, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		response := sucessResponse{
-			Id: user.ID,
-			CreatedAt: user.CreatedAt,
-			UpdatedAt: user.UpdatedAt,
-			Email: user.Email,
-			Token: token,
-			RefreshToken: refreshToken,
-			IsChirpyRed: user.IsChirpyRed,
+		err = tx.Commit()
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
 		}
 
-		utils.RespondWithJSon(w, 200, response)
+		utils.RespondWithJSon(w, 204, nil)
 	})
 
-	serveMux.Handle("POST /api/login", apiCfg.middlewareMetricsInc(login))
+	serveMux.Handle("DELETE /admin/users/{userID}/sessions", apiCfg.middlewareRequireRole(auth.RoleAdmin, revokeUserSessions))
 
-	getChirps := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		type successResponse struct {
-			Id				uuid.UUID	`json:"id"`
-			UserId		uuid.UUID	`json:"user_id"`
-			CreatedAt time.Time `json:"created_at"`
-			UpdatedAt time.Time `json:"updated_at"`
-			Body			string		`json:"body"`
+	// The manual status holds until the user's subscription next changes
+	setUserChirpyRed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			IsChirpyRed	*bool	`json:"is_chirpy_red"`
 		}
 
-		type response []successResponse
-
-		searchByAuthorId := r.URL.Query().Get("author_id");
+		var decodedBody body
 
-		var chirps []database.Chirp
-		if searchByAuthorId == "" {
-			chirps, err = dbQueries.GetChirps(r.Context())
-			if err != nil {
-				utils.RespondWithError(w, 500, genericErrorMessage)
-				return
-			}
-		} else {
-			authorId, err := uuid.Parse(searchByAuthorId)
-			if err != nil {
-				utils.RespondWithError(w, 400, genericErrorMessage)
-				return
-			}
-			chirps, err = dbQueries.GetChirpsByUserID(r.Context(), authorId)
+		err := json.NewDecoder(r.Body).Decode(&decodedBody)
 
-			if err != nil {
-				utils.RespondWithError(w, 500, genericErrorMessage)
-				return
-			}
+		if err != nil || decodedBody.IsChirpyRed == nil {
+			utils.RespondWithError(w, 400, "Wrong input data")
+			return
 		}
 
-		sort_order := r.URL.Query().Get("sort");
+		tx, txQueries, user, ok := loadAdminTarget(w, r)
 
-		if (sort_order == "desc") {
-			sort.Slice(chirps, func(i, j int) bool {
-				return time.Time(chirps[i].CreatedAt).After(time.Time(chirps[j].CreatedAt))
-			})
-		}
-		
-		var chirpList response
-		for i := range(len(chirps)) {
-			chirp := chirps[i]
-			chirpList = append(chirpList, successResponse{
-				Id: chirp.ID,
-				UserId: chirp.UserID,
-				CreatedAt: chirp.CreatedAt,
-				UpdatedAt: chirp.UpdatedAt,
-				Body: chirp.Body,
-			})
+		if !ok {
+			return
 		}
 
-		utils.RespondWithJSon(w, 200, &chirpList)
-	})
-
-	serveMux.Handle("GET /api/chirps", apiCfg.middlewareMetricsInc(getChirps))
-
-	deleteChirp := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		chirpID := r.PathValue("chirpID")
+		defer tx.Rollback()
 
-		bearerToken, err := auth.GetBearerToken(&r.Header)
+		updated, err := txQueries.SetChirpyRed(r.Context(), database.SetChirpyRedParams{
+			IsChirpyRed: *decodedBody.IsChirpyRed,
+			ID: user.ID,
+		})
 
 		if err != nil {
-			utils.RespondWithError(w, 401, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		userID, err := auth.ValidateJWT(bearerToken, apiCfg.jwtSecret)
+		err = auditAdminAction(r, txQueries, "set_chirpy_red", user.ID, map[string]any{
+			"from": user.IsChirpyRed,
+			"to": updated.IsChirpyRed,
+		})
 
-		parsedChirpID, err := uuid.Parse(chirpID)
-	
 		if err != nil {
-			utils.RespondWithError(w, 400, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		chirp, err := dbQueries.GetChirp(r.Context(), parsedChirpID)
-
-		if err != nil {
-			utils.RespondWithError(w, 404, genericErrorMessage)
-			return
-		}
-		if userID != chirp.UserID {
-			utils.RespondWithError(w, 403, "Unauthorized")
-			return
-		}
+		err = tx.Commit()
 
-		err = dbQueries.DeleteChirp(r.Context(), chirp.ID)
 		if err != nil {
-			utils.RespondWithError(w, 404, "not found")
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		utils.RespondWithJSon(w, 204, nil)
+		utils.RespondWithJSon(w, 200, toAdminUserResponse(updated))
 	})
-	
-	serveMux.Handle("DELETE /api/chirps/{chirpID}", apiCfg.middlewareMetricsInc(deleteChirp))
-
-	getChirp := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		chirpID := r.PathValue("chirpID")
 
-		uChirpID, err := uuid.Parse(chirpID)
+	serveMux.Handle("PUT /admin/users/{userID}/chirpy-red", apiCfg.middlewareRequireRole(auth.RoleAdmin, setUserChirpyRed))
 
-		if err != nil {
-			utils.RespondWithError(w, 400, "invalid id")
-			return
+	setUserRole := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type body struct {
+			Role	string	`json:"role"`
 		}
-		
-		chirp, err := dbQueries.GetChirp(r.Context(), uChirpID)
 
-		if err != nil {
-			utils.RespondWithError(w, 404, "user not found")
-			return
-		}
+		var decodedBody body
 
-		type successResponse struct {
-			Id				uuid.UUID	`json:"id"`
-			CreatedAt	time.Time `json:"created_at"`
-			UpdatedAt time.Time	`json:"updated_at"`
-			Body 			string 		`json:"body"`	
-			UserId 		uuid.UUID `json:"user_id"`
-		}
+		err := json.NewDecoder(r.Body).Decode(&decodedBody)
 
-		res := successResponse{
-			Id: chirp.ID,
-			CreatedAt: chirp.CreatedAt,
-			UpdatedAt: chirp.UpdatedAt,
-			Body: chirp.Body,
-			UserId: chirp.UserID,
+		if err != nil || !auth.IsRole(decodedBody.Role) {
+			utils.RespondWithError(w, 400, fmt.Sprintf("role must be one of %s", strings.Join(auth.Roles, ", ")))
+			return
 		}
 
-		utils.RespondWithJSon(w, 200, res)
-	})
-
-	refresh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		type SuccessResponse struct {
-			Token	string	`json:"token"`
-		}
+		tx, txQueries, user, ok := loadAdminTarget(w, r)
 
-		bearerToken, err := auth.GetBearerToken(&r.Header)
-	
-		if err != nil {
-			utils.RespondWithError(w, 401, "Invalid refresh token")
+		if !ok {
 			return
 		}
 
-		user, err := dbQueries.GetUserFromRefreshToken(r.Context(), sql.NullString{String: bearerToken, Valid: true})
+		defer tx.Rollback()
+
+		lastAdmin, err := isLastAdmin(r.Context(), txQueries, user)
 
 		if err != nil {
-			utils.RespondWithError(w, 401, "Invalid refresh token")
+			respondWithInternalError(w, r, err)
 			return
 		}
-		
-		tokenExpiration := user.ExpiresAt
-		isExpired := time.Now().After(tokenExpiration)
-
-		isRevoked := user.RevokedAt.Valid && !user.RevokedAt.Time.IsZero()
 
-		if isExpired || isRevoked {
-			utils.RespondWithError(w, 401, "Invalid refresh token")
+		if lastAdmin && decodedBody.Role != auth.RoleAdmin {
+			utils.RespondWithError(w, 409, "The last admin can't be demoted")
 			return
 		}
 
-		jwtToken, err := auth.MakeJWT(user.UserID, apiCfg.jwtSecret, time.Duration(3600) * time.Second)
+		updated, err := txQueries.SetUserRole(r.Context(), database.SetUserRoleParams{
+			Role: decodedBody.Role,
+			ID: user.ID,
+		})
 
 		if err != nil {
-			utils.RespondWithError(w, 500, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		response := SuccessResponse{
-			Token: jwtToken,
-		}
-
-		utils.RespondWithJSon(w, 200, response)
-	})
-
-	serveMux.Handle("POST /api/refresh", apiCfg.middlewareMetricsInc(refresh))
+		err = auditAdminAction(r, txQueries, "set_role", user.ID, map[string]any{
+			"from": user.Role,
+			"to": updated.Role,
+		})
 
-	revoke := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		bearerToken, err := auth.GetBearerToken(&r.Header)
-	
 		if err != nil {
-			utils.RespondWithError(w, 401, "Invalid refresh token")
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		err = dbQueries.RevokeToken(r.Context(), sql.NullString{String: bearerToken, Valid: true})
+		err = tx.Commit()
 
 		if err != nil {
-			utils.RespondWithError(w, 500, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		utils.RespondWithJSon(w, 204, nil)
+		utils.RespondWithJSon(w, 200, toAdminUserResponse(updated))
 	})
 
-	serveMux.Handle("POST /api/revoke", apiCfg.middlewareMetricsInc(revoke))
-	
-	serveMux.Handle("GET /api/chirps/{chirpID}", apiCfg.middlewareMetricsInc(getChirp))
+	serveMux.Handle("PUT /admin/users/{userID}/role", apiCfg.middlewareRequireRole(auth.RoleAdmin, setUserRole))
 
-	polkaHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		polApiKey, err := auth.GetApiKey(r.Header)
+	// Deleting a user deletes everything they own; the audit log keeps the
+	// email
+	deleteAdminUser := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tx, txQueries, user, ok := loadAdminTarget(w, r)
 
-		if err != nil {
-			utils.RespondWithError(w, 401, genericErrorMessage)
+		if !ok {
 			return
 		}
 
-		if polApiKey != apiCfg.polkaApiKey {
-			utils.RespondWithError(w, 401, genericErrorMessage)
+		defer tx.Rollback()
+
+		lastAdmin, err := isLastAdmin(r.Context(), txQueries, user)
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		type webhookData struct {
-			UserId	uuid.UUID	`json:"user_id"`
-		}
-		
-		type body struct {
-			Event	string			`json:"event"`
-			Data	webhookData	`json:"data"`
+		if lastAdmin {
+			utils.RespondWithError(w, 409, "The last admin can't be deleted")
+			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-
-		var decodedBody body
-		
-		err = decoder.Decode(&decodedBody)
+		_, err = txQueries.DeleteUser(r.Context(), user.ID)
 
 		if err != nil {
-			utils.RespondWithJSon(w, 400, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		if decodedBody.Event != "user.upgraded" {
-			utils.RespondWithJSon(w, 204, nil)
+		err = auditAdminAction(r, txQueries, "delete", user.ID, map[string]any{"email": user.Email})
+
+		if err != nil {
+			respondWithInternalError(w, r, err)
 			return
 		}
 
-		_, err = dbQueries.UpdateChirpyRedStatus(r.Context(), database.UpdateChirpyRedStatusParams{
-			UserID: uuid.NullUUID{ UUID: decodedBody.Data.UserId, Valid: true},
-			Status: sql.NullBool{ Bool: true, Valid: true },
-		})
+		err = tx.Commit()
 
 		if err != nil {
-			utils.RespondWithError(w, 404, genericErrorMessage)
+			respondWithInternalError(w, r, err)
 			return
 		}
 
 		utils.RespondWithJSon(w, 204, nil)
 	})
 
-	serveMux.Handle("POST /api/polka/webhooks", apiCfg.middlewareMetricsInc(polkaHandler))
+	serveMux.Handle("DELETE /admin/users/{userID}", apiCfg.middlewareRequireRole(auth.RoleAdmin, deleteAdminUser))
+
+	serveMux.Handle("POST /admin/reset", apiCfg.middlewareRequireRole(auth.RoleAdmin, resetHandler))
+	serveMux.Handle("POST /admin/fixtures/{name}", apiCfg.middlewareRequireRole(auth.RoleAdmin, loadFixture))
+
+	// Background jobs stop being scheduled on SIGINT or SIGTERM; runs in
+	// progress get until the drain deadline to finish
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	readiness := health.NewChecker(settings.Server.ReadinessTimeout)
+
+	readiness.Add("database", db.PingContext)
+
+	readiness.Add("migrations", migrator.Check)
+
+	readiness.Add("webhook_dispatcher", runPeriodically(signalCtx.Done(), jobsCtx, &jobs, "webhook_dispatcher", settings.Webhooks.DispatchInterval, dispatchWebhooks).Check)
+	readiness.Add("scheduled_chirps", runPeriodically(signalCtx.Done(), jobsCtx, &jobs, "scheduled_chirps", settings.Plans.ScheduledChirpsInterval, publishScheduledChirps).Check)
+	readiness.Add("subscription_expiry", runPeriodically(signalCtx.Done(), jobsCtx, &jobs, "subscription_expiry", settings.Subscriptions.ExpiryInterval, expireSubscriptions).Check)
+
+	// Probes bypass logging and metrics: they come every few seconds and
+	// would drown out real traffic
+	rootMux := http.NewServeMux()
+	rootMux.Handle("GET /livez", health.LivenessHandler())
+	rootMux.Handle("GET /readyz", readiness.ReadinessHandler())
+	rootMux.Handle("GET /api/healthz", healthHandler)
+	rootMux.Handle("/", middlewareLogging(apiCfg.metrics.middleware(middlewareMaxBodySize(settings.Server.MaxBodyBytes, serveMux))))
 
-	serveMux.Handle("POST /admin/reset", resetHandler) 
-	
 	server := &http.Server{
-		Addr: ":8080",
-		Handler: serveMux,
+		Addr: fmt.Sprintf(":%d", settings.Server.Port),
+		Handler: rootMux,
+		ReadHeaderTimeout: settings.Server.ReadHeaderTimeout,
+		ReadTimeout: settings.Server.ReadTimeout,
+		WriteTimeout: settings.Server.WriteTimeout,
+		IdleTimeout: settings.Server.IdleTimeout,
+		MaxHeaderBytes: settings.Server.MaxHeaderBytes,
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	shutdownTimeout := settings.Server.ShutdownTimeout
+
+	serverErr := make(chan error, 1)
+
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	slog.Info("listening", "addr", server.Addr)
+
+	select {
+	case err := <-serverErr:
+		slog.Error("server failed", "error", err)
+		exitCode = 1
+	case <-signalCtx.Done():
+	}
+
+	// A second signal kills the process without waiting. This also stops
+	// scheduling jobs when the server failed.
+	stopSignals()
+
+	slog.Info("shutting down", "timeout", shutdownTimeout.String())
+
+	// Keep serving while load balancers notice readiness failing
+	readiness.ShutDown()
+
+	if exitCode == 0 {
+		time.Sleep(settings.Server.ShutdownDelay)
+	}
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelDrain()
+
+	err = server.Shutdown(drainCtx)
+
+	if err != nil {
+		slog.Error("failed to drain requests", "error", err)
+		server.Close()
+	}
+
+	jobsDone := make(chan struct{})
+
+	go func() {
+		jobs.Wait()
+		close(jobsDone)
+	}()
+
+	select {
+	case <-jobsDone:
+	case <-drainCtx.Done():
+		slog.Error("background jobs did not finish in time, cancelling them")
+		cancelJobs()
+		<-jobsDone
 	}
 
-	server.ListenAndServe()
+	slog.Info("stopped")
 }
 
 
@@ -0,0 +1,9 @@
+-- name: CreateAdminAuditEntry :exec
+INSERT INTO admin_audit_log (id, created_at, actor_id, action, target_user_id, details, via_admin_token)
+VALUES (gen_random_uuid(), NOW(), @actor_id, @action, @target_user_id, @details, @via_admin_token);
+
+-- name: ListAdminAuditEntriesByTarget :many
+SELECT * FROM admin_audit_log
+WHERE target_user_id = @target_user_id
+ORDER BY created_at DESC
+LIMIT @max_entries;
\ No newline at end of file
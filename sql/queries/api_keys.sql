@@ -0,0 +1,38 @@
+-- name: CreateApiKey :one
+INSERT INTO api_keys (id, created_at, updated_at, user_id, name, prefix, hashed_key, scopes, expires_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    @user_id,
+    @name,
+    @prefix,
+    @hashed_key,
+    @scopes,
+    @expires_at
+)
+RETURNING *;
+
+-- name: GetApiKeyByHash :one
+SELECT * FROM api_keys
+WHERE hashed_key = $1;
+
+-- name: ListApiKeysByUser :many
+SELECT * FROM api_keys
+WHERE user_id = $1
+ORDER BY created_at DESC;
+
+-- name: RevokeApiKey :execrows
+UPDATE api_keys
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE id = @id AND user_id = @user_id AND revoked_at IS NULL;
+
+-- name: TouchApiKey :exec
+UPDATE api_keys
+SET last_used_at = NOW()
+WHERE id = $1;
+
+-- name: RevokeAllUserApiKeys :exec
+UPDATE api_keys
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL;
\ No newline at end of file
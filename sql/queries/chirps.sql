@@ -24,4 +24,24 @@ WHERE id=$1;
 
 -- name: DeleteChirp :exec
 DELETE FROM chirps
-WHERE id=$1;
\ No newline at end of file
+WHERE id=$1;
+
+-- name: UpdateChirpBody :one
+UPDATE chirps
+SET body = @body, updated_at = NOW()
+WHERE id = @id
+RETURNING *;
+
+-- name: CountChirpsByUserSince :one
+SELECT COUNT(*) FROM chirps
+WHERE user_id = @user_id AND created_at > @since;
+
+-- name: CountChirpsByUser :one
+SELECT COUNT(*) FROM chirps
+WHERE user_id = $1;
+
+-- name: OldestChirpByUserSince :one
+SELECT created_at FROM chirps
+WHERE user_id = @user_id AND created_at > @since
+ORDER BY created_at
+LIMIT 1;
\ No newline at end of file
@@ -0,0 +1,24 @@
+-- name: RecordFailedLogin :one
+UPDATE users
+SET failed_login_count = CASE
+        WHEN last_failed_login_at IS NULL OR last_failed_login_at < @reset_before THEN 1
+        ELSE failed_login_count + 1
+    END,
+    last_failed_login_at = NOW()
+WHERE id = @id
+RETURNING failed_login_count;
+
+-- name: LockUser :exec
+UPDATE users
+SET locked_until = @locked_until
+WHERE id = @id;
+
+-- name: ResetFailedLogins :exec
+UPDATE users
+SET failed_login_count = 0, last_failed_login_at = NULL, locked_until = NULL
+WHERE id = $1;
+
+-- name: ListLockedUsers :many
+SELECT id, email, failed_login_count, last_failed_login_at, locked_until FROM users
+WHERE locked_until > NOW()
+ORDER BY locked_until DESC;
\ No newline at end of file
@@ -0,0 +1,49 @@
+-- name: CreateOauthClient :one
+INSERT INTO oauth_clients (id, created_at, updated_at, user_id, name, hashed_secret, redirect_uris, scopes)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    @user_id,
+    @name,
+    @hashed_secret,
+    @redirect_uris,
+    @scopes
+)
+RETURNING *;
+
+-- name: GetOauthClient :one
+SELECT * FROM oauth_clients
+WHERE id = $1;
+
+-- name: ListOauthClientsByUser :many
+SELECT * FROM oauth_clients
+WHERE user_id = $1
+ORDER BY created_at DESC;
+
+-- name: DeleteOauthClient :execrows
+DELETE FROM oauth_clients
+WHERE id = @id AND user_id = @user_id;
+
+-- name: CreateOauthAuthorizationCode :exec
+INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, created_at, expires_at, used_at)
+VALUES (@code_hash, @client_id, @user_id, @redirect_uri, @scopes, @code_challenge, NOW(), @expires_at, NULL);
+
+-- name: ConsumeOauthAuthorizationCode :one
+UPDATE oauth_authorization_codes
+SET used_at = NOW()
+WHERE code_hash = @code_hash AND client_id = @client_id AND used_at IS NULL AND expires_at > NOW()
+RETURNING *;
+
+-- name: CreateOauthRefreshToken :exec
+INSERT INTO tokens (token, user_id, expires_at, created_at, updated_at, revoked_at, client_id, scopes)
+VALUES (@token, @user_id, @expires_at, NOW(), NOW(), NULL, @client_id, @scopes);
+
+-- name: GetOauthRefreshToken :one
+SELECT * FROM tokens
+WHERE token = @token AND client_id = @client_id;
+
+-- name: RevokeOauthRefreshToken :exec
+UPDATE tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE token = @token AND client_id = @client_id;
\ No newline at end of file
@@ -0,0 +1,106 @@
+-- name: CreateWebhookEndpoint :one
+INSERT INTO webhook_endpoints (id, created_at, updated_at, user_id, url, secret, event_types, enabled, consecutive_failures)
+VALUES (gen_random_uuid(), NOW(), NOW(), @user_id, @url, @secret, @event_types, TRUE, 0)
+RETURNING *;
+
+-- name: ListWebhookEndpointsByUser :many
+SELECT * FROM webhook_endpoints
+WHERE user_id = $1
+ORDER BY created_at;
+
+-- name: CountWebhookEndpointsByUser :one
+SELECT COUNT(*) FROM webhook_endpoints
+WHERE user_id = $1;
+
+-- name: GetWebhookEndpoint :one
+SELECT * FROM webhook_endpoints
+WHERE id = @id AND user_id = @user_id;
+
+-- name: DeleteWebhookEndpoint :execrows
+DELETE FROM webhook_endpoints
+WHERE id = @id AND user_id = @user_id;
+
+-- name: EnableWebhookEndpoint :execrows
+UPDATE webhook_endpoints
+SET enabled = TRUE, consecutive_failures = 0, disabled_at = NULL, disabled_reason = NULL, updated_at = NOW()
+WHERE id = @id AND user_id = @user_id;
+
+-- name: DisableWebhookEndpoint :exec
+UPDATE webhook_endpoints
+SET enabled = FALSE, disabled_at = NOW(), disabled_reason = @reason, updated_at = NOW()
+WHERE id = @id;
+
+-- name: RecordWebhookEndpointFailure :one
+UPDATE webhook_endpoints
+SET consecutive_failures = consecutive_failures + 1
+WHERE id = $1
+RETURNING consecutive_failures;
+
+-- name: ResetWebhookEndpointFailures :exec
+UPDATE webhook_endpoints
+SET consecutive_failures = 0
+WHERE id = $1;
+
+-- name: CreateWebhookOutboxEvent :exec
+INSERT INTO webhook_outbox (id, created_at, user_id, event_type, payload)
+VALUES (@id, NOW(), @user_id, @event_type, @payload);
+
+-- name: ListWebhookOutboxEvents :many
+SELECT * FROM webhook_outbox
+ORDER BY created_at
+LIMIT @max_events;
+
+-- name: DeleteWebhookOutboxEvent :execrows
+DELETE FROM webhook_outbox
+WHERE id = $1;
+
+-- name: EnqueueWebhookDeliveries :execrows
+INSERT INTO webhook_deliveries (id, created_at, endpoint_id, event_id, event_type, payload, status, attempts, next_attempt_at)
+SELECT gen_random_uuid(), NOW(), id, @event_id, @event_type, @payload, 'pending', 0, NOW()
+FROM webhook_endpoints
+WHERE user_id = @owner_id AND enabled AND (' ' || event_types || ' ') LIKE ('% ' || @event_type || ' %');
+
+-- name: ListDueWebhookDeliveries :many
+SELECT webhook_deliveries.*, webhook_endpoints.url, webhook_endpoints.secret
+FROM webhook_deliveries
+JOIN webhook_endpoints ON webhook_endpoints.id = webhook_deliveries.endpoint_id
+WHERE webhook_deliveries.status = 'pending'
+  AND webhook_deliveries.next_attempt_at <= NOW()
+  AND webhook_endpoints.enabled
+ORDER BY webhook_deliveries.next_attempt_at
+LIMIT @max_deliveries;
+
+-- name: ClaimWebhookDelivery :execrows
+UPDATE webhook_deliveries
+SET next_attempt_at = @lease_until
+WHERE id = @id AND status = 'pending' AND next_attempt_at <= NOW();
+
+-- name: FinishWebhookDeliveryAttempt :exec
+UPDATE webhook_deliveries
+SET status = @status,
+    attempts = attempts + 1,
+    next_attempt_at = @next_attempt_at,
+    last_attempt_at = NOW(),
+    last_response_status = @last_response_status,
+    last_error = @last_error,
+    delivered_at = CASE WHEN @status = 'delivered' THEN NOW() ELSE NULL END
+WHERE id = @id;
+
+-- name: CreateWebhookDeliveryAttempt :exec
+INSERT INTO webhook_delivery_attempts (id, delivery_id, attempted_at, response_status, error, duration_ms)
+VALUES (gen_random_uuid(), @delivery_id, NOW(), @response_status, @error, @duration_ms);
+
+-- name: ListWebhookDeliveriesByEndpoint :many
+SELECT * FROM webhook_deliveries
+WHERE endpoint_id = @endpoint_id
+ORDER BY created_at DESC
+LIMIT @max_deliveries;
+
+-- name: ListWebhookDeliveryAttempts :many
+SELECT * FROM webhook_delivery_attempts
+WHERE delivery_id = $1
+ORDER BY attempted_at;
+
+-- name: GetWebhookDelivery :one
+SELECT * FROM webhook_deliveries
+WHERE id = @id AND endpoint_id = @endpoint_id;
\ No newline at end of file
@@ -4,7 +4,7 @@ VALUES (@token, @user_id, @expires_at, NOW(), NOW(), NULL)
 RETURNING token, created_at, updated_at, user_id, expires_at, revoked_at;
 
 -- name: GetUserFromRefreshToken :one
-SELECT token, user_id, expires_at, tokens.created_at, tokens.updated_at, revoked_at
+SELECT token, user_id, expires_at, tokens.created_at, tokens.updated_at, revoked_at, client_id
 FROM tokens
 INNER JOIN users ON users.id = tokens.user_id
 WHERE token=$1;
@@ -12,4 +12,14 @@ WHERE token=$1;
 -- name: RevokeToken :exec
 UPDATE tokens
 SET revoked_at = NOW(), updated_at = NOW()
-WHERE token = @token; 
\ No newline at end of file
+WHERE token = @token;
+
+-- name: RevokeAllUserTokens :exec
+UPDATE tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL;
+
+-- name: ListActiveSessionsByUser :many
+SELECT created_at, expires_at, client_id FROM tokens
+WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+ORDER BY created_at DESC;
\ No newline at end of file
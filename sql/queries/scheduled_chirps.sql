@@ -0,0 +1,37 @@
+-- name: CreateScheduledChirp :one
+INSERT INTO scheduled_chirps (id, created_at, user_id, body, publish_at)
+VALUES (gen_random_uuid(), NOW(), @user_id, @body, @publish_at)
+RETURNING *;
+
+-- name: ListScheduledChirpsByUser :many
+SELECT * FROM scheduled_chirps
+WHERE user_id = $1
+ORDER BY publish_at;
+
+-- name: CountPendingScheduledChirps :one
+SELECT COUNT(*) FROM scheduled_chirps
+WHERE user_id = $1 AND error IS NULL;
+
+-- name: DeleteScheduledChirp :execrows
+DELETE FROM scheduled_chirps
+WHERE id = @id AND user_id = @user_id;
+
+-- name: ListDueScheduledChirps :many
+SELECT * FROM scheduled_chirps
+WHERE publish_at <= NOW() AND error IS NULL
+ORDER BY publish_at
+LIMIT @max_chirps;
+
+-- name: ClaimScheduledChirp :execrows
+DELETE FROM scheduled_chirps
+WHERE id = $1 AND error IS NULL;
+
+-- name: FailScheduledChirp :exec
+UPDATE scheduled_chirps
+SET error = @error
+WHERE id = @id;
+
+-- name: RescheduleScheduledChirp :exec
+UPDATE scheduled_chirps
+SET publish_at = @publish_at
+WHERE id = @id;
\ No newline at end of file
@@ -0,0 +1,23 @@
+-- name: GetSubscriptionByUser :one
+SELECT * FROM subscriptions
+WHERE user_id = $1;
+
+-- name: UpsertSubscription :one
+INSERT INTO subscriptions (id, created_at, updated_at, user_id, plan, status, current_period_end, grace_period_end, cancelled_at)
+VALUES (gen_random_uuid(), NOW(), NOW(), @user_id, @plan, @status, @current_period_end, @grace_period_end, @cancelled_at)
+ON CONFLICT (user_id) DO UPDATE
+SET plan = excluded.plan,
+    status = excluded.status,
+    current_period_end = excluded.current_period_end,
+    grace_period_end = excluded.grace_period_end,
+    cancelled_at = excluded.cancelled_at,
+    updated_at = NOW()
+RETURNING *;
+
+-- name: ExpireLapsedSubscriptions :many
+UPDATE subscriptions
+SET status = 'expired', updated_at = NOW()
+WHERE status IN ('active', 'cancelled', 'past_due')
+  AND current_period_end <= NOW()
+  AND (grace_period_end IS NULL OR grace_period_end <= NOW())
+RETURNING user_id;
\ No newline at end of file
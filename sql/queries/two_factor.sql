@@ -0,0 +1,41 @@
+-- name: SetTotpSecret :exec
+UPDATE users
+SET totp_secret = @totp_secret, totp_enabled_at = NULL, updated_at = NOW()
+WHERE id = @id;
+
+-- name: EnableTotp :exec
+UPDATE users
+SET totp_enabled_at = NOW(), totp_last_counter = @totp_last_counter, updated_at = NOW()
+WHERE id = @id;
+
+-- name: DisableTotp :exec
+UPDATE users
+SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_counter = 0, updated_at = NOW()
+WHERE id = @id;
+
+-- name: UseTotpCounter :execrows
+UPDATE users
+SET totp_last_counter = @totp_last_counter
+WHERE id = @id AND totp_last_counter < @totp_last_counter;
+
+-- name: CreateRecoveryCode :exec
+INSERT INTO recovery_codes (id, user_id, code_hash, created_at, used_at)
+VALUES (gen_random_uuid(), @user_id, @code_hash, NOW(), NULL);
+
+-- name: UseRecoveryCode :execrows
+UPDATE recovery_codes
+SET used_at = NOW()
+WHERE user_id = @user_id AND code_hash = @code_hash AND used_at IS NULL;
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM recovery_codes
+WHERE user_id = $1;
+
+-- name: UseTwoFactorChallenge :execrows
+INSERT INTO two_factor_challenges (jti, user_id, used_at, expires_at)
+VALUES (@jti, @user_id, NOW(), @expires_at)
+ON CONFLICT (jti) DO NOTHING;
+
+-- name: DeleteExpiredTwoFactorChallenges :exec
+DELETE FROM two_factor_challenges
+WHERE expires_at <= NOW();
\ No newline at end of file
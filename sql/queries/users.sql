@@ -10,20 +10,85 @@ VALUES (
 RETURNING *;
 
 -- name: GetUser :one
-SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red FROM users
+SELECT * FROM users
 WHERE email=$1;
 
+-- name: GetUserByID :one
+SELECT * FROM users
+WHERE id=$1;
+
 -- name: ClearUsers :exec
 DELETE FROM users;
 
 -- name: UpdateUser :one
 UPDATE users
-SET hashed_password=$2, email=$3
+SET hashed_password=$2, email=$3,
+    email_verified_at = CASE WHEN email = $3 THEN email_verified_at ELSE NULL END
 WHERE id=$1
 RETURNING *;
 
--- name: UpdateChirpyRedStatus :one
+-- name: SyncChirpyRedStatus :one
+UPDATE users
+SET is_chirpy_red = EXISTS (
+    SELECT 1 FROM subscriptions
+    WHERE subscriptions.user_id = users.id
+      AND status IN ('active', 'cancelled', 'past_due')
+      AND (current_period_end IS NULL OR current_period_end > NOW() OR grace_period_end > NOW())
+)
+WHERE id = @id
+RETURNING *;
+
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET hashed_password = @hashed_password, updated_at = NOW()
+WHERE id = @id;
+
+-- name: SetUserRole :one
+UPDATE users
+SET role = @role, updated_at = NOW()
+WHERE id = @id
+RETURNING *;
+
+-- name: CountUsersWithRole :one
+SELECT COUNT(*) FROM users
+WHERE role = $1;
+
+-- name: ListUsers :many
+SELECT * FROM users
+WHERE LOWER(email) LIKE '%' || LOWER(@search) || '%' ESCAPE '\'
+ORDER BY created_at, id
+LIMIT @max_users OFFSET @skip;
+
+-- name: CountUsers :one
+SELECT COUNT(*) FROM users
+WHERE LOWER(email) LIKE '%' || LOWER(@search) || '%' ESCAPE '\';
+
+-- name: SetChirpyRed :one
+UPDATE users
+SET is_chirpy_red = @is_chirpy_red, updated_at = NOW()
+WHERE id = @id
+RETURNING *;
+
+-- name: DeleteUser :execrows
+DELETE FROM users
+WHERE id = $1;
+
+-- name: SetTokensValidAfter :exec
 UPDATE users
-SET is_chirpy_red = @status
-WHERE id = @user_id
-RETURNING *;
\ No newline at end of file
+SET tokens_valid_after = @tokens_valid_after, updated_at = NOW()
+WHERE id = @id;
+
+-- name: GetUserTokensValidAfter :one
+SELECT tokens_valid_after FROM users
+WHERE id = $1;
+
+-- name: LockUsersWithRole :many
+SELECT id FROM users
+WHERE role = $1
+ORDER BY id
+FOR UPDATE;
+
+-- name: GetUserForUpdate :one
+SELECT * FROM users
+WHERE id = $1
+FOR UPDATE;
\ No newline at end of file
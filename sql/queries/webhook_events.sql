@@ -0,0 +1,34 @@
+-- name: CreateWebhookEvent :one
+INSERT INTO webhook_events (id, source, event_id, event_type, payload, status, error, attempts, received_at, last_attempt_at)
+VALUES (gen_random_uuid(), @source, @event_id, @event_type, @payload, 'received', NULL, 0, NOW(), NULL)
+ON CONFLICT (source, event_id) DO NOTHING
+RETURNING *;
+
+-- name: GetWebhookEvent :one
+SELECT * FROM webhook_events
+WHERE id = $1;
+
+-- name: GetWebhookEventByEventID :one
+SELECT * FROM webhook_events
+WHERE source = @source AND event_id = @event_id;
+
+-- name: ListWebhookEvents :many
+SELECT * FROM webhook_events
+WHERE status = @status OR @status = ''
+ORDER BY received_at DESC
+LIMIT @max_events;
+
+-- name: ClaimWebhookEvent :execrows
+UPDATE webhook_events
+SET status = 'processing'
+WHERE id = $1 AND status IN ('received', 'failed');
+
+-- name: FinishWebhookEvent :exec
+UPDATE webhook_events
+SET status = @status, error = @error, attempts = attempts + 1, last_attempt_at = NOW()
+WHERE id = @id;
+
+-- name: ResetWebhookEvent :execrows
+UPDATE webhook_events
+SET status = 'received'
+WHERE id = $1 AND status <> 'processing';
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- +goose Up
+-- tokens.token now holds the SHA-256 hex digest of the refresh token
+UPDATE tokens SET token = encode(sha256(convert_to(token, 'UTF8')), 'hex');
+
+-- +goose Down
+-- digests can't be turned back into tokens, so existing sessions are dropped
+DELETE FROM tokens;
\ No newline at end of file
@@ -0,0 +1,36 @@
+-- +goose Up
+CREATE TABLE oauth_clients (
+  id UUID PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id UUID NOT NULL REFERENCES users ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  -- NULL for public clients (mobile and single page apps), which rely on PKCE alone
+  hashed_secret TEXT,
+  redirect_uris TEXT NOT NULL,
+  scopes TEXT NOT NULL
+);
+
+CREATE INDEX oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+CREATE TABLE oauth_authorization_codes (
+  code_hash TEXT NOT NULL PRIMARY KEY,
+  client_id UUID NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users ON DELETE CASCADE,
+  redirect_uri TEXT NOT NULL,
+  scopes TEXT NOT NULL,
+  code_challenge TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  used_at TIMESTAMP
+);
+
+-- Refresh tokens issued to OAuth clients are limited to the granted scopes
+ALTER TABLE tokens ADD COLUMN client_id UUID REFERENCES oauth_clients ON DELETE CASCADE;
+ALTER TABLE tokens ADD COLUMN scopes TEXT;
+
+-- +goose Down
+ALTER TABLE tokens DROP COLUMN scopes;
+ALTER TABLE tokens DROP COLUMN client_id;
+DROP TABLE oauth_authorization_codes;
+DROP TABLE oauth_clients;
\ No newline at end of file
@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE user_identities (
+  id UUID PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id UUID NOT NULL REFERENCES users ON DELETE CASCADE,
+  provider TEXT NOT NULL,
+  -- the provider's "sub" claim, stable unlike the email address
+  subject TEXT NOT NULL,
+  email TEXT NOT NULL,
+  last_login_at TIMESTAMP,
+  UNIQUE (provider, subject)
+);
+
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+
+CREATE TABLE oidc_login_states (
+  state_hash TEXT NOT NULL PRIMARY KEY,
+  provider TEXT NOT NULL,
+  nonce TEXT NOT NULL,
+  code_verifier TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
+
+-- +goose Down
+DROP TABLE oidc_login_states;
+DROP TABLE user_identities;
\ No newline at end of file
@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE webhook_events (
+  id UUID PRIMARY KEY,
+  source TEXT NOT NULL,
+  -- the sender's id for the event, used to drop duplicate deliveries
+  event_id TEXT NOT NULL,
+  event_type TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  -- received, processing, processed, ignored or failed
+  status TEXT NOT NULL,
+  error TEXT,
+  attempts INTEGER NOT NULL,
+  received_at TIMESTAMP NOT NULL,
+  last_attempt_at TIMESTAMP,
+  UNIQUE (source, event_id)
+);
+
+CREATE INDEX webhook_events_status_idx ON webhook_events (status, received_at);
+
+-- +goose Down
+DROP TABLE webhook_events;
\ No newline at end of file
@@ -0,0 +1,24 @@
+-- +goose Up
+CREATE TABLE subscriptions (
+  id UUID PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id UUID NOT NULL UNIQUE REFERENCES users ON DELETE CASCADE,
+  plan TEXT NOT NULL,
+  -- active, cancelled, past_due, expired or refunded
+  status TEXT NOT NULL,
+  -- NULL for subscriptions that run until they are cancelled
+  current_period_end TIMESTAMP,
+  grace_period_end TIMESTAMP,
+  cancelled_at TIMESTAMP
+);
+
+CREATE INDEX subscriptions_period_end_idx ON subscriptions (status, current_period_end);
+
+-- Existing Chirpy Red members keep it until Polka says otherwise
+INSERT INTO subscriptions (id, created_at, updated_at, user_id, plan, status)
+SELECT gen_random_uuid(), NOW(), NOW(), id, 'chirpy_red', 'active' FROM users
+WHERE is_chirpy_red;
+
+-- +goose Down
+DROP TABLE subscriptions;
\ No newline at end of file
@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE scheduled_chirps (
+  id UUID PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  user_id UUID NOT NULL REFERENCES users ON DELETE CASCADE,
+  body TEXT NOT NULL,
+  publish_at TIMESTAMP NOT NULL,
+  -- why publishing failed; failed chirps are not retried
+  error TEXT
+);
+
+CREATE INDEX scheduled_chirps_publish_at_idx ON scheduled_chirps (publish_at);
+
+-- Hourly chirp limits count a user's recent chirps
+CREATE INDEX chirps_user_id_created_at_idx ON chirps (user_id, created_at);
+
+-- +goose Down
+DROP INDEX chirps_user_id_created_at_idx;
+DROP TABLE scheduled_chirps;
\ No newline at end of file
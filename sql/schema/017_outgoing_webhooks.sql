@@ -0,0 +1,56 @@
+-- +goose Up
+CREATE TABLE webhook_endpoints (
+  id UUID PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id UUID NOT NULL REFERENCES users ON DELETE CASCADE,
+  url TEXT NOT NULL,
+  -- kept in clear text because every delivery is signed with it
+  secret TEXT NOT NULL,
+  -- space separated
+  event_types TEXT NOT NULL,
+  enabled BOOLEAN NOT NULL,
+  consecutive_failures INTEGER NOT NULL,
+  disabled_at TIMESTAMP,
+  disabled_reason TEXT
+);
+
+CREATE INDEX webhook_endpoints_user_id_idx ON webhook_endpoints (user_id);
+
+-- The outbox: one row per event and endpoint
+CREATE TABLE webhook_deliveries (
+  id UUID PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  endpoint_id UUID NOT NULL REFERENCES webhook_endpoints ON DELETE CASCADE,
+  event_id UUID NOT NULL,
+  event_type TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  -- pending, delivered or failed
+  status TEXT NOT NULL,
+  attempts INTEGER NOT NULL,
+  next_attempt_at TIMESTAMP NOT NULL,
+  last_attempt_at TIMESTAMP,
+  last_response_status INTEGER,
+  last_error TEXT,
+  delivered_at TIMESTAMP
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt_at);
+CREATE INDEX webhook_deliveries_endpoint_id_idx ON webhook_deliveries (endpoint_id, created_at);
+
+CREATE TABLE webhook_delivery_attempts (
+  id UUID PRIMARY KEY,
+  delivery_id UUID NOT NULL REFERENCES webhook_deliveries ON DELETE CASCADE,
+  attempted_at TIMESTAMP NOT NULL,
+  -- NULL when no response was received
+  response_status INTEGER,
+  error TEXT,
+  duration_ms INTEGER NOT NULL
+);
+
+CREATE INDEX webhook_delivery_attempts_delivery_id_idx ON webhook_delivery_attempts (delivery_id);
+
+-- +goose Down
+DROP TABLE webhook_delivery_attempts;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhook_endpoints;
\ No newline at end of file
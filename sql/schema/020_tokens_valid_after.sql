@@ -0,0 +1,7 @@
+-- +goose Up
+-- Access tokens issued before this time are rejected. Set when a password is
+-- reset, so stolen tokens stop working before they expire.
+ALTER TABLE users ADD COLUMN tokens_valid_after TIMESTAMP;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN tokens_valid_after;
\ No newline at end of file
@@ -0,0 +1,12 @@
+-- +goose Up
+-- Challenges from POST /api/login that were redeemed, by their jti, so each
+-- can only be used once. Rows are removed once the challenge has expired.
+CREATE TABLE two_factor_challenges (
+  jti TEXT PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users ON DELETE CASCADE,
+  used_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
+
+-- +goose Down
+DROP TABLE two_factor_challenges;
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- +goose Up
+-- Whether the actor used the admin token rather than a session. Entries from
+-- before the admin token was assigned to an account have no actor_id.
+ALTER TABLE admin_audit_log ADD COLUMN via_admin_token BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE admin_audit_log DROP COLUMN via_admin_token;
\ No newline at end of file
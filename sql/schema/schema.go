@@ -0,0 +1,16 @@
+// Package schema embeds the goose migrations in this directory, so the
+// chirpy binary can apply them itself.
+package schema
+
+import "embed"
+
+// Migrations are the Postgres migrations.
+//
+//go:embed *.sql
+var Migrations embed.FS
+
+// SQLiteMigrations are the SQLite migrations, in the sqlite directory. They
+// must be kept in step with the Postgres ones.
+//
+//go:embed sqlite/*.sql
+var SQLiteMigrations embed.FS
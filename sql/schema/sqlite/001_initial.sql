@@ -0,0 +1,236 @@
+-- +goose Up
+-- The schema of the Postgres migrations up to 017, for SQLite. UUIDs are
+-- stored as text; columns are in the same order, as queries SELECT *.
+CREATE TABLE users (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  email TEXT NOT NULL UNIQUE,
+  hashed_password TEXT NOT NULL DEFAULT 'unset',
+  is_chirpy_red BOOLEAN NOT NULL DEFAULT FALSE,
+  email_verified_at TIMESTAMP,
+  totp_secret TEXT,
+  totp_enabled_at TIMESTAMP,
+  totp_last_counter BIGINT NOT NULL DEFAULT 0,
+  failed_login_count INTEGER NOT NULL DEFAULT 0,
+  last_failed_login_at TIMESTAMP,
+  locked_until TIMESTAMP
+);
+
+CREATE TABLE chirps (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  body TEXT NOT NULL UNIQUE,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE
+);
+
+CREATE INDEX chirps_user_id_created_at_idx ON chirps (user_id, created_at);
+
+CREATE TABLE oauth_clients (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  hashed_secret TEXT,
+  redirect_uris TEXT NOT NULL,
+  scopes TEXT NOT NULL
+);
+
+CREATE INDEX oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+CREATE TABLE tokens (
+  token TEXT NOT NULL PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  expires_at TIMESTAMP NOT NULL,
+  revoked_at TIMESTAMP,
+  client_id TEXT REFERENCES oauth_clients ON DELETE CASCADE,
+  scopes TEXT
+);
+
+CREATE TABLE api_keys (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  prefix TEXT NOT NULL,
+  hashed_key TEXT NOT NULL UNIQUE,
+  scopes TEXT NOT NULL,
+  expires_at TIMESTAMP,
+  last_used_at TIMESTAMP,
+  revoked_at TIMESTAMP
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
+
+CREATE TABLE password_reset_tokens (
+  token_hash TEXT NOT NULL PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  used_at TIMESTAMP
+);
+
+CREATE TABLE email_verification_tokens (
+  token_hash TEXT NOT NULL PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  email TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  used_at TIMESTAMP
+);
+
+CREATE TABLE recovery_codes (
+  id TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  used_at TIMESTAMP
+);
+
+CREATE INDEX recovery_codes_user_id_idx ON recovery_codes (user_id);
+
+CREATE TABLE oauth_authorization_codes (
+  code_hash TEXT NOT NULL PRIMARY KEY,
+  client_id TEXT NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  redirect_uri TEXT NOT NULL,
+  scopes TEXT NOT NULL,
+  code_challenge TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  used_at TIMESTAMP
+);
+
+CREATE TABLE user_identities (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  provider TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  email TEXT NOT NULL,
+  last_login_at TIMESTAMP,
+  UNIQUE (provider, subject)
+);
+
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+
+CREATE TABLE oidc_login_states (
+  state_hash TEXT NOT NULL PRIMARY KEY,
+  provider TEXT NOT NULL,
+  nonce TEXT NOT NULL,
+  code_verifier TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE webhook_events (
+  id TEXT PRIMARY KEY,
+  source TEXT NOT NULL,
+  event_id TEXT NOT NULL,
+  event_type TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  status TEXT NOT NULL,
+  error TEXT,
+  attempts INTEGER NOT NULL,
+  received_at TIMESTAMP NOT NULL,
+  last_attempt_at TIMESTAMP,
+  UNIQUE (source, event_id)
+);
+
+CREATE INDEX webhook_events_status_idx ON webhook_events (status, received_at);
+
+CREATE TABLE subscriptions (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id TEXT NOT NULL UNIQUE REFERENCES users ON DELETE CASCADE,
+  plan TEXT NOT NULL,
+  status TEXT NOT NULL,
+  current_period_end TIMESTAMP,
+  grace_period_end TIMESTAMP,
+  cancelled_at TIMESTAMP
+);
+
+CREATE INDEX subscriptions_period_end_idx ON subscriptions (status, current_period_end);
+
+CREATE TABLE scheduled_chirps (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  body TEXT NOT NULL,
+  publish_at TIMESTAMP NOT NULL,
+  error TEXT
+);
+
+CREATE INDEX scheduled_chirps_publish_at_idx ON scheduled_chirps (publish_at);
+
+CREATE TABLE webhook_endpoints (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  event_types TEXT NOT NULL,
+  enabled BOOLEAN NOT NULL,
+  consecutive_failures INTEGER NOT NULL,
+  disabled_at TIMESTAMP,
+  disabled_reason TEXT
+);
+
+CREATE INDEX webhook_endpoints_user_id_idx ON webhook_endpoints (user_id);
+
+CREATE TABLE webhook_deliveries (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  endpoint_id TEXT NOT NULL REFERENCES webhook_endpoints ON DELETE CASCADE,
+  event_id TEXT NOT NULL,
+  event_type TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  status TEXT NOT NULL,
+  attempts INTEGER NOT NULL,
+  next_attempt_at TIMESTAMP NOT NULL,
+  last_attempt_at TIMESTAMP,
+  last_response_status INTEGER,
+  last_error TEXT,
+  delivered_at TIMESTAMP
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt_at);
+CREATE INDEX webhook_deliveries_endpoint_id_idx ON webhook_deliveries (endpoint_id, created_at);
+
+CREATE TABLE webhook_delivery_attempts (
+  id TEXT PRIMARY KEY,
+  delivery_id TEXT NOT NULL REFERENCES webhook_deliveries ON DELETE CASCADE,
+  attempted_at TIMESTAMP NOT NULL,
+  response_status INTEGER,
+  error TEXT,
+  duration_ms INTEGER NOT NULL
+);
+
+CREATE INDEX webhook_delivery_attempts_delivery_id_idx ON webhook_delivery_attempts (delivery_id);
+
+-- +goose Down
+DROP TABLE webhook_delivery_attempts;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhook_endpoints;
+DROP TABLE scheduled_chirps;
+DROP TABLE subscriptions;
+DROP TABLE webhook_events;
+DROP TABLE oidc_login_states;
+DROP TABLE user_identities;
+DROP TABLE oauth_authorization_codes;
+DROP TABLE recovery_codes;
+DROP TABLE email_verification_tokens;
+DROP TABLE password_reset_tokens;
+DROP TABLE api_keys;
+DROP TABLE tokens;
+DROP TABLE oauth_clients;
+DROP TABLE chirps;
+DROP TABLE users;
\ No newline at end of file
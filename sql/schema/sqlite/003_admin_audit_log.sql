@@ -0,0 +1,17 @@
+-- +goose Up
+-- What admins did to accounts. Entries outlive the users they mention.
+CREATE TABLE admin_audit_log (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  -- NULL when the admin token was used
+  actor_id TEXT,
+  action TEXT NOT NULL,
+  target_user_id TEXT NOT NULL,
+  -- a JSON object describing the change
+  details TEXT NOT NULL
+);
+
+CREATE INDEX admin_audit_log_target_user_id_idx ON admin_audit_log (target_user_id, created_at);
+
+-- +goose Down
+DROP TABLE admin_audit_log;
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- +goose Up
+-- Set when a signed in user is linking an identity to their account rather
+-- than signing in with it
+ALTER TABLE oidc_login_states ADD COLUMN link_user_id TEXT REFERENCES users ON DELETE CASCADE;
+
+-- +goose Down
+ALTER TABLE oidc_login_states DROP COLUMN link_user_id;
\ No newline at end of file
@@ -0,0 +1,16 @@
+-- +goose Up
+-- Events waiting to be fanned out into webhook_deliveries by the dispatcher,
+-- so a change only writes one row in its transaction
+CREATE TABLE webhook_outbox (
+  id TEXT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  -- the owner of the changed resource; only their endpoints get the event
+  user_id TEXT NOT NULL REFERENCES users ON DELETE CASCADE,
+  event_type TEXT NOT NULL,
+  payload TEXT NOT NULL
+);
+
+CREATE INDEX webhook_outbox_created_at_idx ON webhook_outbox (created_at);
+
+-- +goose Down
+DROP TABLE webhook_outbox;
\ No newline at end of file